@@ -1,71 +1,372 @@
 package ca
 
 import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"log"
+	"math/big"
+	"net"
 	"os"
-	"sync"
+	"path/filepath"
+	"strings"
+	"time"
 
-	"github.com/kairoaraujo/goca"
+	"golang.org/x/net/publicsuffix"
+	"golang.org/x/sync/singleflight"
+	"inivisirisk.com/pse/config"
+	"inivisirisk.com/pse/metrics"
+	"inivisirisk.com/pse/utils"
+	"software.sslmate.com/src/go-pkcs12"
 )
 
 type CA struct {
-	rootCa *goca.CA
-	mutex  sync.Mutex
+	cert *x509.Certificate
+	key  crypto.Signer
+	// chain holds the certificates above cert when it is an intermediate
+	chain []*x509.Certificate
+
+	// leaves caches the leaf certificates issued, by name
+	leaves       *utils.LRU[string, *tls.Certificate]
+	issuing      singleflight.Group
+	leafValidity time.Duration
+	renewBefore  time.Duration
 }
 
-// Define the GOCAPTH (Default is current dir)
+// NewCA loads or creates the CA from the current configuration
 func NewCA() *CA {
-	os.Setenv("CAPATH", "/tmp/ca")
+	ca, err := New(config.Cfg().CA)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return ca
+}
+
+// New loads the CA given by cfg. A configured certificate and key, or a
+// PKCS#12 bundle, take precedence over the generated root kept in cfg.Dir.
+func New(cfg config.CA) (*CA, error) {
+	var (
+		ca  *CA
+		err error
+	)
+	switch {
+	case cfg.PKCS12 != "":
+		ca, err = loadPKCS12(cfg.PKCS12, cfg.PKCS12Password)
+	case cfg.Cert != "" || cfg.Key != "":
+		ca, err = loadPEM(cfg.Cert, cfg.Key)
+	default:
+		ca, err = loadOrCreateRoot(cfg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !ca.cert.IsCA || ca.cert.KeyUsage&x509.KeyUsageCertSign == 0 {
+		return nil, fmt.Errorf("certificate %v is not a signing CA", ca.cert.Subject)
+	}
+	def := config.DefaultCA()
+	if cfg.LeafValidDays <= 0 {
+		cfg.LeafValidDays = def.LeafValidDays
+	}
+	if cfg.LeafCacheSize <= 0 {
+		cfg.LeafCacheSize = def.LeafCacheSize
+	}
+	ca.leaves = utils.NewLRU[string, *tls.Certificate](cfg.LeafCacheSize)
+	ca.leafValidity = time.Duration(cfg.LeafValidDays) * 24 * time.Hour
+	ca.renewBefore = ca.leafValidity / 3
+	return ca, nil
+}
 
-	// RootCAIdentity for creation
-	rootCAIdentity := goca.Identity{
-		Organization:       "InvisiRisk, Inc.",
-		OrganizationalUnit: "PSE-Proxy Certificates",
-		Country:            "US",
-		Locality:           "Houston",
-		Province:           "Texas",
-		Intermediate:       false,
+func loadPEM(certFile, keyFile string) (*CA, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("both CA certificate and key files are required")
 	}
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading CA certificate: %w", err)
+	}
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading CA key: %w", err)
+	}
+	return parseKeyPair(certPEM, keyPEM)
+}
 
-	// (1) Create the New Root CA or loads existent from disk ($CAPATH)
-	rootCA, err := goca.New("invisirisk.com", rootCAIdentity)
+func loadPKCS12(file, password string) (*CA, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading CA bundle: %w", err)
+	}
+	key, cert, chain, err := pkcs12.DecodeChain(data, password)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding CA bundle: %w", err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported CA key type %T", key)
+	}
+	return newCA(signer, append([]*x509.Certificate{cert}, chain...))
+}
+
+func parseKeyPair(certPEM, keyPEM []byte) (*CA, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("no PEM private key found")
+	}
+	key, err := parsePrivateKey(block.Bytes)
 	if err != nil {
-		// Loads in case it exists
-		fmt.Println("Loading CA")
-		rootCA, err = goca.Load("invisirisk.com")
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	for {
+		block, certPEM = pem.Decode(certPEM)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
 		if err != nil {
-			log.Fatal(err)
+			return nil, fmt.Errorf("error parsing CA certificate: %w", err)
 		}
+		certs = append(certs, cert)
+	}
+	return newCA(key, certs)
+}
+
+// newCA finds the certificate matching the key, any other certificate is kept
+// as the chain up to the root.
+func newCA(key crypto.Signer, certs []*x509.Certificate) (*CA, error) {
+	ca := &CA{key: key}
+	for _, cert := range certs {
+		pub, ok := cert.PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+		if ca.cert == nil && ok && pub.Equal(key.Public()) {
+			ca.cert = cert
+		} else {
+			ca.chain = append(ca.chain, cert)
+		}
+	}
+	if ca.cert == nil {
+		return nil, errors.New("no CA certificate matches the private key")
+	}
+	return ca, nil
+}
+
+func parsePrivateKey(der []byte) (crypto.Signer, error) {
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing CA key: %w", err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported CA key type %T", key)
+	}
+	return signer, nil
+}
+
+// loadOrCreateRoot reuses the root persisted in cfg.Dir, a new root is only
+// generated when none exists yet. Roots created by earlier releases are kept
+// in the goca layout, <dir>/<cn>/ca/<cn>.crt and key.pem, and are reused as is
+// so build hosts trusting them keep working after an upgrade.
+func loadOrCreateRoot(cfg config.CA) (*CA, error) {
+	certFile := filepath.Join(cfg.Dir, cfg.Identity.CommonName+".crt")
+	keyFile := filepath.Join(cfg.Dir, cfg.Identity.CommonName+".key")
+	if _, err := os.Stat(certFile); err == nil {
+		return loadPEM(certFile, keyFile)
+	}
+	legacyDir := filepath.Join(cfg.Dir, cfg.Identity.CommonName, "ca")
+	legacyCert := filepath.Join(legacyDir, cfg.Identity.CommonName+".crt")
+	if _, err := os.Stat(legacyCert); err == nil {
+		return loadPEM(legacyCert, filepath.Join(legacyDir, "key.pem"))
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	id := cfg.Identity
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serialNumber(),
+		Subject: pkix.Name{
+			CommonName:         id.CommonName,
+			Organization:       nonEmpty(id.Organization),
+			OrganizationalUnit: nonEmpty(id.OrganizationalUnit),
+			Country:            nonEmpty(id.Country),
+			Province:           nonEmpty(id.Province),
+			Locality:           nonEmpty(id.Locality),
+		},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(0, 0, cfg.ValidDays),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return nil, fmt.Errorf("error creating root CA: %w", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(cfg.Dir, 0700); err != nil {
+		return nil, fmt.Errorf("error creating CA directory: %w", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		return nil, fmt.Errorf("error writing CA key: %w", err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return nil, fmt.Errorf("error writing CA certificate: %w", err)
 	}
 	return &CA{
-		rootCa: &rootCA,
+		cert: cert,
+		key:  key,
+	}, nil
+}
+
+func nonEmpty(v string) []string {
+	if v == "" {
+		return nil
+	}
+	return []string{v}
+}
+
+func serialNumber() *big.Int {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		panic(err)
 	}
+	return serial
 }
+
+// RootCert returns the signing certificate, for an intermediate CA that is the
+// intermediate itself.
 func (ca *CA) RootCert() *x509.Certificate {
-	return ca.rootCa.GoCertificate()
+	return ca.cert
 }
-func (ca *CA) IssueCertificate(name string) (*tls.Certificate, error) {
-	ca.mutex.Lock()
-	defer func() {
-		ca.mutex.Unlock()
-	}()
-	intranetIdentity := goca.Identity{
 
-		Intermediate: false,
-		DNSNames:     []string{name},
+// PEM returns the signing certificate followed by its chain, this is what
+// build hosts need to install to trust intercepted connections.
+func (ca *CA) PEM() []byte {
+	buf := bytes.NewBuffer(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}))
+	for _, c := range ca.chain {
+		pem.Encode(buf, &pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})
 	}
-	cert, err := ca.rootCa.LoadCertificate(name)
-	if err != nil {
-		cert, err = ca.rootCa.IssueCertificate(name, intranetIdentity)
+	return buf.Bytes()
+}
+
+// IssueCertificate returns a server certificate for the SNI name. Certificates
+// are cached in memory and shared by every name under the same parent domain,
+// concurrent handshakes for the same name wait on a single issuance.
+func (ca *CA) IssueCertificate(name string) (*tls.Certificate, error) {
+	if name == "" {
+		return nil, errors.New("no server name to issue a certificate for")
+	}
+	san := leafName(name)
+	if cert, ok := ca.leaves.Get(san); ok && ca.fresh(cert) {
+		return cert, nil
 	}
+	v, err, _ := ca.issuing.Do(san, func() (interface{}, error) {
+		if cert, ok := ca.leaves.Get(san); ok && ca.fresh(cert) {
+			return cert, nil
+		}
+		start := time.Now()
+		cert, err := ca.issue(san)
+		metrics.Since(metrics.CertIssue, start)
+		if err != nil {
+			return nil, err
+		}
+		ca.leaves.Put(san, cert)
+		return cert, nil
+	})
 	if err != nil {
 		return nil, err
+	}
+	return v.(*tls.Certificate), nil
+}
+
+// fresh reports whether cert is far enough from expiry to keep serving it
+func (ca *CA) fresh(cert *tls.Certificate) bool {
+	return time.Until(cert.Leaf.NotAfter) > ca.renewBefore
+}
 
+// leafName consolidates host names into a wildcard for their parent domain,
+// registry.npmjs.org and www.npmjs.org share *.npmjs.org. The parent must be
+// the registrable domain or below it, clients reject wildcards over a public
+// suffix such as *.co.uk. IP addresses and other names are issued as is.
+func leafName(name string) string {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if net.ParseIP(name) != nil || strings.HasPrefix(name, "*.") {
+		return name
 	}
-	gocert, err := tls.X509KeyPair([]byte(cert.Certificate), []byte(cert.PrivateKey))
-	return &gocert, err
+	registrable, err := publicsuffix.EffectiveTLDPlusOne(name)
+	if err != nil {
+		return name
+	}
+	i := strings.IndexByte(name, '.')
+	if i < 0 || !strings.HasSuffix("."+name[i+1:], "."+registrable) {
+		return name
+	}
+	return "*" + name[i:]
+}
 
+func (ca *CA) issue(san string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serialNumber(),
+		Subject:      pkix.Name{CommonName: san},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(ca.leafValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(san); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else {
+		tmpl.DNSNames = []string{san}
+	}
+	if tmpl.NotAfter.After(ca.cert.NotAfter) {
+		tmpl.NotAfter = ca.cert.NotAfter
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	cert := &tls.Certificate{
+		Certificate: [][]byte{der, ca.cert.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}
+	for _, c := range ca.chain {
+		cert.Certificate = append(cert.Certificate, c.Raw)
+	}
+	return cert, nil
 }
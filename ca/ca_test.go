@@ -1,9 +1,17 @@
 package ca
 
 import (
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+	"inivisirisk.com/pse/config"
 )
 
 func TestCert(t *testing.T) {
@@ -11,3 +19,164 @@ func TestCert(t *testing.T) {
 	_, err := ca.IssueCertificate("www1.google.com")
 	require.NoError(t, err)
 }
+
+func TestGeneratedRootIsPersisted(t *testing.T) {
+	cfg := config.DefaultCA()
+	cfg.Dir = t.TempDir()
+	cfg.Identity.CommonName = "pse.example.com"
+	cfg.ValidDays = 30
+
+	first, err := New(cfg)
+	require.NoError(t, err)
+	require.Equal(t, "pse.example.com", first.RootCert().Subject.CommonName)
+	second, err := New(cfg)
+	require.NoError(t, err)
+	require.Equal(t, first.RootCert().Raw, second.RootCert().Raw)
+}
+
+func TestLegacyRootIsReused(t *testing.T) {
+	chain, err := os.ReadFile("testdata/chain.crt")
+	require.NoError(t, err)
+	key, err := os.ReadFile("testdata/intermediate.key")
+	require.NoError(t, err)
+
+	cfg := config.DefaultCA()
+	cfg.Dir = t.TempDir()
+	legacyDir := filepath.Join(cfg.Dir, cfg.Identity.CommonName, "ca")
+	require.NoError(t, os.MkdirAll(legacyDir, 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(legacyDir, cfg.Identity.CommonName+".crt"), chain, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(legacyDir, "key.pem"), key, 0600))
+
+	ca, err := New(cfg)
+	require.NoError(t, err)
+	require.Equal(t, "Test Intermediate", ca.RootCert().Subject.CommonName)
+	require.NoFileExists(t, filepath.Join(cfg.Dir, cfg.Identity.CommonName+".crt"))
+}
+
+func TestIntermediateCA(t *testing.T) {
+	rootPEM, err := os.ReadFile("testdata/root.crt")
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	require.True(t, roots.AppendCertsFromPEM(rootPEM))
+
+	for _, cfg := range []config.CA{
+		{Cert: "testdata/chain.crt", Key: "testdata/intermediate.key"},
+		{PKCS12: "testdata/intermediate.p12", PKCS12Password: "test"},
+		// OpenSSL 3 default export, PBES2 with AES-256-CBC and a SHA-256 MAC
+		{PKCS12: "testdata/intermediate-aes.p12", PKCS12Password: "test"},
+	} {
+		ca, err := New(cfg)
+		require.NoError(t, err)
+		require.Equal(t, "Test Intermediate", ca.RootCert().Subject.CommonName)
+		require.Contains(t, string(ca.PEM()), string(rootPEM))
+		cert, err := ca.IssueCertificate("registry.npmjs.org")
+		require.NoError(t, err)
+
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		require.NoError(t, err)
+		intermediates := x509.NewCertPool()
+		for _, der := range cert.Certificate[1:] {
+			c, err := x509.ParseCertificate(der)
+			require.NoError(t, err)
+			intermediates.AddCert(c)
+		}
+		_, err = leaf.Verify(x509.VerifyOptions{
+			DNSName:       "registry.npmjs.org",
+			Roots:         roots,
+			Intermediates: intermediates,
+		})
+		require.NoError(t, err)
+	}
+
+	_, err = New(config.CA{PKCS12: "testdata/intermediate.p12", PKCS12Password: "wrong"})
+	require.Error(t, err)
+	_, err = New(config.CA{Cert: "testdata/root.crt", Key: "testdata/intermediate.key"})
+	require.Error(t, err)
+}
+
+func testCA(t *testing.T) *CA {
+	cfg := config.DefaultCA()
+	cfg.Dir = t.TempDir()
+	ca, err := New(cfg)
+	require.NoError(t, err)
+	return ca
+}
+
+func TestLeafCache(t *testing.T) {
+	ca := testCA(t)
+
+	var wg sync.WaitGroup
+	certs := make([]*tls.Certificate, 16)
+	for i := range certs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cert, err := ca.IssueCertificate("registry.npmjs.org")
+			require.NoError(t, err)
+			certs[i] = cert
+		}(i)
+	}
+	wg.Wait()
+	for _, cert := range certs {
+		require.Same(t, certs[0], cert)
+	}
+	require.IsType(t, &ecdsa.PrivateKey{}, certs[0].PrivateKey)
+
+	sibling, err := ca.IssueCertificate("www.npmjs.org")
+	require.NoError(t, err)
+	require.Same(t, certs[0], sibling)
+	require.NoError(t, sibling.Leaf.VerifyHostname("www.npmjs.org"))
+	require.Equal(t, 1, ca.leaves.Len())
+
+	_, err = ca.IssueCertificate("")
+	require.Error(t, err)
+}
+
+func TestLeafName(t *testing.T) {
+	for name, want := range map[string]string{
+		"registry.npmjs.org":      "*.npmjs.org",
+		"Registry.NPMJS.org.":     "*.npmjs.org",
+		"a.b.example.co.uk":       "*.b.example.co.uk",
+		"www.example.co.uk":       "*.example.co.uk",
+		"example.co.uk":           "example.co.uk",
+		"github.com":              "github.com",
+		"user.github.io":          "user.github.io",
+		"pkg.user.github.io":      "*.user.github.io",
+		"127.0.0.1":               "127.0.0.1",
+		"localhost":               "localhost",
+		"mirror.corp.internal":    "*.corp.internal",
+		"cdn.registry.example.au": "*.registry.example.au",
+	} {
+		require.Equal(t, want, leafName(name), name)
+	}
+}
+
+func TestLeafCacheEviction(t *testing.T) {
+	cfg := config.DefaultCA()
+	cfg.Dir = t.TempDir()
+	cfg.LeafCacheSize = 2
+	ca, err := New(cfg)
+	require.NoError(t, err)
+
+	first, err := ca.IssueCertificate("github.com")
+	require.NoError(t, err)
+	for _, name := range []string{"gitlab.com", "127.0.0.1"} {
+		_, err := ca.IssueCertificate(name)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 2, ca.leaves.Len())
+	again, err := ca.IssueCertificate("github.com")
+	require.NoError(t, err)
+	require.NotSame(t, first, again)
+}
+
+func TestLeafRenewal(t *testing.T) {
+	ca := testCA(t)
+	first, err := ca.IssueCertificate("proxy.golang.org")
+	require.NoError(t, err)
+
+	ca.renewBefore = time.Until(first.Leaf.NotAfter)
+	second, err := ca.IssueCertificate("proxy.golang.org")
+	require.NoError(t, err)
+	require.NotSame(t, first, second)
+}
@@ -0,0 +1,47 @@
+package config
+
+// CA configures the certificate authority used to intercept TLS. When Cert
+// and Key (or PKCS12) are set that CA is used as is, it may be a root or an
+// intermediate. Otherwise a root is generated from Identity on first start and
+// persisted in Dir so that restarts keep the same root.
+type CA struct {
+	Dir            string     `yaml:"dir,omitempty"`
+	Cert           string     `yaml:"cert,omitempty"`
+	Key            string     `yaml:"key,omitempty"`
+	PKCS12         string     `yaml:"pkcs12,omitempty"`
+	PKCS12Password string     `yaml:"pkcs12-password,omitempty"`
+	Identity       CAIdentity `yaml:"identity,omitempty"`
+	// ValidDays is the validity of a generated root
+	ValidDays int `yaml:"valid-days,omitempty"`
+	// LeafValidDays is the validity of issued server certificates, they are
+	// re-issued once less than a third of it remains
+	LeafValidDays int `yaml:"leaf-valid-days,omitempty"`
+	// LeafCacheSize bounds the number of server certificates kept in memory
+	LeafCacheSize int `yaml:"leaf-cache-size,omitempty"`
+}
+
+type CAIdentity struct {
+	CommonName         string `yaml:"common-name,omitempty"`
+	Organization       string `yaml:"organization,omitempty"`
+	OrganizationalUnit string `yaml:"organizational-unit,omitempty"`
+	Country            string `yaml:"country,omitempty"`
+	Province           string `yaml:"province,omitempty"`
+	Locality           string `yaml:"locality,omitempty"`
+}
+
+func DefaultCA() CA {
+	return CA{
+		Dir: "/tmp/ca",
+		Identity: CAIdentity{
+			CommonName:         "invisirisk.com",
+			Organization:       "InvisiRisk, Inc.",
+			OrganizationalUnit: "PSE-Proxy Certificates",
+			Country:            "US",
+			Province:           "Texas",
+			Locality:           "Houston",
+		},
+		ValidDays:     3650,
+		LeafValidDays: 30,
+		LeafCacheSize: 1024,
+	}
+}
@@ -3,6 +3,7 @@ package config
 import (
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 
 	"gopkg.in/yaml.v3"
@@ -18,12 +19,47 @@ type Config struct {
 	AlpineRepos   []string `yaml:"alpine-repos,omitempty"`
 	RubygemsRepos []string `yaml:"rubygems-repos,omitempty"`
 	NugetRepos    []string `yaml:"nuget-repos,omitempty"`
+	CargoRepos    []string `yaml:"cargo-repos,omitempty"`
+	OCIRepos      []string `yaml:"oci-repos,omitempty"`
+	// GoSums are go.sum files module downloads are verified against, in
+	// addition to the checksum database lookups seen
+	GoSums []string `yaml:"gomodule-sums,omitempty"`
+
+	// PassThroughHosts are tunneled without TLS interception, a leading "."
+	// or "*." matches every subdomain
+	PassThroughHosts []string `yaml:"pass-through-hosts,omitempty"`
+	// PassThroughPolicy asks the policy about every other CONNECT, tunnels the
+	// combined rule marks with "bypass" are spliced as well
+	PassThroughPolicy bool `yaml:"pass-through-policy,omitempty"`
+
+	Listeners Listeners `yaml:"listeners,omitempty"`
+	CA        CA        `yaml:"ca,omitempty"`
+	Upstream  Upstream  `yaml:"upstream-proxy,omitempty"`
+	// TrustedProxies are the addresses or CIDRs of peers relaying plain HTTP
+	// proxy requests, the Forwarded header of their requests names the build
+	// host. It is dropped from the requests of other clients.
+	TrustedProxies []string `yaml:"trusted-proxies,omitempty"`
+	// PolicyBundle replaces the portal policy bundle when its path is set
+	PolicyBundle PolicyBundle `yaml:"policy-bundle,omitempty"`
+	// DecisionCache reuses request decisions for identical requests
+	DecisionCache DecisionCache `yaml:"decision-cache,omitempty"`
+	// PolicyFailure decides requests the policy failed to evaluate
+	PolicyFailure PolicyFailure `yaml:"policy-failure,omitempty"`
 }
 
 var (
-	cfg = &Config{}
+	cfg = defaultConfig()
 )
 
+func defaultConfig() *Config {
+	return &Config{
+		Listeners: DefaultListeners(),
+		CA:        DefaultCA(),
+
+		DecisionCache: DefaultDecisionCache(),
+	}
+}
+
 func Parse(file string) (*Config, error) {
 	f, err := os.Open(file)
 	if err != nil {
@@ -33,14 +69,54 @@ func Parse(file string) (*Config, error) {
 	if err != nil {
 		return nil, fmt.Errorf("error reading configuration file: %w", err)
 	}
-	cfg := &Config{}
+	cfg := defaultConfig()
 	err = yaml.Unmarshal(data, cfg)
 	if err != nil {
 		return nil, fmt.Errorf("error decoding configuration file: %w", err)
 	}
+	if err := cfg.PolicyFailure.validate(); err != nil {
+		return nil, err
+	}
+	if err := cfg.Listeners.validate(); err != nil {
+		return nil, err
+	}
+	for _, peer := range cfg.TrustedProxies {
+		if _, err := parsePeer(peer); err != nil {
+			return nil, err
+		}
+	}
 	return cfg, nil
 }
 
+// parsePeer parses a trusted proxy, an address is a single host network
+func parsePeer(peer string) (*net.IPNet, error) {
+	if _, n, err := net.ParseCIDR(peer); err == nil {
+		return n, nil
+	}
+	ip := net.ParseIP(peer)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid trusted proxy %q", peer)
+	}
+	bits := 8 * len(ip)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 32
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// Trusted reports whether ip is one of the trusted proxies
+func (c *Config) Trusted(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, peer := range c.TrustedProxies {
+		if n, err := parsePeer(peer); err == nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 func Set(file string) error {
 	var err error
 	cfg, err = Parse(file)
@@ -2,6 +2,9 @@ package config
 
 import (
 	"fmt"
+	"net"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -16,3 +19,58 @@ func TestConfig(t *testing.T) {
 	require.NoError(t, err)
 	fmt.Printf("%v\n", cfg)
 }
+
+func TestListeners(t *testing.T) {
+	cfg, err := Parse("cfg.yaml")
+	require.NoError(t, err)
+	require.Equal(t, DefaultListeners(), cfg.Listeners)
+	require.Equal(t, ":3128", cfg.Listeners.Proxy.String())
+
+	file := filepath.Join(t.TempDir(), "cfg.yaml")
+	require.NoError(t, os.WriteFile(file, []byte("listeners:\n  control:\n    disabled: false\n    socket: "+t.TempDir()+"/pse.sock\n  tls:\n    disabled: true\n"), 0600))
+	cfg, err = Parse(file)
+	require.NoError(t, err)
+	require.True(t, cfg.Listeners.TLS.Disabled)
+	require.Equal(t, 3128, cfg.Listeners.Proxy.Port)
+	require.Equal(t, "unix", cfg.Listeners.Control.Network())
+
+	l, err := cfg.Listeners.Control.Listen()
+	require.NoError(t, err)
+	l.Close()
+
+	require.NoError(t, os.WriteFile(file, []byte("listeners:\n  proxy:\n    socket: "+t.TempDir()+"/proxy.sock\n"), 0600))
+	_, err = Parse(file)
+	require.Error(t, err)
+}
+
+func TestPolicyFailure(t *testing.T) {
+	cfg, err := Parse("cfg.yaml")
+	require.NoError(t, err)
+	require.Equal(t, FailureMode{}, cfg.PolicyFailure.For("npm"))
+
+	file := filepath.Join(t.TempDir(), "cfg.yaml")
+	require.NoError(t, os.WriteFile(file, []byte("policy-failure:\n  retries: 1\n  technologies:\n    npm:\n      mode: closed\n      retries: 2\n"), 0600))
+	cfg, err = Parse(file)
+	require.NoError(t, err)
+	require.Equal(t, FailureMode{Mode: FailClosed, Retries: 2}, cfg.PolicyFailure.For("npm"))
+	require.Equal(t, FailureMode{Retries: 1}, cfg.PolicyFailure.For("git"))
+
+	require.NoError(t, os.WriteFile(file, []byte("policy-failure:\n  technologies:\n    npm:\n      mode: close\n"), 0600))
+	_, err = Parse(file)
+	require.Error(t, err)
+}
+
+func TestTrustedProxies(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "cfg.yaml")
+	require.NoError(t, os.WriteFile(file, []byte("trusted-proxies:\n  - 10.1.0.0/16\n  - 192.0.2.7\n"), 0600))
+	cfg, err := Parse(file)
+	require.NoError(t, err)
+	require.True(t, cfg.Trusted(net.ParseIP("10.1.2.3")))
+	require.True(t, cfg.Trusted(net.ParseIP("192.0.2.7")))
+	require.False(t, cfg.Trusted(net.ParseIP("192.0.2.8")))
+	require.False(t, cfg.Trusted(nil))
+
+	require.NoError(t, os.WriteFile(file, []byte("trusted-proxies:\n  - sidecar\n"), 0600))
+	_, err = Parse(file)
+	require.Error(t, err)
+}
@@ -0,0 +1,79 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// Listener describes a single socket the proxy listens on. When Socket is set
+// the listener is a Unix domain socket and Address/Port are ignored. The
+// proxy and TLS listeners must be TCP, build sessions are found by the
+// address of the client.
+type Listener struct {
+	Disabled bool   `yaml:"disabled,omitempty"`
+	Address  string `yaml:"address,omitempty"`
+	Port     int    `yaml:"port,omitempty"`
+	Socket   string `yaml:"socket,omitempty"`
+}
+
+type Listeners struct {
+	// Proxy accepts CONNECT and plain HTTP proxy requests
+	Proxy Listener `yaml:"proxy,omitempty"`
+	// TLS accepts TLS connections addressed directly to the proxy
+	TLS Listener `yaml:"tls,omitempty"`
+	// Policy serves the local policy bundle directory
+	Policy Listener `yaml:"policy,omitempty"`
+	// Control serves the session start/end and CA endpoints without going
+	// through the proxy
+	Control Listener `yaml:"control,omitempty"`
+}
+
+func DefaultListeners() Listeners {
+	return Listeners{
+		Proxy:   Listener{Port: 3128},
+		TLS:     Listener{Port: 12345},
+		Policy:  Listener{Address: "localhost", Port: 8081},
+		Control: Listener{Disabled: true},
+	}
+}
+
+func (ls Listeners) validate() error {
+	if ls.Proxy.Socket != "" {
+		return fmt.Errorf("proxy listener cannot be a Unix socket")
+	}
+	if ls.TLS.Socket != "" {
+		return fmt.Errorf("tls listener cannot be a Unix socket")
+	}
+	return nil
+}
+
+func (l Listener) Network() string {
+	if l.Socket != "" {
+		return "unix"
+	}
+	return "tcp"
+}
+
+func (l Listener) String() string {
+	if l.Socket != "" {
+		return l.Socket
+	}
+	return net.JoinHostPort(l.Address, strconv.Itoa(l.Port))
+}
+
+// Listen opens the listener. A stale Unix socket left behind by a previous
+// instance is removed first.
+func (l Listener) Listen() (net.Listener, error) {
+	if l.Socket != "" {
+		if fi, err := os.Stat(l.Socket); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(l.Socket)
+		}
+	}
+	nl, err := net.Listen(l.Network(), l.String())
+	if err != nil {
+		return nil, fmt.Errorf("error listening on %v: %w", l, err)
+	}
+	return nl, nil
+}
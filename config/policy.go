@@ -0,0 +1,81 @@
+package config
+
+import "fmt"
+
+// PolicyBundle loads policies from disk instead of the portal, for air-gapped
+// runs and local development
+type PolicyBundle struct {
+	// Path is a directory of Rego and data files, a bundle tarball or a single
+	// .rego file. The portal bundle is used when empty.
+	Path string `yaml:"path,omitempty"`
+	// Watch reloads the policies when Path changes
+	Watch bool `yaml:"watch,omitempty"`
+}
+
+// DecisionCache keeps request decisions so identical requests within a build
+// are not evaluated again. Entries are dropped when the policy revision
+// changes.
+type DecisionCache struct {
+	Disabled bool `yaml:"disabled,omitempty"`
+	// Size bounds the number of decisions kept in memory
+	Size int `yaml:"size,omitempty"`
+	// TTLSeconds is how long a decision is reused
+	TTLSeconds int `yaml:"ttl-seconds,omitempty"`
+}
+
+func DefaultDecisionCache() DecisionCache {
+	return DecisionCache{
+		Size:       4096,
+		TTLSeconds: 300,
+	}
+}
+
+const (
+	// FailOpen allows requests the policy failed to decide with an alert
+	FailOpen = "open"
+	// FailClosed denies requests the policy failed to decide
+	FailClosed = "closed"
+)
+
+// FailureMode is how requests are decided when the policy cannot be
+// evaluated
+type FailureMode struct {
+	// Mode is FailOpen or FailClosed, open when empty
+	Mode string `yaml:"mode,omitempty"`
+	// Retries is how often a failed evaluation is retried before Mode applies
+	Retries int `yaml:"retries,omitempty"`
+}
+
+// PolicyFailure is the failure mode for every technology not listed in
+// Technologies
+type PolicyFailure struct {
+	FailureMode `yaml:",inline"`
+	// Technologies overrides the mode by activity name, such as npm or git
+	Technologies map[string]FailureMode `yaml:"technologies,omitempty"`
+}
+
+// For returns the failure mode of the technology tech
+func (f PolicyFailure) For(tech string) FailureMode {
+	if m, ok := f.Technologies[tech]; ok {
+		return m
+	}
+	return f.FailureMode
+}
+
+func (f PolicyFailure) validate() error {
+	modes := map[string]FailureMode{"": f.FailureMode}
+	for tech, m := range f.Technologies {
+		modes[tech] = m
+	}
+	for tech, m := range modes {
+		switch m.Mode {
+		case "", FailOpen, FailClosed:
+		default:
+			if tech == "" {
+				return fmt.Errorf("unknown policy failure mode %q", m.Mode)
+			}
+			return fmt.Errorf("unknown policy failure mode %q for %v", m.Mode, tech)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+package config
+
+// Upstream is the parent proxy outgoing connections are chained through
+type Upstream struct {
+	// URL of the parent proxy, http://, https:// or socks5://. Connections are
+	// direct when empty.
+	URL      string `yaml:"url,omitempty"`
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
+	// NoProxy hosts are dialed directly, entries follow the NO_PROXY syntax
+	NoProxy []string `yaml:"no-proxy,omitempty"`
+}
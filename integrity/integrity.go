@@ -0,0 +1,298 @@
+// Package integrity verifies downloaded artifacts against the digests their
+// registries publish, such as npm dist.integrity or PyPI #sha256= links.
+package integrity
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/invisirisk/clog"
+	"github.com/invisirisk/svcs/model"
+	"inivisirisk.com/pse/utils"
+)
+
+const (
+	SHA1   = "sha1"
+	SHA256 = "sha256"
+	SHA512 = "sha512"
+	// H1 is the go.sum hash of a module zip
+	H1 = "h1"
+	// H1Mod is the go.sum hash of a go.mod file
+	H1Mod = "h1-mod"
+
+	// Policy names the checks added for verified artifacts
+	Policy = "registry_integrity"
+
+	Verified = "verified"
+	Mismatch = "mismatch"
+
+	// maxMetadata bounds the metadata read from a single response
+	maxMetadata = 64 << 20
+)
+
+// Digest is a digest a registry publishes for one of its artifacts
+type Digest struct {
+	// Key names the artifact, as returned by Registry.Key
+	Key string
+	// Algorithm is one of SHA1, SHA256, SHA512, H1 or H1Mod
+	Algorithm string
+	// Value is hex encoded, H1 and H1Mod values keep their h1: form
+	Value string
+	// Source tells where the digest was published, e.g. "npm dist.integrity"
+	Source string
+}
+
+var (
+	// strength orders the algorithms, the strongest compared is reported
+	strength = map[string]int{
+		SHA512: 4,
+		SHA256: 3,
+		H1:     2,
+		H1Mod:  2,
+		SHA1:   1,
+	}
+)
+
+// Sums are the hex encoded digests of a downloaded body
+type Sums struct {
+	MD5    string
+	SHA1   string
+	SHA256 string
+	SHA512 string
+	// H1 is set for Go module zips
+	H1 string
+}
+
+// get returns the sum d is published with, "" when it is not computed
+func (s Sums) get(algorithm string) string {
+	switch algorithm {
+	case SHA1:
+		return s.SHA1
+	case SHA256:
+		return s.SHA256
+	case SHA512:
+		return s.SHA512
+	case H1:
+		return s.H1
+	case H1Mod:
+		if s.SHA256 == "" {
+			return ""
+		}
+		summary := sha256.Sum256([]byte(s.SHA256 + "  go.mod\n"))
+		return "h1:" + base64.StdEncoding.EncodeToString(summary[:])
+	}
+	return ""
+}
+
+// Registry is the integrity data of a package registry
+type Registry interface {
+	// Published parses the digests listed in a metadata response. Registries
+	// keeping the digests of metadata listing many versions return none for
+	// it and those of the version on its download instead.
+	Published(rsp *http.Response, body io.Reader) ([]Digest, error)
+	// Key names the artifact downloaded from u, "" when u is no artifact
+	Key(u *url.URL) string
+}
+
+// URLKey names the artifact at u by its host and path, the scheme, query and
+// fragment do not change what is downloaded
+func URLKey(u *url.URL) string {
+	return strings.ToLower(u.Host) + u.Path
+}
+
+// SRI returns the digests of a subresource integrity string such as npm's
+// dist.integrity, unknown algorithms are skipped
+func SRI(key, integrity, source string) []Digest {
+	var digests []Digest
+	for _, field := range strings.Fields(integrity) {
+		alg, value, ok := strings.Cut(field, "-")
+		if !ok {
+			continue
+		}
+		switch alg {
+		case SHA1, SHA256, SHA512:
+		default:
+			continue
+		}
+		raw, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			continue
+		}
+		digests = append(digests, Digest{Key: key, Algorithm: alg, Value: hex.EncodeToString(raw), Source: source})
+	}
+	return digests
+}
+
+// Result is the outcome of comparing an artifact with a published digest
+type Result struct {
+	Digest Digest
+	Got    string
+	OK     bool
+	// Download is what Verify was given for the artifact, a digest published
+	// after the download is about it rather than about the metadata request
+	Download interface{}
+}
+
+// Status is Verified or Mismatch
+func (r *Result) Status() string {
+	if r.OK {
+		return Verified
+	}
+	return Mismatch
+}
+
+// Check is the tech check recording the result, a mismatch is critical
+func (r *Result) Check() model.TechCheck {
+	if r.OK {
+		return model.TechCheck{
+			Name:       "Allow",
+			Score:      10,
+			AlertLevel: model.AlertNone,
+			Details:    fmt.Sprintf("%v matches %v", r.Digest.Algorithm, r.Digest.Source),
+			Policy:     Policy,
+		}
+	}
+	return model.TechCheck{
+		Name:       "Block",
+		Score:      0,
+		AlertLevel: model.AlertCritical,
+		Details: fmt.Sprintf("%v of %v does not match %v: published %v, downloaded %v",
+			r.Digest.Algorithm, r.Digest.Key, r.Digest.Source, r.Digest.Value, r.Got),
+		Policy: Policy,
+	}
+}
+
+// Store is a fixed size LRU of the digests published for artifacts and of
+// the sums of downloaded ones. Either may be seen first, maven clients fetch
+// the .sha1 file after the jar.
+type Store struct {
+	mutex   sync.Mutex
+	entries *utils.LRU[string, *entry]
+}
+
+type entry struct {
+	digests  []Digest
+	sums     *Sums
+	download interface{}
+}
+
+func NewStore(size int) *Store {
+	return &Store{entries: utils.NewLRU[string, *entry](size)}
+}
+
+// get returns the entry of key, creating it if needed, the mutex must be held
+func (s *Store) get(key string) *entry {
+	return s.entries.Update(strings.ToLower(key), func(en *entry, ok bool) *entry {
+		if !ok {
+			en = &entry{}
+		}
+		return en
+	})
+}
+
+// compare returns the first mismatch of sums with the digests, or a match
+// when none differ. It is nil when no digest can be compared.
+func compare(digests []Digest, sums Sums) *Result {
+	var result *Result
+	for _, d := range digests {
+		got := sums.get(d.Algorithm)
+		if got == "" {
+			continue
+		}
+		r := &Result{Digest: d, Got: got, OK: strings.EqualFold(got, d.Value)}
+		if !r.OK {
+			return r
+		}
+		// the strongest algorithm is reported
+		if result == nil || strength[d.Algorithm] > strength[result.Digest.Algorithm] {
+			result = r
+		}
+	}
+	return result
+}
+
+// Publish records d, the result is not nil when the artifact was already
+// downloaded
+func (s *Store) Publish(d Digest) *Result {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	en := s.get(d.Key)
+	replaced := false
+	for i := range en.digests {
+		if en.digests[i].Algorithm == d.Algorithm {
+			en.digests[i] = d
+			replaced = true
+		}
+	}
+	if !replaced {
+		en.digests = append(en.digests, d)
+	}
+	if en.sums == nil {
+		return nil
+	}
+	r := compare([]Digest{d}, *en.sums)
+	if r != nil {
+		r.Download = en.download
+	}
+	return r
+}
+
+// Verify records the sums of the artifact key and the download they were read
+// from, the result is nil when no digest was published for it yet
+func (s *Store) Verify(key string, sums Sums, download interface{}) *Result {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	en := s.get(key)
+	en.sums, en.download = &sums, download
+	r := compare(en.digests, sums)
+	if r != nil {
+		r.Download = download
+	}
+	return r
+}
+
+func (s *Store) len() int {
+	return s.entries.Len()
+}
+
+// Chain collects the digests published in a response of the registry
+type Chain struct {
+	Registry Registry
+	Response *http.Response
+	Digests  []Digest
+}
+
+func (c *Chain) Handle(ctx context.Context, r io.Reader) error {
+	_, cl := clog.WithCtx(ctx, "integrity")
+	if c.Registry == nil || c.Response == nil || c.Response.StatusCode != http.StatusOK ||
+		c.Response.Request.Method != http.MethodGet {
+		return nil
+	}
+	r = io.LimitReader(r, maxMetadata)
+	if c.Response.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil
+		}
+		defer zr.Close()
+		r = zr
+	}
+	digests, err := c.Registry.Published(c.Response, r)
+	if err != nil {
+		return fmt.Errorf("reading published digests: %w", err)
+	}
+	if len(digests) > 0 {
+		cl.Infof("%v digests published in %v", len(digests), c.Response.Request.URL)
+	}
+	c.Digests = digests
+	return nil
+}
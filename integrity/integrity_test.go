@@ -0,0 +1,101 @@
+package integrity
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"testing"
+
+	"github.com/invisirisk/svcs/model"
+	"github.com/stretchr/testify/require"
+)
+
+func sums(data string) Sums {
+	return Sums{
+		SHA1:   fmt.Sprintf("%x", sha1.Sum([]byte(data))),
+		SHA256: fmt.Sprintf("%x", sha256.Sum256([]byte(data))),
+		SHA512: fmt.Sprintf("%x", sha512.Sum512([]byte(data))),
+	}
+}
+
+func TestSRI(t *testing.T) {
+	sum := sha512.Sum512([]byte("tarball"))
+	digests := SRI("k", "sha512-"+base64.StdEncoding.EncodeToString(sum[:])+" md5-xxxx", "npm dist.integrity")
+	require.Equal(t, []Digest{{Key: "k", Algorithm: SHA512, Value: fmt.Sprintf("%x", sum), Source: "npm dist.integrity"}}, digests)
+}
+
+func TestStore(t *testing.T) {
+	s := NewStore(2)
+	require.Nil(t, s.Verify("a", sums("tarball"), "jar"))
+
+	// published after the download, as maven checksum files are
+	r := s.Publish(Digest{Key: "a", Algorithm: SHA1, Value: sums("tarball").SHA1, Source: "maven .sha1"})
+	require.NotNil(t, r)
+	require.True(t, r.OK)
+	require.Equal(t, "jar", r.Download)
+	require.Equal(t, Verified, r.Status())
+
+	s.Publish(Digest{Key: "b", Algorithm: SHA256, Value: sums("tarball").SHA256, Source: "pypi simple #sha256"})
+	s.Publish(Digest{Key: "b", Algorithm: SHA512, Value: sums("tarball").SHA512, Source: "pypi json digests"})
+	r = s.Verify("B", sums("tarball"), nil)
+	require.True(t, r.OK)
+	require.Equal(t, SHA512, r.Digest.Algorithm)
+
+	r = s.Verify("b", sums("tampered"), nil)
+	require.False(t, r.OK)
+	require.Equal(t, Mismatch, r.Status())
+	check := r.Check()
+	require.Equal(t, model.AlertCritical, check.AlertLevel)
+	require.Equal(t, Policy, check.Policy)
+	require.Contains(t, check.Details, "does not match")
+
+	s.Publish(Digest{Key: "c", Algorithm: SHA1, Value: "00"})
+	require.Equal(t, 2, s.len())
+	require.Nil(t, s.Verify("a", sums("tarball"), nil))
+}
+
+func TestStrongest(t *testing.T) {
+	s := NewStore(4)
+	zip := sums("zip")
+	zip.H1 = "h1:zip"
+	s.Publish(Digest{Key: "a", Algorithm: SHA1, Value: zip.SHA1})
+	s.Publish(Digest{Key: "a", Algorithm: H1, Value: zip.H1})
+	r := s.Verify("a", zip, nil)
+	require.True(t, r.OK)
+	require.Equal(t, H1, r.Digest.Algorithm)
+
+	s.Publish(Digest{Key: "a", Algorithm: SHA512, Value: zip.SHA512})
+	s.Publish(Digest{Key: "a", Algorithm: SHA256, Value: zip.SHA256})
+	r = s.Verify("a", zip, nil)
+	require.True(t, r.OK)
+	require.Equal(t, SHA512, r.Digest.Algorithm)
+}
+
+func TestVersions(t *testing.T) {
+	v := NewVersions(64)
+	d := Digest{Key: "k", Algorithm: SHA256, Value: "00"}
+	v.Put("Pkg", map[string][]Digest{"1.0.0": {d}})
+	require.Equal(t, []Digest{d}, v.Get("pkg", "1.0.0"))
+	require.Empty(t, v.Get("pkg", "2.0.0"))
+
+	// a package listing more than the bound evicts the others
+	big := map[string][]Digest{}
+	for i := 0; i < 10; i++ {
+		big[fmt.Sprintf("%d.0.0", i)] = []Digest{d}
+	}
+	v.Put("big", big)
+	require.Empty(t, v.Get("pkg", "1.0.0"))
+}
+
+func TestH1Mod(t *testing.T) {
+	// go.sum line of golang.org/x/sync v0.1.0/go.mod
+	s := NewStore(1)
+	s.Publish(Digest{Key: "m", Algorithm: H1Mod, Value: "h1:RxMgew5VJxzue5/jJTE5uejpjVlOe/izrB70Jof72aM="})
+	r := s.Verify("m", sums("module golang.org/x/sync\n"), nil)
+	require.True(t, r.OK)
+
+	r = s.Verify("m", sums("module golang.org/x/sync\nrequire evil.example.com v1.0.0\n"), nil)
+	require.False(t, r.OK)
+}
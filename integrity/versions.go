@@ -0,0 +1,55 @@
+package integrity
+
+import (
+	"strings"
+
+	"inivisirisk.com/pse/utils"
+)
+
+// Versions keeps the digests registry metadata lists for every version of a
+// package, by package. Only the version downloaded is then published to the
+// Store, a package listing thousands of versions cannot evict the digests of
+// others. It is bounded by the approximate size of the digests kept.
+type Versions struct {
+	packages *utils.LRU[string, map[string][]Digest]
+}
+
+// NewVersions returns Versions keeping up to size bytes of digests
+func NewVersions(size int) *Versions {
+	return &Versions{packages: utils.NewLRUCost[string, map[string][]Digest](size, versionsCost)}
+}
+
+func versionsCost(versions map[string][]Digest) int {
+	cost := 0
+	for v, digests := range versions {
+		cost += len(v)
+		for _, d := range digests {
+			cost += len(d.Key) + len(d.Algorithm) + len(d.Value)
+		}
+	}
+	return cost
+}
+
+// Put adds the versions listed for pkg, those listed before are kept
+func (v *Versions) Put(pkg string, versions map[string][]Digest) {
+	if len(versions) == 0 {
+		return
+	}
+	v.packages.Update(strings.ToLower(pkg), func(prev map[string][]Digest, ok bool) map[string][]Digest {
+		// Get reads prev without the lock, it is copied rather than changed
+		merged := make(map[string][]Digest, len(prev)+len(versions))
+		for ver, d := range prev {
+			merged[ver] = d
+		}
+		for ver, d := range versions {
+			merged[ver] = d
+		}
+		return merged
+	})
+}
+
+// Get returns the digests listed for version of pkg
+func (v *Versions) Get(pkg, version string) []Digest {
+	versions, _ := v.packages.Get(strings.ToLower(pkg))
+	return versions[version]
+}
@@ -1,16 +1,23 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/urfave/cli/v2"
 	"inivisirisk.com/pse/config"
+	"inivisirisk.com/pse/policy"
 	"inivisirisk.com/pse/proxy"
 	"inivisirisk.com/pse/server"
+	"inivisirisk.com/pse/upstream"
 )
 
 var (
@@ -29,7 +36,7 @@ func main() {
 			{
 				Name:  "serve",
 				Usage: "serve web",
-				Flags: []cli.Flag{
+				Flags: append([]cli.Flag{
 					&cli.StringFlag{
 						Name:        "policy",
 						Usage:       "Policy Configuration",
@@ -53,7 +60,58 @@ func main() {
 						Value:       false,
 						Destination: &globalSession,
 					},
-				},
+					&cli.StringFlag{
+						Name:  "ca-cert",
+						Usage: "PEM certificate of the CA used to intercept TLS, root or intermediate",
+					},
+					&cli.StringFlag{
+						Name:  "ca-key",
+						Usage: "PEM private key of the CA",
+					},
+					&cli.StringFlag{
+						Name:  "ca-pkcs12",
+						Usage: "PKCS#12 bundle with the CA certificate and key, replaces ca-cert and ca-key",
+					},
+					&cli.StringFlag{
+						Name:    "ca-pkcs12-password",
+						Usage:   "password of the PKCS#12 bundle",
+						EnvVars: []string{"PSE_CA_PKCS12_PASSWORD"},
+					},
+					&cli.StringFlag{
+						Name:  "ca-dir",
+						Usage: "directory the generated root CA is kept in",
+					},
+					&cli.StringFlag{
+						Name:  "upstream-proxy",
+						Usage: "parent proxy url outgoing connections are chained through, http://, https:// or socks5://",
+					},
+					&cli.StringFlag{
+						Name:  "upstream-proxy-username",
+						Usage: "username for the parent proxy",
+					},
+					&cli.StringFlag{
+						Name:    "upstream-proxy-password",
+						Usage:   "password for the parent proxy",
+						EnvVars: []string{"PSE_UPSTREAM_PROXY_PASSWORD"},
+					},
+					&cli.StringSliceFlag{
+						Name:  "upstream-no-proxy",
+						Usage: "hosts dialed directly instead of through the parent proxy",
+					},
+					&cli.StringFlag{
+						Name:  "policy-bundle",
+						Usage: "directory, bundle tarball or .rego file to load policies from instead of the portal",
+					},
+					&cli.BoolFlag{
+						Name:  "policy-watch",
+						Usage: "reload the policy bundle when it changes",
+					},
+					&cli.DurationFlag{
+						Name:  "shutdown-timeout",
+						Usage: "time given to downloads in flight on SIGTERM before open sessions are flushed",
+						Value: 30 * time.Second,
+					},
+				}, listenerFlags()...),
 				Action: func(c *cli.Context) error {
 					os.Setenv("LEAKS_FILE_PATH", leaksFile)
 					os.Setenv("GLOBAL_SESSION", strconv.FormatBool(globalSession))
@@ -61,11 +119,71 @@ func main() {
 					if err != nil {
 						return err
 					}
-					s := server.StartServer(8081, "policy/policies")
-					defer s.Close()
+					applyCAFlags(c, &config.Cfg().CA)
+					applyUpstreamFlags(c, &config.Cfg().Upstream)
+					applyPolicyBundleFlags(c, &config.Cfg().PolicyBundle)
+					if err := upstream.Set(config.Cfg().Upstream); err != nil {
+						return err
+					}
+					listeners := &config.Cfg().Listeners
+					applyListenerFlags(c, "proxy", &listeners.Proxy)
+					applyListenerFlags(c, "tls", &listeners.TLS)
+					applyListenerFlags(c, "policy-server", &listeners.Policy)
+					applyListenerFlags(c, "control", &listeners.Control)
+					var s *server.Server
+					if !listeners.Policy.Disabled {
+						l, err := listeners.Policy.Listen()
+						if err != nil {
+							return err
+						}
+						s = server.Serve(l, "policy/policies")
+						defer s.Close()
+					}
 					p := proxy.NewProxy(policyFile)
-					p.Start()
-					return nil
+
+					ctx, stop := signal.NotifyContext(c.Context, syscall.SIGTERM, os.Interrupt)
+					defer stop()
+					errs := make(chan error, 1)
+					go func() { errs <- p.Start() }()
+					select {
+					case err := <-errs:
+						if err != nil {
+							return err
+						}
+					case <-ctx.Done():
+						stop()
+					}
+
+					shutdownCtx, cancel := context.WithTimeout(context.Background(), c.Duration("shutdown-timeout"))
+					defer cancel()
+					err = p.Shutdown(shutdownCtx)
+					if s != nil {
+						s.Shutdown(shutdownCtx)
+					}
+					return err
+				},
+			},
+			{
+				Name:  "policy",
+				Usage: "policy tools",
+				Subcommands: []*cli.Command{
+					{
+						Name:      "eval",
+						Usage:     "evaluate recorded policy inputs, one JSON document per line, against a policy bundle",
+						ArgsUsage: "inputs.jsonl",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:     "bundle",
+								Usage:    "directory, bundle tarball or .rego file to evaluate",
+								Required: true,
+							},
+							&cli.StringFlag{
+								Name:  "diff",
+								Usage: "second bundle, only inputs it decides differently are printed",
+							},
+						},
+						Action: policyEval,
+					},
 				},
 			},
 		},
@@ -76,3 +194,140 @@ func main() {
 		log.Fatal(err)
 	}
 }
+
+var (
+	listenerNames = []struct{ name, desc string }{
+		{"proxy", "proxy (CONNECT/HTTP)"},
+		{"tls", "direct TLS"},
+		{"policy-server", "policy server"},
+		{"control", "control endpoint"},
+	}
+)
+
+// listenerFlags returns the address, port, socket and disable flags for every
+// listener. They override the listeners section of the configuration file.
+func listenerFlags() []cli.Flag {
+	flags := []cli.Flag{}
+	for _, ln := range listenerNames {
+		name, desc := ln.name, ln.desc
+		flags = append(flags,
+			&cli.StringFlag{
+				Name:  name + "-address",
+				Usage: "bind address of the " + desc + " listener",
+			},
+			&cli.IntFlag{
+				Name:  name + "-port",
+				Usage: "port of the " + desc + " listener",
+			},
+			&cli.StringFlag{
+				Name:  name + "-socket",
+				Usage: "unix socket path of the " + desc + " listener, replaces address and port",
+			},
+			&cli.BoolFlag{
+				Name:  name + "-disabled",
+				Usage: "disable the " + desc + " listener",
+			},
+		)
+	}
+	return flags
+}
+
+// applyListenerFlags overrides l with the flags set for the named listener.
+// Setting an address, port or socket enables the listener unless it is also
+// explicitly disabled.
+func applyListenerFlags(c *cli.Context, name string, l *config.Listener) {
+	if c.IsSet(name + "-address") {
+		l.Address = c.String(name + "-address")
+		l.Disabled = false
+	}
+	if c.IsSet(name + "-port") {
+		l.Port = c.Int(name + "-port")
+		l.Disabled = false
+	}
+	if c.IsSet(name + "-socket") {
+		l.Socket = c.String(name + "-socket")
+		l.Disabled = false
+	}
+	if c.IsSet(name + "-disabled") {
+		l.Disabled = c.Bool(name + "-disabled")
+	}
+}
+
+func applyCAFlags(c *cli.Context, ca *config.CA) {
+	if c.IsSet("ca-cert") {
+		ca.Cert = c.String("ca-cert")
+	}
+	if c.IsSet("ca-key") {
+		ca.Key = c.String("ca-key")
+	}
+	if c.IsSet("ca-pkcs12") {
+		ca.PKCS12 = c.String("ca-pkcs12")
+	}
+	if c.IsSet("ca-pkcs12-password") {
+		ca.PKCS12Password = c.String("ca-pkcs12-password")
+	}
+	if c.IsSet("ca-dir") {
+		ca.Dir = c.String("ca-dir")
+	}
+}
+
+func policyEval(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return cli.Exit("expecting one inputs file, - reads stdin", 2)
+	}
+	in := os.Stdin
+	if name := c.Args().First(); name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	inputs, err := policy.ReadInputs(in)
+	if err != nil {
+		return err
+	}
+	p, err := policy.NewLocalPolicy(c.String("bundle"), false)
+	if err != nil {
+		return err
+	}
+	defer p.Stop(c.Context)
+	if !c.IsSet("diff") {
+		p.EvalInputs(c.Context, os.Stdout, inputs)
+		return nil
+	}
+	to, err := policy.NewLocalPolicy(c.String("diff"), false)
+	if err != nil {
+		return err
+	}
+	defer to.Stop(c.Context)
+	if n := policy.DiffInputs(c.Context, os.Stdout, inputs, p, to); n > 0 {
+		return cli.Exit(fmt.Sprintf("%v of %v decisions differ", n, len(inputs)), 1)
+	}
+	return nil
+}
+
+func applyPolicyBundleFlags(c *cli.Context, b *config.PolicyBundle) {
+	if c.IsSet("policy-bundle") {
+		b.Path = c.String("policy-bundle")
+	}
+	if c.IsSet("policy-watch") {
+		b.Watch = c.Bool("policy-watch")
+	}
+}
+
+func applyUpstreamFlags(c *cli.Context, u *config.Upstream) {
+	if c.IsSet("upstream-proxy") {
+		u.URL = c.String("upstream-proxy")
+	}
+	if c.IsSet("upstream-proxy-username") {
+		u.Username = c.String("upstream-proxy-username")
+	}
+	if c.IsSet("upstream-proxy-password") {
+		u.Password = c.String("upstream-proxy-password")
+	}
+	if c.IsSet("upstream-no-proxy") {
+		u.NoProxy = c.StringSlice("upstream-no-proxy")
+	}
+}
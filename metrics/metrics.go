@@ -0,0 +1,96 @@
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	// Registry holds every metric served by Handler
+	Registry = prometheus.NewRegistry()
+
+	// Requests counts intercepted requests by the technology handling them
+	Requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pse_requests_total",
+		Help: "Intercepted requests by technology.",
+	}, []string{"technology"})
+
+	// Decisions counts policy decisions by allow, alert and deny
+	Decisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pse_decisions_total",
+		Help: "Policy decisions by outcome.",
+	}, []string{"decision"})
+
+	// OPADecision observes how long OPA takes to evaluate a decision
+	OPADecision = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "pse_opa_decision_seconds",
+		Help:    "Latency of OPA decisions.",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+	})
+
+	// CertIssue observes how long issuing a leaf certificate takes
+	CertIssue = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "pse_cert_issue_seconds",
+		Help:    "Latency of leaf certificate issuance.",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+	})
+
+	// DecisionCache counts request decisions served from the cache, hit, or
+	// evaluated by OPA, miss
+	DecisionCache = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pse_decision_cache_total",
+		Help: "Request decision cache lookups by result.",
+	}, []string{"result"})
+
+	// Integrity counts downloads compared with the digest their registry
+	// published, verified or mismatch
+	Integrity = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pse_integrity_checks_total",
+		Help: "Registry integrity checks by result.",
+	}, []string{"result"})
+
+	// Bytes counts body bytes proxied, upload or download
+	Bytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pse_proxied_bytes_total",
+		Help: "Bytes proxied by direction.",
+	}, []string{"direction"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		Requests,
+		Decisions,
+		DecisionCache,
+		OPADecision,
+		CertIssue,
+		Integrity,
+		Bytes,
+	)
+}
+
+// Since observes the time elapsed since start on h, to be deferred
+func Since(h prometheus.Observer, start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+// Sessions reports the number of open build sessions, as returned by count,
+// on every scrape
+func Sessions(count func() int) {
+	Registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "pse_sessions_active",
+		Help: "Open build sessions.",
+	}, func() float64 {
+		return float64(count())
+	}))
+}
+
+// Handler serves the registry in the Prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
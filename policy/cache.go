@@ -0,0 +1,105 @@
+package policy
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"inivisirisk.com/pse/utils"
+)
+
+// decisionCache is a fixed size LRU of request decisions. Entries expire
+// after ttl and are dropped once the policy revision they were taken under
+// is replaced.
+type decisionCache struct {
+	mutex    sync.Mutex
+	ttl      time.Duration
+	revision string
+	entries  *utils.LRU[string, *decisionEntry]
+}
+
+type decisionEntry struct {
+	result   map[string]interface{}
+	decision Decision
+	expires  time.Time
+}
+
+func newDecisionCache(size int, ttl time.Duration) *decisionCache {
+	return &decisionCache{
+		ttl:     ttl,
+		entries: utils.NewLRU[string, *decisionEntry](size),
+	}
+}
+
+// decisionKey normalizes the request input, the api key and additional
+// context are the same for every request and left out
+func decisionKey(in RequestPolicyInput) (string, bool) {
+	details, err := json.Marshal(in.Details)
+	if err != nil {
+		return "", false
+	}
+	return strings.Join([]string{
+		string(in.PackageRegistry),
+		in.Action,
+		strings.ToLower(in.Host),
+		string(details),
+	}, "\x00"), true
+}
+
+// sync drops every entry when revision differs from the one cached under,
+// the mutex must be held
+func (c *decisionCache) sync(revision string) {
+	if revision == c.revision {
+		return
+	}
+	c.revision = revision
+	c.entries.Clear()
+}
+
+// get returns a copy of the cached OPA result, callers are free to modify it
+func (c *decisionCache) get(key, revision string) (map[string]interface{}, Decision, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.sync(revision)
+	entry, ok := c.entries.Get(key)
+	if !ok {
+		return nil, Decision{}, false
+	}
+	if time.Now().After(entry.expires) {
+		c.entries.Remove(key)
+		return nil, Decision{}, false
+	}
+	return copyResult(entry.result), entry.decision, true
+}
+
+func (c *decisionCache) add(key, revision string, result map[string]interface{}, dec Decision) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.sync(revision)
+	c.entries.Put(key, &decisionEntry{
+		result:   copyResult(result),
+		decision: dec,
+		expires:  time.Now().Add(c.ttl),
+	})
+}
+
+func (c *decisionCache) len() int {
+	return c.entries.Len()
+}
+
+// copyResult copies the maps of an OPA result, the secret check rewrites
+// them in place
+func copyResult(m map[string]interface{}) map[string]interface{} {
+	if m == nil {
+		return nil
+	}
+	c := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		if vm, ok := v.(map[string]interface{}); ok {
+			v = copyResult(vm)
+		}
+		c[k] = v
+	}
+	return c
+}
@@ -0,0 +1,201 @@
+package policy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/invisirisk/svcs/model"
+	"github.com/open-policy-agent/opa/sdk"
+	"github.com/stretchr/testify/require"
+	"inivisirisk.com/pse/config"
+	"inivisirisk.com/pse/session"
+)
+
+// countingDecider alerts on every request and counts the evaluations
+type countingDecider struct {
+	calls int32
+}
+
+func (d *countingDecider) Decision(ctx context.Context, options sdk.DecisionOptions) (*sdk.DecisionResult, error) {
+	atomic.AddInt32(&d.calls, 1)
+	return &sdk.DecisionResult{
+		Result: map[string]interface{}{
+			"final_decision":        map[string]interface{}{"result": "alert/warn"},
+			"final_secret_decision": map[string]interface{}{"check": false, "result": "alert/warn"},
+		},
+	}, nil
+}
+
+func (d *countingDecider) Stop(ctx context.Context) {
+}
+
+func npmActivity(version string) *session.Activity {
+	return &session.Activity{
+		ActivityHdr: model.ActivityHdr{Name: model.NPM, Action: "GET"},
+		Activity:    map[string]string{"package": "left-pad", "version": version},
+	}
+}
+
+func TestDecisionCache(t *testing.T) {
+	c := newDecisionCache(2, time.Hour)
+	result := map[string]interface{}{"final_decision": map[string]interface{}{"result": "alert/warn"}}
+	c.add("a", "r1", result, Decision{Decision: Alert})
+
+	got, dec, ok := c.get("a", "r1")
+	require.True(t, ok)
+	require.Equal(t, Alert, dec.Decision)
+	// callers rewrite the result, the cached one is left alone
+	got["final_decision"].(map[string]interface{})["result"] = "alert"
+	got, _, _ = c.get("a", "r1")
+	require.Equal(t, "alert/warn", got["final_decision"].(map[string]interface{})["result"])
+
+	c.add("b", "r1", result, Decision{Decision: Allow})
+	c.add("c", "r1", result, Decision{Decision: Allow})
+	require.Equal(t, 2, c.len())
+	_, _, ok = c.get("a", "r1")
+	require.False(t, ok)
+
+	// a new revision drops everything cached before
+	_, _, ok = c.get("c", "r2")
+	require.False(t, ok)
+	require.Equal(t, 0, c.len())
+
+	c = newDecisionCache(2, time.Millisecond)
+	c.add("a", "", result, Decision{Decision: Allow})
+	time.Sleep(5 * time.Millisecond)
+	_, _, ok = c.get("a", "")
+	require.False(t, ok)
+}
+
+func TestRequestDecisionCached(t *testing.T) {
+	d := &countingDecider{}
+	p := NewPolicyWithDecider(d)
+	req, _ := http.NewRequest("GET", "https://registry.npmjs.org/left-pad", nil)
+	for i := 0; i < 3; i++ {
+		act := npmActivity("1.3.0")
+		dec, err := p.GetRequestDecision(context.Background(), act, req)
+		require.NoError(t, err)
+		require.Equal(t, Alert, dec.Decision)
+		require.Equal(t, model.AlertWarning, dec.AlertLevel)
+	}
+	require.EqualValues(t, 1, d.calls)
+
+	_, err := p.GetRequestDecision(context.Background(), npmActivity("1.3.1"), req)
+	require.NoError(t, err)
+	require.EqualValues(t, 2, d.calls)
+}
+
+func TestRequestDecisionReloaded(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "combined.rego")
+	require.NoError(t, os.WriteFile(file, []byte(combinedRego("evil.example.com")), 0644))
+	p, err := NewLocalPolicy(dir, true)
+	require.NoError(t, err)
+	defer p.Stop(context.Background())
+	require.Equal(t, Allow, requestDecision(t, p, "registry.npmjs.org"))
+
+	// the cached allow is dropped with the revision it was taken under
+	require.NoError(t, os.WriteFile(file, []byte(combinedRego("registry.npmjs.org")), 0644))
+	require.Eventually(t, func() bool {
+		return requestDecision(t, p, "registry.npmjs.org") == Deny
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+// failingDecider fails the first fails evaluations
+type failingDecider struct {
+	countingDecider
+	fails int32
+}
+
+func (d *failingDecider) Decision(ctx context.Context, options sdk.DecisionOptions) (*sdk.DecisionResult, error) {
+	if atomic.AddInt32(&d.fails, -1) >= 0 {
+		atomic.AddInt32(&d.calls, 1)
+		return nil, errors.New("bundle not activated")
+	}
+	return d.countingDecider.Decision(ctx, options)
+}
+
+func TestPolicyFailure(t *testing.T) {
+	saved := config.Cfg().PolicyFailure
+	defer func() { config.Cfg().PolicyFailure = saved }()
+	defer func(b time.Duration) { retryBackoff = b }(retryBackoff)
+	retryBackoff = time.Millisecond
+	req, _ := http.NewRequest("GET", "https://registry.npmjs.org/left-pad", nil)
+
+	config.Cfg().PolicyFailure = config.PolicyFailure{}
+	dec, err := NewPolicyWithDecider(&failingDecider{fails: 1}).GetRequestDecision(context.Background(), npmActivity("1.3.0"), req)
+	require.Error(t, err)
+	require.Equal(t, Alert, dec.Decision)
+	require.Equal(t, model.AlertError, dec.AlertLevel)
+	require.Equal(t, failurePolicy, dec.PolicyChecks[0].Policy)
+
+	config.Cfg().PolicyFailure = config.PolicyFailure{
+		Technologies: map[string]config.FailureMode{"npm": {Mode: config.FailClosed, Retries: 1}},
+	}
+	// a single failure is retried
+	d := &failingDecider{fails: 1}
+	dec, err = NewPolicyWithDecider(d).GetRequestDecision(context.Background(), npmActivity("1.3.0"), req)
+	require.NoError(t, err)
+	require.Equal(t, Alert, dec.Decision)
+	require.EqualValues(t, 2, d.calls)
+
+	d = &failingDecider{fails: 2}
+	dec, err = NewPolicyWithDecider(d).GetRequestDecision(context.Background(), npmActivity("1.3.0"), req)
+	require.Error(t, err)
+	require.Equal(t, Deny, dec.Decision)
+	require.Equal(t, failurePolicy, dec.PolicyChecks[0].Policy)
+	require.EqualValues(t, 2, d.calls)
+
+	// other technologies keep failing open
+	act := npmActivity("1.3.0")
+	act.Name = model.Git
+	dec, err = NewPolicyWithDecider(&failingDecider{fails: 1}).GetRequestDecision(context.Background(), act, req)
+	require.Error(t, err)
+	require.Equal(t, Alert, dec.Decision)
+}
+
+func TestSecretInitFailure(t *testing.T) {
+	saved := config.Cfg().PolicyFailure
+	defer func() { config.Cfg().PolicyFailure = saved }()
+	t.Setenv("LEAKS_FILE_PATH", filepath.Join(t.TempDir(), "leaks.toml"))
+	decide := func() Decision {
+		req, _ := http.NewRequest("POST", "https://example.com/upload", strings.NewReader("payload"))
+		act := &session.Activity{ActivityHdr: model.ActivityHdr{Name: model.Web, Action: "POST"}}
+		dec, err := NewPolicyWithDecider(&countingDecider{}).GetRequestDecision(context.Background(), act, req)
+		require.NoError(t, err)
+		body, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		require.Equal(t, "payload", string(body))
+		return dec
+	}
+	failed := func(dec Decision) bool {
+		for _, check := range dec.PolicyChecks {
+			if check.Policy == failurePolicy {
+				return true
+			}
+		}
+		return false
+	}
+
+	// a scanner failing to load is a policy failing to evaluate, open alerts
+	config.Cfg().PolicyFailure = config.PolicyFailure{}
+	dec := decide()
+	require.Equal(t, Alert, dec.Decision)
+	require.True(t, failed(dec))
+
+	// and closed denies
+	config.Cfg().PolicyFailure = config.PolicyFailure{
+		Technologies: map[string]config.FailureMode{"web": {Mode: config.FailClosed}},
+	}
+	dec = decide()
+	require.Equal(t, Deny, dec.Decision)
+	require.True(t, failed(dec))
+}
@@ -0,0 +1,103 @@
+package policy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+)
+
+// ReadInputs decodes recorded policy inputs, one JSON document per line.
+// Blank lines are skipped.
+func ReadInputs(r io.Reader) ([]PolicyInput, error) {
+	var inputs []PolicyInput
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var input PolicyInput
+		if err := json.Unmarshal([]byte(text), &input); err != nil {
+			return nil, fmt.Errorf("line %v: %w", line, err)
+		}
+		inputs = append(inputs, input)
+	}
+	return inputs, scanner.Err()
+}
+
+// Evaluate takes the decision the proxy takes on input
+func (policy *Policy) Evaluate(ctx context.Context, input PolicyInput) (Decision, error) {
+	_, dec, err := policy.GetOpaAndPolicyDecision(ctx, input)
+	return dec, err
+}
+
+// formatDecision renders dec as decision[/alert level] followed by the detail
+func formatDecision(dec Decision) string {
+	s := dec.Decision
+	if dec.AlertLevel != "" {
+		s += "/" + string(dec.AlertLevel)
+	}
+	if dec.Detail != "" {
+		s += " " + dec.Detail
+	}
+	return s
+}
+
+func inputName(input PolicyInput) string {
+	return fmt.Sprintf("%v %v %v", input.Request.PackageRegistry, input.Request.Action, input.Request.Host)
+}
+
+func writeChecks(w io.Writer, checks []policyCheck) {
+	for _, c := range checks {
+		fmt.Fprintf(w, "\t%v: %v %v\n", c.Policy, c.Decision, c.Detail)
+	}
+}
+
+// EvalInputs writes the decision, alert level and policy checks taken on
+// every input to w
+func (policy *Policy) EvalInputs(ctx context.Context, w io.Writer, inputs []PolicyInput) {
+	for i, input := range inputs {
+		dec, err := policy.Evaluate(ctx, input)
+		if err != nil {
+			fmt.Fprintf(w, "%v: %v: error %v\n", i+1, inputName(input), err)
+			continue
+		}
+		fmt.Fprintf(w, "%v: %v: %v\n", i+1, inputName(input), formatDecision(dec))
+		writeChecks(w, dec.PolicyChecks)
+	}
+}
+
+// DiffInputs evaluates every input against both policies and writes the ones
+// decided differently to w. It returns the number of differences.
+func DiffInputs(ctx context.Context, w io.Writer, inputs []PolicyInput, from, to *Policy) int {
+	diffs := 0
+	for i, input := range inputs {
+		a, errA := from.Evaluate(ctx, input)
+		b, errB := to.Evaluate(ctx, input)
+		if reflect.DeepEqual(a, b) && (errA == nil) == (errB == nil) {
+			continue
+		}
+		diffs++
+		fmt.Fprintf(w, "%v: %v\n", i+1, inputName(input))
+		for _, side := range []struct {
+			mark string
+			dec  Decision
+			err  error
+		}{{"-", a, errA}, {"+", b, errB}} {
+			if side.err != nil {
+				fmt.Fprintf(w, "%v error %v\n", side.mark, side.err)
+				continue
+			}
+			fmt.Fprintf(w, "%v %v\n", side.mark, formatDecision(side.dec))
+			writeChecks(w, side.dec.PolicyChecks)
+		}
+	}
+	return diffs
+}
@@ -0,0 +1,66 @@
+package policy
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	evalInputs = `{"request":{"action":"GET","host":"registry.npmjs.org","package_registry":"npm","details":{"package":"left-pad"}}}
+
+{"request":{"action":"GET","host":"evil.example.com","package_registry":"web"}}
+`
+)
+
+// writePolicy writes a combined policy alerting on npm to a temp dir
+func writePolicy(t *testing.T, npm string) string {
+	dir := t.TempDir()
+	rego := `
+		package combined
+
+		default final_decision = {"result": "allow"}
+		final_decision = {"result": "` + npm + `", "details": "npm", "policy_checks": [{"policy": "npm-package", "result": "` + npm + `", "details": "left-pad"}]} {
+			input.request.package_registry == "npm"
+		}
+		final_decision = {"result": "deny", "details": "blocked host"} {
+			input.request.host == "evil.example.com"
+		}
+	`
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "combined.rego"), []byte(rego), 0644))
+	return dir
+}
+
+func TestEvalInputs(t *testing.T) {
+	inputs, err := ReadInputs(strings.NewReader(evalInputs))
+	require.NoError(t, err)
+	require.Len(t, inputs, 2)
+	_, err = ReadInputs(strings.NewReader("{\n"))
+	require.Error(t, err)
+
+	p, err := NewLocalPolicy(writePolicy(t, "alert/warn"), false)
+	require.NoError(t, err)
+	var out bytes.Buffer
+	p.EvalInputs(context.Background(), &out, inputs)
+	require.Equal(t, `1: npm GET registry.npmjs.org: alert/warn npm
+	npm-package: alert/warn left-pad
+2: web GET evil.example.com: deny blocked host
+`, out.String())
+
+	to, err := NewLocalPolicy(writePolicy(t, "deny"), false)
+	require.NoError(t, err)
+	out.Reset()
+	require.Equal(t, 1, DiffInputs(context.Background(), &out, inputs, p, to))
+	require.Equal(t, `1: npm GET registry.npmjs.org
+- alert/warn npm
+	npm-package: alert/warn left-pad
++ deny npm
+	npm-package: deny left-pad
+`, out.String())
+	require.Equal(t, 0, DiffInputs(context.Background(), &out, inputs, p, p))
+}
@@ -0,0 +1,209 @@
+package policy
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/invisirisk/clog"
+	"github.com/open-policy-agent/opa/loader"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/sdk"
+)
+
+const (
+	// changes arriving within this window are reloaded once
+	reloadDelay = 250 * time.Millisecond
+)
+
+// LocalDecider evaluates policies loaded from a directory, a bundle tarball or
+// a single .rego file, without a portal or OPA service configuration.
+type LocalDecider struct {
+	path string
+	cl   *clog.CLog
+
+	mutex   sync.Mutex
+	load    func(*rego.Rego)
+	queries map[string]rego.PreparedEvalQuery
+	// bundle manifest revision and the number of loads, changes on every
+	// reload
+	revision string
+	loads    int
+
+	watcher *fsnotify.Watcher
+	done    chan struct{}
+}
+
+// NewLocalDecider loads the policies at path. With watch set they are
+// reloaded whenever path changes, a reload that fails to compile keeps the
+// policies loaded before.
+func NewLocalDecider(ctx context.Context, path string, watch bool) (*LocalDecider, error) {
+	d := &LocalDecider{
+		path: path,
+		cl:   clog.NewCLog("local-policy"),
+		done: make(chan struct{}),
+	}
+	if err := d.reload(ctx); err != nil {
+		return nil, err
+	}
+	if watch {
+		if err := d.watch(); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// reload reads the policies and replaces the current ones once they compile
+func (d *LocalDecider) reload(ctx context.Context) error {
+	var load func(*rego.Rego)
+	var revision string
+	if strings.HasSuffix(d.path, ".rego") {
+		if _, err := os.Stat(d.path); err != nil {
+			return err
+		}
+		load = rego.Load([]string{d.path}, nil)
+	} else {
+		b, err := loader.NewFileLoader().AsBundle(d.path)
+		if err != nil {
+			return err
+		}
+		load = rego.ParsedBundle("local", b)
+		revision = b.Manifest.Revision
+	}
+	// compile everything up front so a broken change is caught here
+	if _, err := rego.New(rego.Query("data"), load).PrepareForEval(ctx); err != nil {
+		return fmt.Errorf("error compiling policies from %v: %w", d.path, err)
+	}
+
+	d.mutex.Lock()
+	d.load = load
+	d.queries = make(map[string]rego.PreparedEvalQuery)
+	d.loads++
+	d.revision = fmt.Sprintf("%v#%v", revision, d.loads)
+	d.mutex.Unlock()
+	d.cl.Infof("policies loaded from %v", d.path)
+	return nil
+}
+
+// Revision identifies the policies loaded last
+func (d *LocalDecider) Revision() string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.revision
+}
+
+func (d *LocalDecider) prepared(ctx context.Context, path string) (rego.PreparedEvalQuery, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if pq, ok := d.queries[path]; ok {
+		return pq, nil
+	}
+	query := "data." + strings.ReplaceAll(strings.Trim(path, "/"), "/", ".")
+	pq, err := rego.New(rego.Query(query), d.load).PrepareForEval(ctx)
+	if err != nil {
+		return pq, err
+	}
+	d.queries[path] = pq
+	return pq, nil
+}
+
+func (d *LocalDecider) Decision(ctx context.Context, options sdk.DecisionOptions) (*sdk.DecisionResult, error) {
+	pq, err := d.prepared(ctx, options.Path)
+	if err != nil {
+		return nil, err
+	}
+	rs, err := pq.Eval(ctx, rego.EvalInput(options.Input))
+	if err != nil {
+		return nil, err
+	}
+	if len(rs) == 0 || len(rs[0].Expressions) == 0 {
+		return nil, &sdk.Error{
+			Code:    sdk.UndefinedErr,
+			Message: fmt.Sprintf("%v decision was undefined", options.Path),
+		}
+	}
+	return &sdk.DecisionResult{
+		Result: rs[0].Expressions[0].Value,
+	}, nil
+}
+
+func (d *LocalDecider) Stop(ctx context.Context) {
+	if d.watcher != nil {
+		close(d.done)
+		d.watcher.Close()
+	}
+}
+
+// watch follows every directory below path, or the directory holding path
+// when it is a file since editors replace files instead of writing them.
+func (d *LocalDecider) watch() error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(d.path)
+	if err != nil {
+		w.Close()
+		return err
+	}
+	if fi.IsDir() {
+		err = filepath.Walk(d.path, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return w.Add(path)
+			}
+			return nil
+		})
+	} else {
+		err = w.Add(filepath.Dir(d.path))
+	}
+	if err != nil {
+		w.Close()
+		return err
+	}
+	d.watcher = w
+	go d.follow(fi.IsDir())
+	return nil
+}
+
+func (d *LocalDecider) follow(dir bool) {
+	target := filepath.Clean(d.path)
+	var timer <-chan time.Time
+	for {
+		select {
+		case <-d.done:
+			return
+		case ev, ok := <-d.watcher.Events:
+			if !ok {
+				return
+			}
+			if !dir && filepath.Clean(ev.Name) != target {
+				continue
+			}
+			if dir && ev.Op&fsnotify.Create != 0 {
+				if fi, err := os.Stat(ev.Name); err == nil && fi.IsDir() {
+					d.watcher.Add(ev.Name)
+				}
+			}
+			timer = time.After(reloadDelay)
+		case err, ok := <-d.watcher.Errors:
+			if !ok {
+				return
+			}
+			d.cl.Errorf("watch error %v", err)
+		case <-timer:
+			timer = nil
+			if err := d.reload(context.Background()); err != nil {
+				d.cl.Errorf("reload failed, keeping the policies loaded before: %v", err)
+			}
+		}
+	}
+}
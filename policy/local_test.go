@@ -0,0 +1,78 @@
+package policy
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/invisirisk/svcs/model"
+	"github.com/stretchr/testify/require"
+	"inivisirisk.com/pse/session"
+)
+
+// combinedRego denies the given host and allows everything else
+func combinedRego(deny string) string {
+	return `
+		package combined
+
+		default final_decision = {"result": "allow"}
+		final_decision = {"result": "deny", "details": "blocked host"} {
+			input.request.host == "` + deny + `"
+		}
+		final_secret_decision = {"check": false, "result": "allow"}
+	`
+}
+
+func requestDecision(t *testing.T, p *Policy, host string) string {
+	act := &session.Activity{
+		ActivityHdr: model.ActivityHdr{Name: model.Web, Action: "GET"},
+		Activity:    model.WebActivity{URL: "https://" + host + "/"},
+	}
+	req, _ := http.NewRequest("GET", "https://"+host+"/", nil)
+	dec, err := p.GetRequestDecision(context.Background(), act, req)
+	require.NoError(t, err)
+	return dec.Decision
+}
+
+func TestLocalPolicy(t *testing.T) {
+	t.Setenv("INVISIRISK_JWT_TOKEN", "")
+	t.Setenv("INVISIRISK_PORTAL", "")
+	dir := t.TempDir()
+	file := filepath.Join(dir, "combined.rego")
+	require.NoError(t, os.WriteFile(file, []byte(combinedRego("evil.example.com")), 0644))
+
+	for _, path := range []string{dir, file} {
+		p, err := NewLocalPolicy(path, false)
+		require.NoError(t, err, path)
+		require.Equal(t, Deny, requestDecision(t, p, "evil.example.com"))
+		require.Equal(t, Allow, requestDecision(t, p, "registry.npmjs.org"))
+		p.Stop(context.Background())
+	}
+
+	_, err := NewLocalPolicy(filepath.Join(dir, "missing"), false)
+	require.Error(t, err)
+}
+
+func TestLocalPolicyReload(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "combined.rego")
+	require.NoError(t, os.WriteFile(file, []byte(combinedRego("evil.example.com")), 0644))
+
+	p, err := NewLocalPolicy(dir, true)
+	require.NoError(t, err)
+	defer p.Stop(context.Background())
+	require.Equal(t, Allow, requestDecision(t, p, "registry.npmjs.org"))
+
+	require.NoError(t, os.WriteFile(file, []byte(combinedRego("registry.npmjs.org")), 0644))
+	require.Eventually(t, func() bool {
+		return requestDecision(t, p, "registry.npmjs.org") == Deny
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// a change that does not compile keeps the policies loaded before
+	require.NoError(t, os.WriteFile(file, []byte("package combined\nfinal_decision = {"), 0644))
+	time.Sleep(3 * reloadDelay)
+	require.Equal(t, Deny, requestDecision(t, p, "registry.npmjs.org"))
+}
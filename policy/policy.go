@@ -11,19 +11,29 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/invisirisk/clog"
 	"github.com/invisirisk/svcs/model"
 	"github.com/open-policy-agent/opa/logging"
+	"github.com/open-policy-agent/opa/plugins/bundle"
 	"github.com/open-policy-agent/opa/sdk"
+	"inivisirisk.com/pse/config"
+	"inivisirisk.com/pse/metrics"
 	"inivisirisk.com/pse/session"
 	"inivisirisk.com/pse/utils"
 )
 
 type Policy struct {
 	opa PolicyDecider
+	// cache of request decisions, nil when disabled
+	cache *decisionCache
+	// revision of the loaded policies, cached decisions are dropped when it
+	// changes
+	revision func() string
 }
 type PolicyInput struct{
 	IsResponseReady bool `json:"is_response_ready" default:"false"`
@@ -54,6 +64,14 @@ type ResponsePolicyInput struct {
 	Request    RequestMetadata `json:"request"`
 	MimeType  string		   `json:"mime_type"`
 	Checksum string         `json:"checksum"`
+	SHA1 string `json:"sha1,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+	SHA512 string `json:"sha512,omitempty"`
+	// Integrity is verified or mismatch when the registry published a digest
+	Integrity string `json:"integrity,omitempty"`
+	// Metadata the registry published about the package version, for npm
+	// the install scripts, deprecation, publish time and maintainers
+	Metadata interface{} `json:"metadata,omitempty"`
 	ContentLength float32 `json:"content_length"`
 	FileSize int64 `json:"file_size"`
 }
@@ -79,6 +97,16 @@ var (
 		Decision: Allow,
 	}
 )
+const (
+	// failurePolicy names the check recorded on decisions taken without a
+	// policy
+	failurePolicy = "policy-unavailable"
+)
+var (
+	// retryBackoff is the wait before the first retry of a failed evaluation,
+	// it doubles on every retry
+	retryBackoff = 100 * time.Millisecond
+)
 var(
 	leaksPath="./leaks.toml"
 	leaksPathTest="../leaks.toml"
@@ -160,6 +188,35 @@ func NewPolicy(config string) (*Policy, error) {
 
 }
 
+// NewLocalPolicy evaluates the policies at path, a directory, bundle tarball
+// or .rego file, and needs neither portal nor token
+func NewLocalPolicy(path string, watch bool) (*Policy, error) {
+	ctx, _ := clog.WithCtx(context.TODO(), "policy")
+	d, err := NewLocalDecider(ctx, path, watch)
+	if err != nil {
+		return nil, err
+	}
+	p := withDecider(d)
+	p.revision = d.Revision
+	return p, nil
+}
+
+// NewPolicyWithDecider returns a policy evaluated by d instead of an OPA
+// instance configured from a bundle
+func NewPolicyWithDecider(d PolicyDecider) *Policy {
+	return withDecider(d)
+}
+
+func withDecider(d PolicyDecider) *Policy {
+	p := &Policy{
+		opa: d,
+	}
+	if cfg := config.Cfg().DecisionCache; !cfg.Disabled && cfg.Size > 0 {
+		p.cache = newDecisionCache(cfg.Size, time.Duration(cfg.TTLSeconds)*time.Second)
+	}
+	return p
+}
+
 func newPolicy(ctx context.Context, cfg io.Reader) (*Policy, error) {
 	log := logging.New()
 	const DEFAULT_TIMEOUT = 10 // seconds
@@ -180,9 +237,9 @@ func newPolicy(ctx context.Context, cfg io.Reader) (*Policy, error) {
 
 	select {
 	case <-readyChan:
-		return &Policy{
-			opa: opa,
-		}, nil
+		p := withDecider(opa)
+		p.revision = bundleRevision(opa)
+		return p, nil
 	case <-ctx.Done():
 		return nil, fmt.Errorf("timeout While starting OPA: %w", ctx.Err())
 	}
@@ -197,7 +254,9 @@ func (policy *Policy) GetOpaDecision(ctx context.Context, input PolicyInput) (ma
 		Input: input,
 	}
 
+	start := time.Now()
 	result, err := policy.opa.Decision(ctx, options)
+	metrics.Since(metrics.OPADecision, start)
 	if err != nil {
 		var opaErr *sdk.Error
 		if errors.As(err, &opaErr) {
@@ -302,7 +361,42 @@ func toString(v interface{}) string {
 	return fmt.Sprintf("%v", v)
 }
 
-func (policy *Policy) SecretCheckDecision(ctx context.Context, act *session.Activity, result *map[string]interface{}, body io.ReadCloser) (Decision, error) {
+// errSecretDenied aborts a streamed body carrying a secret the policy denies
+var errSecretDenied = errors.New("secret denied by policy")
+
+const (
+	// maxHeldBody bounds the request body scanned before it is forwarded
+	maxHeldBody = 4 << 20
+)
+
+type heldBody struct {
+	io.Reader
+	io.Closer
+}
+
+type errReader struct {
+	err error
+}
+
+func (r errReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
+
+// holdBody reads up to maxHeldBody of the scanning reader body, so that the
+// verdict of a body ending within it is given before anything is sent. A
+// denied body fails on the first read.
+func holdBody(body io.ReadCloser) io.ReadCloser {
+	head, err := io.ReadAll(io.LimitReader(body, maxHeldBody+1))
+	if err != nil {
+		return heldBody{errReader{err}, body}
+	}
+	if len(head) <= maxHeldBody {
+		return heldBody{bytes.NewReader(head), body}
+	}
+	return heldBody{io.MultiReader(bytes.NewReader(head), body), body}
+}
+
+func (policy *Policy) SecretCheckDecision(ctx context.Context, act *session.Activity, result *map[string]interface{}, body io.ReadCloser) (Decision, io.ReadCloser, error) {
 	/*
 		Secret Policy Evaluation
 
@@ -315,14 +409,23 @@ func (policy *Policy) SecretCheckDecision(ctx context.Context, act *session.Acti
 		Default Behavior
 
 		If no secret-related policies are found in the policy configuration, the default action is to alert and return an Alert Decision.
+
+		Streaming
+
+		Bodies up to maxHeldBody are read and scanned here, before any of them is forwarded, a denied
+		secret then denies the request. The returned reader scans longer bodies while they are forwarded,
+		once fully read a denied secret fails the reader in place of io.EOF: the last chunk never reaches
+		upstream but the earlier ones have, a deny only truncates such a body.
 	*/
 	cl := clog.FromCtx(ctx)
 	var defaultSecretCheckDecision = map[string]interface{}{"check": true, "result": "deny", "alert_level": model.AlertCritical}
 	const DECISION_PATH string = "final_secret_decision"
 	secret,err:=utils.NewSecrets(GetSecretsFilePath(),"request")
 	if err != nil {
-		cl.Errorf("error initializing secret: %v", err)
-		return DefaultDecision, err
+		// no secrets are looked for, the request is decided as one the
+		// policy failed to evaluate
+		cl.Errorf("error initializing secret, skipping secret check: %v", err)
+		return failureDecision(act.Name, fmt.Errorf("secret check: %w", err)), body, nil
 	}
 
 	secretCheckPolicy, secretErr := policy.extractDecision(*result, DECISION_PATH)
@@ -337,7 +440,13 @@ func (policy *Policy) SecretCheckDecision(ctx context.Context, act *session.Acti
 
 	if body != nil && act.Name == model.Web && (*secretCheckPolicy)["check"].(bool) {
 		cl.Infof("performing secret Checks...")
-		utils.ReaderChain(ctx, body, secret)
+		body = utils.VerdictReaderChain(ctx, body, func(ctx context.Context) error {
+			if act.Decision == model.Deny {
+				return errSecretDenied
+			}
+			return nil
+		}, secret)
+		body = holdBody(body)
 	}
 
 	decisionMap := map[model.Decision]string{
@@ -350,7 +459,7 @@ func (policy *Policy) SecretCheckDecision(ctx context.Context, act *session.Acti
 		Decision:   decisionMap[act.ActivityHdr.Decision],
 		AlertLevel: act.AlertLevel,
 		Detail:     buildDetails(act.ActivityHdr.Checks),
-	}, nil
+	}, body, nil
 }
 
 func buildDetails(checks []model.TechCheck) string {
@@ -432,7 +541,8 @@ func (policy *Policy) generateFinalDecision(decisions ...Decision) Decision {
 }
 
 func GetRequestInput(act *session.Activity,req *http.Request) RequestPolicyInput {
-	apiKey:= utils.GetApiKey()
+	// local policies run without a portal token
+	apiKey := os.Getenv("INVISIRISK_JWT_TOKEN")
 	additional_context:= get_additional_input_context()
 	return RequestPolicyInput{
 			Action:          act.Action,
@@ -468,6 +578,97 @@ func (policy *Policy) GetOpaAndPolicyDecision(ctx context.Context, input PolicyI
 	}
 	return opa_decision,sanitizedPolicyDecision, nil
 }
+// bundleRevision follows the revisions of the bundles opa activates
+func bundleRevision(opa *sdk.OPA) func() string {
+	var mutex sync.Mutex
+	var revision string
+	if bp, ok := opa.Plugin(bundle.Name).(*bundle.Plugin); ok {
+		bp.RegisterBulkListener("pse-decision-cache", func(status map[string]*bundle.Status) {
+			var revs []string
+			for name, s := range status {
+				revs = append(revs, name+"="+s.ActiveRevision)
+			}
+			sort.Strings(revs)
+			mutex.Lock()
+			revision = strings.Join(revs, ",")
+			mutex.Unlock()
+		})
+	}
+	return func() string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return revision
+	}
+}
+
+// evaluate is GetOpaAndPolicyDecision retried as configured for the
+// technology of input
+func (policy *Policy) evaluate(ctx context.Context, input PolicyInput) (map[string]interface{}, Decision, error) {
+	retries := config.Cfg().PolicyFailure.For(string(input.Request.PackageRegistry)).Retries
+	backoff := retryBackoff
+	for attempt := 0; ; attempt++ {
+		result, dec, err := policy.GetOpaAndPolicyDecision(ctx, input)
+		if err == nil || attempt >= retries {
+			return result, dec, err
+		}
+		clog.FromCtx(ctx).Infof("retrying policy evaluation in %v: %v", backoff, err)
+		select {
+		case <-ctx.Done():
+			return result, dec, err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// failureDecision decides a request of tech the policy failed to evaluate,
+// it is allowed with an alert or denied as configured. Either way a check
+// records that the decision was taken without a policy.
+func failureDecision(tech model.ActivityName, err error) Decision {
+	detail := fmt.Sprintf("no policy decision: %v", err)
+	if config.Cfg().PolicyFailure.For(string(tech)).Mode == config.FailClosed {
+		return Decision{
+			Decision:     Deny,
+			AlertLevel:   model.AlertCritical,
+			Detail:       detail,
+			PolicyChecks: []policyCheck{{Policy: failurePolicy, Decision: Deny, Detail: detail}},
+		}
+	}
+	return Decision{
+		Decision:     Alert,
+		AlertLevel:   model.AlertError,
+		Detail:       detail,
+		PolicyChecks: []policyCheck{{Policy: failurePolicy, Decision: string(model.AlertError), Detail: detail}},
+	}
+}
+
+// requestDecision is GetOpaAndPolicyDecision for requests, the decisions are
+// reused for identical requests until the policy revision changes
+func (policy *Policy) requestDecision(ctx context.Context, input PolicyInput) (map[string]interface{}, Decision, error) {
+	if policy.cache == nil {
+		return policy.evaluate(ctx, input)
+	}
+	key, ok := decisionKey(input.Request)
+	if !ok {
+		return policy.evaluate(ctx, input)
+	}
+	revision := ""
+	if policy.revision != nil {
+		revision = policy.revision()
+	}
+	if result, dec, ok := policy.cache.get(key, revision); ok {
+		metrics.DecisionCache.WithLabelValues("hit").Inc()
+		return result, dec, nil
+	}
+	metrics.DecisionCache.WithLabelValues("miss").Inc()
+	result, dec, err := policy.evaluate(ctx, input)
+	if err != nil {
+		return result, dec, err
+	}
+	policy.cache.add(key, revision, result, dec)
+	return result, dec, nil
+}
+
 func (policy *Policy) GetRequestDecision(ctx context.Context, act *session.Activity, request *http.Request) (Decision, error) {
 	/*
 		Generates OPA decision based on policies on request data and metadata and returns a Decision based on the outcome of the evaluation.
@@ -477,21 +678,44 @@ func (policy *Policy) GetRequestDecision(ctx context.Context, act *session.Activ
 		Request: GetRequestInput(act,request),
 		IsResponseReady: false,
 	}
-	opa_decision,sanitizedPolicyDecision, err := policy.GetOpaAndPolicyDecision(ctx, input)
+	opa_decision,sanitizedPolicyDecision, err := policy.requestDecision(ctx, input)
 	if err != nil {
 		cl.Errorf("error generating response from OPA %v", err)
-		return DefaultDecision, err
+		return failureDecision(act.Name, err), err
 	}
 
-	_, err = policy.SecretCheckDecision(ctx, act, &opa_decision, request.Body)
+	// the body is scanned for secrets before or, past maxHeldBody, while it
+	// streams upstream
+	secretDecision, body, err := policy.SecretCheckDecision(ctx, act, &opa_decision, request.Body)
 	if err != nil {
 		cl.Errorf("got error while evaluating secret check %v", err)
 		return sanitizedPolicyDecision, err
 	}
+	request.Body = body
+	// a secret check that could not run carries the check of a failed policy
+	if secretDecision.Decision == Deny || len(secretDecision.PolicyChecks) > 0 {
+		return policy.generateFinalDecision(sanitizedPolicyDecision, secretDecision), nil
+	}
 
 	return sanitizedPolicyDecision, nil
 }
 
+// ConnectDecision evaluates a CONNECT tunnel before it is intercepted. Next to
+// the final decision the combined policy may set "bypass" to splice the tunnel
+// without terminating TLS.
+func (policy *Policy) ConnectDecision(ctx context.Context, act *session.Activity, request *http.Request) (Decision, bool, error) {
+	input := PolicyInput{
+		Request:         GetRequestInput(act, request),
+		IsResponseReady: false,
+	}
+	opa_decision, decision, err := policy.requestDecision(ctx, input)
+	if err != nil {
+		return decision, false, err
+	}
+	bypass, _ := opa_decision["bypass"].(bool)
+	return decision, bypass, nil
+}
+
 func (policy *Policy) extractDecision(result map[string]interface{}, key string) (*map[string]interface{}, error) {
 	// it transforms opa result key of any interface{} to map[string]interface{} for easy access of decision
 
@@ -504,15 +728,27 @@ func (policy *Policy) extractDecision(result map[string]interface{}, key string)
 func (policy *Policy) GetResponseDecision(ctx context.Context, act *session.Activity, body io.ReadCloser, policy_input *PolicyInput) (Decision, error) {
 	cl:= clog.FromCtx(ctx)
 	// Generates OPA decision based on policies on response data and metadata
-	opa_decision,policy_decision,err:=policy.GetOpaAndPolicyDecision(ctx, *policy_input)
+	opa_decision,policy_decision,err:=policy.evaluate(ctx, *policy_input)
 	if err != nil {
 		cl.Errorf("error generating response from OPA %v", err)
+		if body != nil {
+			io.Copy(io.Discard, body)
+		}
+		return failureDecision(act.Name, err), err
 	}
-	_, err = policy.SecretCheckDecision(ctx, act, &opa_decision, body)
+	// a body given here is scanned before returning, the proxy passes none as
+	// its response reader chain scans the streamed body
+	secretDecision, body, err := policy.SecretCheckDecision(ctx, act, &opa_decision, body)
 	if err != nil {
 		cl.Errorf("got error while evaluating secret check %v", err)
 		return policy_decision, err
 	}
+	if body != nil {
+		io.Copy(io.Discard, body)
+	}
+	if len(secretDecision.PolicyChecks) > 0 {
+		return policy.generateFinalDecision(policy_decision, secretDecision), nil
+	}
 	return policy_decision, nil
 }
 func (policy *Policy) Stop(ctx context.Context) {
@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/invisirisk/svcs/model"
+	"inivisirisk.com/pse/session"
+)
+
+// blockPage tells the client why a request was denied, in a form the
+// package manager of the technology prints. The reference is logged with
+// the activity so a failed build can be traced to its decision.
+type blockPage struct {
+	// Error is read by npm and printed next to the status
+	Error     string       `json:"error"`
+	URL       string       `json:"url"`
+	Decision  string       `json:"decision"`
+	Detail    string       `json:"details,omitempty"`
+	Checks    []blockCheck `json:"checks,omitempty"`
+	Reference string       `json:"reference"`
+
+	tech model.ActivityName
+}
+
+type blockCheck struct {
+	Policy  string `json:"policy"`
+	Result  string `json:"result"`
+	Details string `json:"details,omitempty"`
+}
+
+func newReference() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// newBlockPage describes the deny of act with the decision detail, the
+// checks listed are the ones that did not allow it
+func newBlockPage(act *session.Activity, url, detail string) *blockPage {
+	b := &blockPage{
+		URL:       url,
+		Decision:  string(act.Decision),
+		Detail:    detail,
+		Reference: newReference(),
+		tech:      act.Name,
+	}
+	for _, check := range act.Checks {
+		if check.AlertLevel == model.AlertNone {
+			continue
+		}
+		b.Checks = append(b.Checks, blockCheck{
+			Policy:  check.Policy,
+			Result:  check.Name,
+			Details: check.Details,
+		})
+	}
+	b.Error = b.message()
+	return b
+}
+
+// message is the one line summary, naming the policies and the detail
+func (b *blockPage) message() string {
+	msg := "blocked by InvisiRisk policy"
+	var policies []string
+	for _, c := range b.Checks {
+		if c.Policy != "" {
+			policies = append(policies, c.Policy)
+		}
+	}
+	if len(policies) > 0 {
+		msg += " " + strings.Join(policies, ", ")
+	}
+	if b.Detail != "" {
+		msg += ": " + b.Detail
+	}
+	return msg
+}
+
+// render returns the page in the format the client of the technology
+// displays: JSON for npm and composer, which print its error, a PEP 503
+// style HTML page for pip and plain text for maven and the go command, which
+// print the first lines of the body. Other clients get JSON when they
+// accept it.
+func (b *blockPage) render(accept string) (string, []byte) {
+	switch {
+	case b.tech == model.Pypi:
+		var buf bytes.Buffer
+		fmt.Fprintf(&buf, "<!DOCTYPE html>\n<html>\n  <head><title>403 Forbidden</title></head>\n  <body>\n    <h1>%v</h1>\n", html.EscapeString(b.Error))
+		for _, c := range b.Checks {
+			fmt.Fprintf(&buf, "    <p>%v: %v %v</p>\n", html.EscapeString(c.Policy), html.EscapeString(c.Result), html.EscapeString(c.Details))
+		}
+		fmt.Fprintf(&buf, "    <p>reference: %v</p>\n  </body>\n</html>\n", b.Reference)
+		return "text/html; charset=utf-8", buf.Bytes()
+	case b.tech == model.NPM, b.tech == model.Composer,
+		b.tech != model.Maven && b.tech != model.GoModule && strings.Contains(accept, "json"):
+		data, _ := json.MarshalIndent(b, "", "  ")
+		return "application/json", append(data, '\n')
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%v\n\nurl: %v\ndecision: %v\n", b.Error, b.URL, b.Decision)
+	for _, c := range b.Checks {
+		fmt.Fprintf(&buf, "check %v: %v %v\n", c.Policy, c.Result, c.Details)
+	}
+	fmt.Fprintf(&buf, "reference: %v\n", b.Reference)
+	return "text/plain; charset=utf-8", buf.Bytes()
+}
+
+// write sends the page as the response to a request
+func (b *blockPage) write(w http.ResponseWriter, r *http.Request) {
+	contentType, body := b.render(r.Header.Get("Accept"))
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusForbidden)
+	w.Write(body)
+}
+
+// replace swaps the body of rsp for the page
+func (b *blockPage) replace(rsp *http.Response) {
+	contentType, body := b.render(rsp.Request.Header.Get("Accept"))
+	rsp.StatusCode = http.StatusForbidden
+	rsp.Status = fmt.Sprintf("%d %s", http.StatusForbidden, http.StatusText(http.StatusForbidden))
+	rsp.Header = http.Header{}
+	rsp.Header.Set("Content-Type", contentType)
+	rsp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	rsp.Header.Set("Cache-Control", "no-store")
+	rsp.ContentLength = int64(len(body))
+	rsp.TransferEncoding = nil
+	rsp.Body = io.NopCloser(bytes.NewReader(body))
+}
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/invisirisk/svcs/model"
+
+	"inivisirisk.com/pse/session"
+)
+
+const (
+	// response bodies up to this size are held in memory, larger ones are
+	// spilled to a temporary file
+	holdInMemory = 4 << 20
+	// holdMax bounds the part of a response held before it is forwarded, the
+	// rest streams and its verdict is given once it has been sent
+	holdMax = 128 << 20
+)
+
+// holdResponse reports whether the response of act is held until decided.
+// Package downloads are, the response policy and the integrity check decide
+// on them. Everything else streams through the chains.
+func holdResponse(act *session.Activity, rsp *http.Response) bool {
+	if act == nil || act.Name == model.Web || act.Action != "get" {
+		return false
+	}
+	return rsp.Request.Method == http.MethodGet && rsp.StatusCode == http.StatusOK
+}
+
+// heldBody is a body read before it is forwarded, rest is the body read on
+// past the part held
+type heldBody struct {
+	io.Reader
+	file *os.File
+	rest io.Closer
+}
+
+func (h *heldBody) Close() error {
+	if h.rest != nil {
+		h.rest.Close()
+	}
+	if h.file == nil {
+		return nil
+	}
+	h.file.Close()
+	return os.Remove(h.file.Name())
+}
+
+// hold reads r up to limit bytes and returns a reader replaying it along with
+// its size. A body longer than limit is replayed and then read on from r, its
+// size is -1. The error ending r, such as a deny given by a verdict, is
+// returned instead when it is not io.EOF.
+func hold(r io.ReadCloser, limit int64) (*heldBody, int64, error) {
+	var buf bytes.Buffer
+	inMemory := int64(holdInMemory)
+	if limit < inMemory {
+		inMemory = limit
+	}
+	n, err := io.CopyN(&buf, r, inMemory+1)
+	if err == io.EOF {
+		r.Close()
+		return &heldBody{Reader: &buf}, n, nil
+	}
+	if err != nil {
+		r.Close()
+		return nil, n, err
+	}
+	if n > limit {
+		return &heldBody{Reader: io.MultiReader(&buf, r), rest: r}, -1, nil
+	}
+	f, err := os.CreateTemp("", "pse-held-")
+	if err != nil {
+		r.Close()
+		return nil, n, err
+	}
+	h := &heldBody{file: f}
+	n, err = io.CopyN(f, io.MultiReader(&buf, r), limit+1)
+	if err == io.EOF {
+		err = nil
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		r.Close()
+		h.Close()
+		return nil, n, err
+	}
+	if n > limit {
+		h.Reader, h.rest = io.MultiReader(f, r), r
+		return h, -1, nil
+	}
+	r.Close()
+	h.Reader = f
+	return h, n, nil
+}
@@ -0,0 +1,171 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	"github.com/invisirisk/svcs/model"
+
+	"inivisirisk.com/pse/config"
+	"inivisirisk.com/pse/integrity"
+	"inivisirisk.com/pse/metrics"
+	"inivisirisk.com/pse/session"
+	"inivisirisk.com/pse/technology/cargo"
+	"inivisirisk.com/pse/technology/gomodule"
+	"inivisirisk.com/pse/technology/maven"
+	"inivisirisk.com/pse/technology/npm"
+	"inivisirisk.com/pse/technology/nuget"
+	"inivisirisk.com/pse/technology/oci"
+	"inivisirisk.com/pse/technology/pypi"
+	"inivisirisk.com/pse/utils"
+)
+
+const (
+	// integrityStoreSize bounds the artifacts published digests are kept for
+	integrityStoreSize = 16384
+	// npmVersionsSize bounds the digests of packument versions kept, in bytes
+	npmVersionsSize = 32 << 20
+	// cargoVersionsSize bounds the cksums of index files kept, in bytes
+	cargoVersionsSize = 16 << 20
+)
+
+// newIntegrityStore returns the store of published digests, holding the
+// hashes of the configured go.sum files
+func newIntegrityStore(cfg *config.Config) *integrity.Store {
+	store := integrity.NewStore(integrityStoreSize)
+	for _, file := range cfg.GoSums {
+		digests, err := gomodule.ReadSums(file)
+		if err != nil {
+			baseLogger.Errorf("error reading go.sum %v: %v", file, err)
+			continue
+		}
+		for _, d := range digests {
+			store.Publish(d)
+		}
+	}
+	return store
+}
+
+// registries are the integrity data of the registries a proxy serves, those
+// keeping digests by package keep them for the proxy
+type registries struct {
+	maven, npm, pypi, nuget, cargo integrity.Registry
+	images                         *oci.Store
+	// npmVersions are the digests of the packuments read, the npm.Packument
+	// chain keeps them
+	npmVersions *integrity.Versions
+}
+
+func newRegistries(images *oci.Store) *registries {
+	npmVersions := integrity.NewVersions(npmVersionsSize)
+	return &registries{
+		maven:       maven.NewRegistry(),
+		npm:         npm.NewRegistry(npmVersions),
+		npmVersions: npmVersions,
+		pypi:        pypi.NewRegistry(),
+		nuget:       nuget.NewRegistry(),
+		cargo:       cargo.NewRegistry(integrity.NewVersions(cargoVersionsSize)),
+		images:      images,
+	}
+}
+
+// For returns the integrity data of the registry serving u, nil when it
+// publishes none. Container registries are recognised by the storage URLs in
+// images as well.
+func (rs *registries) For(u *url.URL, cfg *config.Config) integrity.Registry {
+	s := u.Host + u.Path
+	if path, match := matchPath(s, cfg.GoProxies); match {
+		// keys are read from the path the proxy serves, as handle passes it
+		return gomodule.NewRegistry(u.Path[:len(u.Path)-len(path)])
+	}
+	if _, match := matchPath(s, cfg.MavenRepos); match {
+		return rs.maven
+	}
+	if _, match := matchPath(s, cfg.NpmRepos); match {
+		return rs.npm
+	}
+	if _, match := matchPath(s, cfg.PypiRepos); match {
+		return rs.pypi
+	}
+	if _, match := matchPath(s, cfg.NugetRepos); match {
+		return rs.nuget
+	}
+	if _, match := matchPath(s, cfg.CargoRepos); match {
+		return rs.cargo
+	}
+	if _, match := matchPath(s, cfg.OCIRepos); match {
+		return oci.NewRegistry(rs.images)
+	}
+	if _, ok := rs.images.Redirected(u); ok {
+		return oci.NewRegistry(rs.images)
+	}
+	return nil
+}
+
+// download is the activity an artifact was downloaded by, checks about the
+// artifact are added to it under the lock of its session
+type download struct {
+	act  *session.Activity
+	sess *session.Session
+}
+
+// addResult adds the check of r to act, a mismatch raises it to a critical
+// alert. The lock of the session of act must be held.
+func addResult(act *session.Activity, r *integrity.Result) {
+	act.Checks = append(act.Checks, r.Check())
+	if !r.OK {
+		act.AlertLevel = model.AlertCritical
+		if act.Decision != model.Deny {
+			act.Decision = model.Alert
+		}
+	}
+}
+
+// verifyIntegrity records the digests published in rsp and compares the
+// download with the digests published for it. The results are added to the
+// activity of the download as checks, a digest published after it, such as a
+// maven .sha1 file, checks the activity of the artifact. It returns the
+// status of the download, "" when nothing was published for it.
+func verifyIntegrity(ctx context.Context, store *integrity.Store, reg integrity.Registry, rsp *http.Response, sums integrity.Sums, published []integrity.Digest) string {
+	// the sums of a HEAD response are those of an empty body
+	if reg == nil || rsp.StatusCode != http.StatusOK || rsp.Request.Method == http.MethodHead {
+		return ""
+	}
+	act, ok := ctx.Value(utils.ActCtxKey).(*session.Activity)
+	if !ok {
+		return ""
+	}
+	sess, _ := ctx.Value(utils.SessionCtxKey).(*session.Session)
+	var results []*integrity.Result
+	// digests of an artifact downloaded earlier, maven checksum files
+	for _, d := range published {
+		r := store.Publish(d)
+		if r == nil {
+			continue
+		}
+		metrics.Integrity.WithLabelValues(r.Status()).Inc()
+		if dl, ok := r.Download.(*download); ok && dl.act != act {
+			if dl.sess.Update(func() { addResult(dl.act, r) }) {
+				continue
+			}
+			// the session of the artifact was reported, the check is also
+			// added to the request publishing the digest
+		}
+		results = append(results, r)
+	}
+	status := ""
+	if key := reg.Key(rsp.Request.URL); key != "" && sums.SHA256 != "" {
+		if r := store.Verify(key, sums, &download{act: act, sess: sess}); r != nil {
+			metrics.Integrity.WithLabelValues(r.Status()).Inc()
+			results = append(results, r)
+			status = r.Status()
+		}
+	}
+	sess.Update(func() {
+		for _, r := range results {
+			addResult(act, r)
+		}
+	})
+	return status
+}
@@ -1,20 +1,65 @@
 package proxy
 
-import "net"
+import (
+	"net"
+	"sync"
+)
 
+// AppListner hands the connections hijacked from CONNECT requests to the
+// intercepting TLS server
 type AppListner struct {
-	c chan net.Conn
+	c    chan net.Conn
+	done chan struct{}
+	once sync.Once
+}
+
+func newAppListener() *AppListner {
+	return &AppListner{
+		c:    make(chan net.Conn, 100),
+		done: make(chan struct{}),
+	}
+}
+
+// push queues conn for Accept, it is closed instead once the listener is
+func (l *AppListner) push(conn net.Conn) {
+	select {
+	case <-l.done:
+		conn.Close()
+		return
+	default:
+	}
+	select {
+	case l.c <- conn:
+	case <-l.done:
+		conn.Close()
+	}
 }
 
 func (l *AppListner) Accept() (net.Conn, error) {
-	c := <-l.c
-	return c, nil
+	select {
+	case c := <-l.c:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
 }
 
 func (l *AppListner) Addr() net.Addr {
 	return nil
 }
 
+// Close stops Accept, connections still queued are closed
 func (l *AppListner) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		for {
+			select {
+			case c := <-l.c:
+				c.Close()
+			default:
+				return
+			}
+		}
+	})
 	return nil
 }
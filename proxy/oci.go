@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+
+	"inivisirisk.com/pse/session"
+	"inivisirisk.com/pse/technology/oci"
+	"inivisirisk.com/pse/utils"
+)
+
+// ociMetadata resolves the image of a manifest response to the digest served
+// and records it with the digests the manifest references. The activity then
+// names the digest before the response is decided, it is updated under the
+// lock of the session it was added to. Blob redirects are recorded for the
+// download from storage that follows. It returns the metadata of the manifest
+// read, nil for other responses.
+func ociMetadata(ctx context.Context, images *oci.Store, m *oci.Manifest) interface{} {
+	act, ok := ctx.Value(utils.ActCtxKey).(*session.Activity)
+	if !ok || act.Name != oci.OCI {
+		return nil
+	}
+	iact, ok := act.Activity.(session.ImageActivity)
+	if !ok {
+		return nil
+	}
+	rsp := m.Response
+	img := oci.Image{Host: iact.Repo, Name: iact.Package, Tag: iact.Tag, Digest: iact.Digest}
+	if iact.Kind == oci.KindBlob {
+		if rsp.StatusCode >= http.StatusMultipleChoices && rsp.StatusCode < http.StatusBadRequest {
+			if loc, err := rsp.Location(); err == nil {
+				images.Redirect(loc, img)
+			}
+		}
+		return nil
+	}
+	digest := m.Digest()
+	if digest == "" {
+		return nil
+	}
+	// a digest requested is verified against the body as an integrity check
+	if img.Digest == "" {
+		img.Digest = digest
+	}
+	var refs []string
+	if m.Metadata != nil {
+		refs = m.Metadata.Refs()
+	}
+	images.Put(img, refs)
+	sess, _ := ctx.Value(utils.SessionCtxKey).(*session.Session)
+	sess.Update(func() {
+		act.Activity = img.Activity(iact.Kind)
+	})
+	if m.Metadata == nil {
+		return nil
+	}
+	return m.Metadata
+}
@@ -0,0 +1,41 @@
+package proxy
+
+import (
+	"context"
+
+	"github.com/invisirisk/svcs/model"
+
+	"inivisirisk.com/pse/session"
+	"inivisirisk.com/pse/technology/npm"
+	"inivisirisk.com/pse/utils"
+)
+
+const (
+	// packumentStoreSize bounds the metadata of npm packuments kept, in bytes
+	packumentStoreSize = 32 << 20
+)
+
+// npmMetadata records the versions listed in a packument response and returns
+// the metadata of the version the activity resolves or downloads, nil when
+// no packument told about it
+func npmMetadata(ctx context.Context, store *npm.Store, p *npm.Packument) interface{} {
+	act, ok := ctx.Value(utils.ActCtxKey).(*session.Activity)
+	if !ok || act.Name != model.NPM {
+		return nil
+	}
+	pkg, ok := act.Activity.(model.PackageActivity)
+	if !ok {
+		return nil
+	}
+	if act.Action == "metadata" {
+		store.Put(pkg.Package, p.Versions)
+		if p.Resolved == nil {
+			return nil
+		}
+		return p.Resolved
+	}
+	if md, ok := store.Get(pkg.Package, pkg.Version); ok {
+		return &md
+	}
+	return nil
+}
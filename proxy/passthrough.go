@@ -0,0 +1,199 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/invisirisk/clog"
+	"github.com/invisirisk/svcs/model"
+
+	"inivisirisk.com/pse/config"
+	"inivisirisk.com/pse/metrics"
+	"inivisirisk.com/pse/policy"
+	"inivisirisk.com/pse/session"
+	"inivisirisk.com/pse/upstream"
+)
+
+const (
+	helloTimeout = 5 * time.Second
+	dialTimeout  = 30 * time.Second
+)
+
+var (
+	errHelloRead = errors.New("client hello read")
+)
+
+// matchHost reports whether host is one of hosts. Entries starting with "."
+// or "*." match every subdomain of the entry.
+func matchHost(host string, hosts []string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, h := range hosts {
+		h = strings.ToLower(h)
+		switch {
+		case strings.HasPrefix(h, "*."):
+			if strings.HasSuffix(host, h[1:]) {
+				return true
+			}
+		case strings.HasPrefix(h, "."):
+			if strings.HasSuffix(host, h) {
+				return true
+			}
+		case host == h:
+			return true
+		}
+	}
+	return false
+}
+
+// passThrough splices the CONNECT tunnel straight to the upstream host when
+// the host is configured as pass-through or, with PassThroughPolicy set, the
+// policy marks it as bypass. The client keeps talking TLS to the real server,
+// so certificate pinning and client certificates keep working. Configured
+// hosts are trusted and not evaluated. It reports whether conn was handled.
+func (p *Proxy) passThrough(conn net.Conn, bufrw *bufio.ReadWriter, r *http.Request) bool {
+	cfg := config.Cfg()
+	ctx, cl := clog.WithCtx(r.Context(), "pass-through")
+	tunnel := session.TunnelActivity{
+		WebActivity: model.WebActivity{
+			URL: "https://" + r.Host,
+		},
+	}
+	act := &session.Activity{
+		ActivityHdr: model.ActivityHdr{
+			Name:   model.Web,
+			Action: r.Method,
+			Host:   r.Host,
+		},
+		Activity: tunnel,
+	}
+	if matchHost(r.URL.Hostname(), cfg.PassThroughHosts) {
+		BuildActivity(act, policy.DefaultDecision, false)
+	} else {
+		if !cfg.PassThroughPolicy {
+			return false
+		}
+		dec, bypass, err := p.handler.p.ConnectDecision(ctx, act, r)
+		if err != nil {
+			cl.Errorf("connect decision error %v", err)
+			return false
+		}
+		if !bypass {
+			return false
+		}
+		BuildActivity(act, dec, false)
+	}
+	// the tunnel is recorded before it is spliced, a session ending meanwhile
+	// reports it with what is known so far
+	sess := p.handler.findSession(r)
+	if sess != nil {
+		sess.Add(act)
+	}
+
+	if act.Decision == model.Deny {
+		cl.Infof("pass-through to %v denied", r.Host)
+		bufrw.WriteString("HTTP/1.1 403 Forbidden\r\n\r\n")
+		bufrw.Flush()
+		conn.Close()
+		return true
+	}
+
+	dialCtx, cancel := context.WithTimeout(ctx, dialTimeout)
+	upstreamConn, err := upstream.Get().DialContext(dialCtx, "tcp", r.Host)
+	cancel()
+	if err != nil {
+		cl.Errorf("error connecting to %v: %v", r.Host, err)
+		bufrw.WriteString("HTTP/1.1 502 Bad Gateway\r\n\r\n")
+		bufrw.Flush()
+		conn.Close()
+		return true
+	}
+	bufrw.WriteString("HTTP/1.1 200 OK\r\n\r\n")
+	bufrw.Flush()
+
+	start := time.Now()
+	conn.SetReadDeadline(start.Add(helloTimeout))
+	sni, client := peekServerName(bufrw.Reader)
+	conn.SetReadDeadline(time.Time{})
+	tunnel.SNI = sni
+	sess.Update(func() {
+		if sni != "" {
+			act.Host = sni
+		}
+		act.Activity = tunnel
+	})
+	cl.Infof("pass-through to %v sni %q", r.Host, sni)
+
+	sent, received := splice(conn, client, upstreamConn)
+	duration := time.Since(start)
+	cl.Infof("pass-through to %v done, %v bytes sent, %v bytes received in %v", r.Host, sent, received, duration)
+	metrics.Bytes.WithLabelValues("upload").Add(float64(sent))
+	metrics.Bytes.WithLabelValues("download").Add(float64(received))
+	tunnel.BytesSent = sent
+	tunnel.BytesReceived = received
+	tunnel.DurationMs = duration.Milliseconds()
+	if !sess.Update(func() { act.Activity = tunnel }) {
+		cl.Infof("pass-through to %v ended after its session was reported", r.Host)
+	}
+	return true
+}
+
+// peekServerName reads the TLS ClientHello from r without answering it. The
+// returned reader replays everything consumed, the server name is empty for
+// tunnels not carrying TLS.
+func peekServerName(r io.Reader) (string, io.Reader) {
+	var buf bytes.Buffer
+	var sni string
+	tls.Server(helloConn{r: io.TeeReader(r, &buf)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			sni = hello.ServerName
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	return sni, io.MultiReader(&buf, r)
+}
+
+// helloConn feeds the ClientHello to a TLS server that must not write back
+type helloConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c helloConn) Read(p []byte) (int, error)         { return c.r.Read(p) }
+func (c helloConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c helloConn) Close() error                       { return nil }
+func (c helloConn) SetDeadline(t time.Time) error      { return nil }
+func (c helloConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c helloConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// splice copies between the client and upstream until either side closes
+// and returns the bytes sent upstream and received from it.
+func splice(client net.Conn, clientR io.Reader, upstream net.Conn) (sent, received int64) {
+	var once sync.Once
+	closeBoth := func() {
+		client.Close()
+		upstream.Close()
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		sent, _ = io.Copy(upstream, clientR)
+		once.Do(closeBoth)
+	}()
+	go func() {
+		defer wg.Done()
+		received, _ = io.Copy(client, upstream)
+		once.Do(closeBoth)
+	}()
+	wg.Wait()
+	return sent, received
+}
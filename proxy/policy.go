@@ -2,26 +2,31 @@ package proxy
 
 import (
 	"context"
-	"io"
+	"errors"
 	"net"
 	"net/http"
 	"os"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/invisirisk/clog"
 	"github.com/invisirisk/svcs/model"
 
+	"inivisirisk.com/pse/ca"
 	"inivisirisk.com/pse/config"
+	"inivisirisk.com/pse/metrics"
 	"inivisirisk.com/pse/policy"
 	"inivisirisk.com/pse/session"
 	"inivisirisk.com/pse/technology/alpine"
+	"inivisirisk.com/pse/technology/cargo"
 	"inivisirisk.com/pse/technology/composer"
 	"inivisirisk.com/pse/technology/git"
 	"inivisirisk.com/pse/technology/gomodule"
 	"inivisirisk.com/pse/technology/maven"
 	"inivisirisk.com/pse/technology/npm"
 	"inivisirisk.com/pse/technology/nuget"
+	"inivisirisk.com/pse/technology/oci"
 	"inivisirisk.com/pse/technology/pypi"
 	"inivisirisk.com/pse/technology/ruby"
 	"inivisirisk.com/pse/utils"
@@ -30,15 +35,36 @@ import (
 type PolicyHandler struct {
 	next http.Handler
 	p    *policy.Policy
+	ca   *ca.CA
+	// versions of the Composer dist URLs listed in metadata read
+	dists *composer.Store
+	// refs advertised by git repositories
+	refs *git.Store
+	// images read from container registries and their blob redirects
+	images *oci.Store
+	// set once the policy is loaded and every listener is bound
+	ready atomic.Bool
 }
 
 const (
 	self = "pse.invisirisk.com"
+	// composerStoreSize bounds the Composer dist URLs versions are kept for
+	composerStoreSize = 65536
+	// gitStoreSize bounds the git repositories advertised refs are kept for
+	gitStoreSize = 1024
+	// ociStoreSize bounds the image tags, digests and blob redirects kept
+	ociStoreSize = 16384
 )
 
+func init() {
+	metrics.Sessions(sessions.Len)
+}
+
 var (
 	sessions   = session.NewSessions()
 	baseLogger = clog.NewCLog("base")
+
+	errResponseDenied = errors.New("response denied by policy")
 )
 
 func (m *PolicyHandler) remoteIp(r *http.Request) string {
@@ -49,13 +75,13 @@ func (m *PolicyHandler) remoteIp(r *http.Request) string {
 
 func (m *PolicyHandler) caCert(w http.ResponseWriter, r *http.Request) {
 	cl := clog.FromCtx(r.Context())
-	f, err := os.Open("/tmp/ca/invisirisk.com/ca/invisirisk.com.crt")
-	if err != nil {
+	if m.ca == nil {
 		cl.Errorf("CA certificate not available")
 		w.WriteHeader(404)
 		return
 	}
-	io.Copy(w, f)
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Write(m.ca.PEM())
 }
 
 func (m *PolicyHandler) PseEndpoint(w http.ResponseWriter, r *http.Request) {
@@ -67,10 +93,34 @@ func (m *PolicyHandler) PseEndpoint(w http.ResponseWriter, r *http.Request) {
 		sessions.End(w, r)
 	case "/ca":
 		m.caCert(w, r)
+	case "/healthz":
+		w.Write([]byte("ok"))
+	case "/readyz":
+		if !m.ready.Load() {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	case "/metrics":
+		metrics.Handler().ServeHTTP(w, r)
 	}
 
 }
 
+// ControlEndpoint serves the PSE endpoints on the control listener. Requests
+// arriving over a Unix socket carry no client address, the build host is then
+// taken from the Forwarded header. The header is ignored on TCP listeners,
+// where any client reaching the port could name another build host.
+func (m *PolicyHandler) ControlEndpoint(w http.ResponseWriter, r *http.Request) {
+	if local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok && local.Network() == "unix" {
+		if rip := forwardedFor(r); rip != "" {
+			r.RemoteAddr = net.JoinHostPort(rip, "0")
+		}
+	}
+	r.Header.Del("Forwarded")
+	m.PseEndpoint(w, r)
+}
+
 func matchPath(path string, paths []string) (string, bool) {
 	for _, p := range paths {
 		if strings.Index(path, p) == 0 {
@@ -80,13 +130,14 @@ func matchPath(path string, paths []string) (string, bool) {
 	return "", false
 }
 
-func (m *PolicyHandler) handle(s string, cfg *config.Config, r *http.Request, sess *session.Session) *session.Activity {
-	if strings.HasPrefix(r.UserAgent(), "Composer") {
-		return composer.Handle(m.p, r, sess)
+func (m *PolicyHandler) handle(s string, cfg *config.Config, r *http.Request) *session.Activity {
+	path, match := matchPath(s, cfg.ComposerRepos)
+	if match {
+		return composer.Handle(m.p, m.dists, path, r)
 	}
-	path, match := matchPath(s, cfg.GitRepos)
+	path, match = matchPath(s, cfg.GitRepos)
 	if match {
-		return git.Handle(m.p, path, r)
+		return git.Handle(m.p, m.refs, path, r)
 	}
 	path, match = matchPath(s, cfg.GoProxies)
 	if match {
@@ -116,30 +167,52 @@ func (m *PolicyHandler) handle(s string, cfg *config.Config, r *http.Request, se
 	if match {
 		return nuget.Handle(m.p, path, r)
 	}
+	path, match = matchPath(s, cfg.CargoRepos)
+	if match {
+		return cargo.Handle(m.p, path, r)
+	}
+	path, match = matchPath(s, cfg.OCIRepos)
+	if match {
+		return oci.Handle(m.p, m.images, path, r)
+	}
+	// registries redirect blob downloads to storage hosts of their own
+	if act := oci.Redirected(m.images, r); act != nil {
+		return act
+	}
 	return nil
 }
 
-
-func (m *PolicyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
+// findSession returns the build session of the client sending r, or the
+// first session when a global session is enabled
+func (m *PolicyHandler) findSession(r *http.Request) *session.Session {
 	var sess *session.Session
 	var ok bool
 	if os.Getenv("GLOBAL_SESSION") == "true" {
 		baseLogger.Infof("Global session enabled")
-		sess,ok = sessions.FindFirst()
-	}else{
+		sess, ok = sessions.FindFirst()
+	} else {
 		sess, ok = sessions.Find(m.remoteIp(r))
 	}
 	if !ok {
 		baseLogger.Errorf("request with session from %v", r.RemoteAddr)
 	}
+	return sess
+}
+
+func (m *PolicyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	sess := m.findSession(r)
 
 	cl := baseLogger
 	if sess != nil {
 		cl = sess.Log()
 	}
 
-	r.URL.Scheme = "https"
+	// intercepted TLS traffic arrives in origin form, plain HTTP proxy
+	// requests keep their http scheme
+	if r.TLS != nil || r.URL.Scheme == "" {
+		r.URL.Scheme = "https"
+	}
 	if r.URL.Host == "" {
 		r.URL.Host = r.Host
 	}
@@ -154,7 +227,7 @@ func (m *PolicyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	cl.Infof("url %s Method %s", u, r.Method)
 
 	cfg := config.Cfg()
-	act := m.handle(r.URL.Host+r.URL.Path, cfg, r, sess)
+	act := m.handle(r.URL.Host+r.URL.Path, cfg, r)
 	if act == nil || act == session.NilActivity {
 		act = &session.Activity{
 			ActivityHdr: model.ActivityHdr{
@@ -167,24 +240,32 @@ func (m *PolicyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 	act.Host= r.Host
+	metrics.Requests.WithLabelValues(string(act.Name)).Inc()
+	if r.ContentLength > 0 {
+		metrics.Bytes.WithLabelValues("upload").Add(float64(r.ContentLength))
+	}
 	ctx = context.WithValue(ctx, utils.ActCtxKey, act)
+	ctx = context.WithValue(ctx, utils.SessionCtxKey, sess)
 	r = r.WithContext(ctx)
 
 	if act != session.NilActivity {
+		// on errors dec is the configured failure decision
 		dec, err := m.p.GetRequestDecision(ctx, act, r)
 		if err != nil {
 			cl.Errorf("decision error %v", err)
-			act.Decision = model.Alert
 		}
 		cl.Infof("decision %v", dec)
 		
 		BuildActivity(act, dec,false)
+		metrics.Decisions.WithLabelValues(string(act.Decision)).Inc()
 
 		if sess != nil {
 			sess.Add(act)
 		}
 		if act.Decision == model.Deny {
-			w.WriteHeader(http.StatusForbidden)
+			page := newBlockPage(act, u, dec.Detail)
+			cl.Infof("request denied, reference %v", page.Reference)
+			page.write(w, r)
 			return
 		}
 	}
@@ -204,6 +285,11 @@ func getOpaResponseInput(act *session.Activity, rsp_data *utils.ResponseData) po
 				ContentLength: utils.StrToFloat(rsp.Header.Get("Content-Length")),
 				FileSize: rsp_data.FileSizeByte,
 				Checksum:	rsp_data.Checksum,
+				SHA1:	rsp_data.SHA1,
+				SHA256:	rsp_data.SHA256,
+				SHA512:	rsp_data.SHA512,
+				Integrity:	rsp_data.Integrity,
+				Metadata:	rsp_data.Metadata,
 				Request: policy.RequestMetadata{
 					Method:  rsp.Request.Method,
 					URL:     rsp.Request.URL.String(),
@@ -222,18 +308,38 @@ func  ModifyResponseBasedOnPolicy( p *policy.Policy, ctx context.Context, rsp_da
 		cl.Errorf("invalid activity type %T", v)
 	}
 	policy_input := getOpaResponseInput(act,rsp_data)
-	// generate OPA decisions for response
-	response_decision,_:=p.GetResponseDecision(ctx, act, rsp_data.Response.Body, &policy_input)
-	// bind the response decision with activity log
-	BuildActivity(act, response_decision,true)
+	// generate OPA decisions for response, the body has already been scanned
+	// for secrets by the response reader chain
+	response_decision, err := p.GetResponseDecision(ctx, act, nil, &policy_input)
+	if err != nil {
+		cl.Errorf("response decision error %v", err)
+	}
+	// bind the response decision with activity log, the activity was added to
+	// the session which may be reporting it
+	sess, _ := ctx.Value(utils.SessionCtxKey).(*session.Session)
+	sess.Update(func() {
+		BuildActivity(act, response_decision, true)
+	})
 
-	// change status code based if deny
 	if act.Decision == model.Deny {
-		rsp_data.Response.StatusCode = http.StatusForbidden
+		return &deniedError{detail: response_decision.Detail}
 	}
 	return nil
 }
 
+// deniedError is errResponseDenied carrying the detail of the decision
+type deniedError struct {
+	detail string
+}
+
+func (e *deniedError) Error() string {
+	return errResponseDenied.Error()
+}
+
+func (e *deniedError) Is(target error) bool {
+	return target == errResponseDenied
+}
+
 func BuildActivity(act *model.Activity,dec policy.Decision, is_response_cycle bool) error {
 	// binds the decision and checks to activity handler based on the OPA decision from request and response cycle
 
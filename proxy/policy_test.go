@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"net/http"
 	"os"
 	"testing"
 
@@ -26,7 +27,11 @@ func TestPolicy(t *testing.T) {
 	path, match := matchPath("proxy.golang.org/google.golang.org/protobuf/@v/list", cfg.GoProxies)
 	assert.True(t, match)
 	m := PolicyHandler{}
-	act := gomodule.Handle(m.p, path, nil)
+	r, _ := http.NewRequest("GET", "https://proxy.golang.org/google.golang.org/protobuf/@v/list", nil)
+	act := gomodule.Handle(m.p, path, r)
+	assert.Equal(t, "list", act.Action)
+
+	act = gomodule.Handle(m.p, "/google.golang.org/protobuf/@v/v1.30.0.ziphash", r)
 	assert.Equal(t, act, session.NilActivity)
 }
 
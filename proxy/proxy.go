@@ -1,20 +1,35 @@
 package proxy
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"net/http/httputil"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/invisirisk/clog"
+	"github.com/invisirisk/svcs/model"
 	"inivisirisk.com/pse/ca"
+	"inivisirisk.com/pse/config"
+	"inivisirisk.com/pse/integrity"
+	"inivisirisk.com/pse/metrics"
 	"inivisirisk.com/pse/policy"
+	"inivisirisk.com/pse/session"
+	"inivisirisk.com/pse/technology/composer"
+	"inivisirisk.com/pse/technology/git"
+	"inivisirisk.com/pse/technology/gomodule"
+	"inivisirisk.com/pse/technology/npm"
+	"inivisirisk.com/pse/technology/oci"
+	"inivisirisk.com/pse/upstream"
 	"inivisirisk.com/pse/utils"
 )
 
@@ -22,15 +37,26 @@ import (
 type Proxy struct {
 	rootCa   *ca.CA
 	appProxy *http.Server
+	handler  *PolicyHandler
 	l        *AppListner
+
+	proxyServer   *http.Server
+	controlServer *http.Server
+	// CONNECT requests still being handled, pass-through tunnels included
+	tunnels sync.WaitGroup
 }
 
+const (
+	// time left to post open sessions once draining is over
+	flushTimeout = 30 * time.Second
+)
+
 var (
 	cl = clog.NewCLog("proxy")
 )
 
 type proxyConn struct {
-	*net.TCPConn
+	net.Conn
 
 	remoteAddr net.Addr
 }
@@ -40,65 +66,107 @@ func (c *proxyConn) RemoteAddr() net.Addr {
 }
 
 func (p *Proxy) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
-	var rip string
 	if r.Method == "CONNECT" {
 
 		cl.Infof("CONNECT request for " + r.URL.String() + " from " + r.RemoteAddr)
+		// counted before the hijack, Shutdown stops tracking the connection
+		// after it
+		p.tunnels.Add(1)
+		defer p.tunnels.Done()
 		hj, ok := rw.(http.Hijacker)
 		if !ok {
 			cl.Infof("webserver doesn't support hijacking")
 			http.Error(rw, "webserver doesn't support hijacking", http.StatusInternalServerError)
 			return
 		}
-		fwd := r.Header.Get("Forwarded")
-		if fwd != "" {
-			cl.Infof("fowarded for %v", fwd)
-			parts := strings.Split(fwd, "=")
-			if len(parts) >= 2 {
-				if parts[0] == "for" {
-					rip = parts[1]
-					cl.Infof("setting rip to %v", rip)
-				}
-			}
-		}
+		rip := forwardedFor(r)
 
 		conn, bufrw, err := hj.Hijack()
 		if err != nil {
 			http.Error(rw, "webserver hijack returned error", http.StatusInternalServerError)
+			return
 		}
-		bufrw.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
-		bufrw.Flush()
-		if rip != "" {
-			addr := conn.RemoteAddr().(*net.TCPAddr)
-			addr.IP = net.ParseIP(rip)
-			pc := &proxyConn{
-				TCPConn:    conn.(*net.TCPConn),
+		if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && rip != "" {
+			addr = &net.TCPAddr{IP: net.ParseIP(rip), Port: addr.Port, Zone: addr.Zone}
+			conn = &proxyConn{
+				Conn:       conn,
 				remoteAddr: addr,
 			}
-			conn = pc
+			r.RemoteAddr = addr.String()
+		}
+		if p.passThrough(conn, bufrw, r) {
+			return
 		}
+		bufrw.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+		bufrw.Flush()
+
+		p.l.push(conn)
+		return
+	}
 
-		p.l.c <- conn
+	// plain HTTP requests from clients using http_proxy arrive in absolute form
+	if !r.URL.IsAbs() || r.URL.Scheme != "http" {
+		cl.Infof("not a proxy request %v from %v", r.URL, r.RemoteAddr)
+		http.Error(rw, "not a proxy request", http.StatusBadRequest)
+		return
+	}
+	cl.Infof("HTTP request for " + r.URL.String() + " from " + r.RemoteAddr)
+	// sessions are found by the client address, only trusted proxies name
+	// another client
+	host, port, _ := net.SplitHostPort(r.RemoteAddr)
+	if rip := forwardedFor(r); rip != "" && config.Cfg().Trusted(net.ParseIP(host)) {
+		r.RemoteAddr = net.JoinHostPort(rip, port)
 	}
-	// handle direct requests
+	r.Header.Del("Forwarded")
+	p.handler.ServeHTTP(rw, r)
+}
 
+// forwardedFor returns the client address from a "Forwarded: for=" header
+func forwardedFor(r *http.Request) string {
+	fwd := r.Header.Get("Forwarded")
+	if fwd == "" {
+		return ""
+	}
+	cl.Infof("fowarded for %v", fwd)
+	parts := strings.Split(fwd, "=")
+	if len(parts) >= 2 {
+		if parts[0] == "for" {
+			cl.Infof("setting rip to %v", parts[1])
+			return parts[1]
+		}
+	}
+	return ""
 }
 
 func NewProxy(policyFile string) *Proxy {
 	// initialize policy
 	rootCa := ca.NewCA()
 
-	p, err := policy.NewPolicy(policyFile)
+	var p *policy.Policy
+	var err error
+	if bundle := config.Cfg().PolicyBundle; bundle.Path != "" {
+		p, err = policy.NewLocalPolicy(bundle.Path, bundle.Watch)
+	} else {
+		p, err = policy.NewPolicy(policyFile)
+	}
 	if err != nil {
 		log.Panic(err)
 	}
+	return newProxy(rootCa, p)
+}
 
-	appList := &AppListner{
-		c: make(chan net.Conn, 100),
-	}
+func newProxy(rootCa *ca.CA, p *policy.Policy) *Proxy {
+	appList := newAppListener()
+	digests := newIntegrityStore(config.Cfg())
+	packuments := npm.NewStore(packumentStoreSize)
+	dists := composer.NewStore(composerStoreSize)
+	refs := git.NewStore(gitStoreSize)
+	images := oci.NewStore(ociStoreSize)
+	registries := newRegistries(images)
 
 	rp := &httputil.ReverseProxy{
 		Transport: &http.Transport{
+			Proxy:           upstream.Get().Proxy,
 			TLSClientConfig: createDynamicTLSConfig(rootCa),
 			DialContext: (&net.Dialer{
 				Timeout:   30 * time.Second,
@@ -107,7 +175,9 @@ func NewProxy(policyFile string) *Proxy {
 			TLSHandshakeTimeout: 10 * time.Second,
 		},
 		Director: func(r *http.Request) {
-			r.URL.Scheme = "https"
+			if r.URL.Scheme == "" {
+				r.URL.Scheme = "https"
+			}
 			r.URL.Host = r.Host
 		},
 		ModifyResponse: func(rsp *http.Response) error {
@@ -126,21 +196,86 @@ func NewProxy(policyFile string) *Proxy {
 			check_sum := &utils.Checksum{Direction: "Download"}
 			file_size := &utils.FileSize{Direction: "Download"}
 			secret,_ := utils.NewSecrets(policy.GetSecretsFilePath(),"response")
-			if rsp.Body != nil {
-				top := utils.ReaderChain(ctx, rsp.Body, mime_chain, check_sum, file_size, &utils.PHPCheck{Response: rsp},secret)
-				rsp.Body = top
+			registry := registries.For(rsp.Request.URL, config.Cfg())
+			published := &integrity.Chain{Registry: registry, Response: rsp}
+			zip_hash := &gomodule.ZipHash{}
+			packument := &npm.Packument{Response: rsp, Digests: registries.npmVersions}
+			composer_metadata := &composer.Metadata{Response: rsp, Dists: dists}
+			advertisement := &git.Advertisement{Response: rsp, Refs: refs}
+			manifest := &oci.Manifest{Response: rsp}
+			decide := func(ctx context.Context) error {
+				metrics.Bytes.WithLabelValues("download").Add(float64(file_size.ByteSize))
+				rsp_data := utils.ResponseData{Response: rsp, Mime: mime_chain.Mime, Checksum: check_sum.Checksum, FileSizeByte: file_size.ByteSize}
+				rsp_data.SHA1, rsp_data.SHA256, rsp_data.SHA512 = check_sum.SHA1, check_sum.SHA256, check_sum.SHA512
+				sums := integrity.Sums{MD5: check_sum.Checksum, SHA1: check_sum.SHA1, SHA256: check_sum.SHA256, SHA512: check_sum.SHA512, H1: zip_hash.Hash}
+				rsp_data.Integrity = verifyIntegrity(ctx, digests, registry, rsp, sums, published.Digests)
+				rsp_data.Metadata = npmMetadata(ctx, packuments, packument)
+				if md := ociMetadata(ctx, images, manifest); md != nil {
+					rsp_data.Metadata = md
+				}
+				return ModifyResponseBasedOnPolicy(p, ctx, &rsp_data)
+			}
+			block := func(err error) {
+				act, ok := ctx.Value(utils.ActCtxKey).(*session.Activity)
+				if !ok {
+					act = &session.Activity{ActivityHdr: model.ActivityHdr{Decision: model.Deny}}
+				}
+				var denied *deniedError
+				detail := ""
+				if errors.As(err, &denied) {
+					detail = denied.detail
+				}
+				page := newBlockPage(act, rsp.Request.URL.String(), detail)
+				cl.Infof("response for %v denied, reference %v", rsp.Request.URL, page.Reference)
+				page.replace(rsp)
+			}
+			// without a body the decision is taken before the headers are sent
+			if rsp.Body == nil {
+				if err := decide(ctx); err != nil {
+					block(err)
+				}
+				return nil
+			}
+			body := utils.VerdictReaderChain(ctx, rsp.Body, decide, mime_chain, check_sum, file_size, &utils.PHPCheck{Response: rsp}, secret, published, zip_hash, packument, composer_metadata, advertisement, manifest)
+			act, _ := ctx.Value(utils.ActCtxKey).(*session.Activity)
+			if !holdResponse(act, rsp) {
+				// the body streams through the chains and the response decision
+				// is taken once it is fully read, a deny truncates the transfer
+				rsp.Body = body
+				return nil
+			}
+			// package downloads are read through the chains before anything is
+			// sent, a denied artifact never reaches the client and is replaced
+			// by a block page. Past holdMax the rest streams as other responses
+			// do, the integrity check is reported once it has been sent.
+			held, size, err := hold(body, holdMax)
+			if errors.Is(err, errResponseDenied) {
+				block(err)
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			rsp.Body = held
+			if size >= 0 && rsp.ContentLength < 0 {
+				rsp.ContentLength = size
+				rsp.Header.Set("Content-Length", strconv.FormatInt(size, 10))
+				rsp.TransferEncoding = nil
 			}
-			rsp_data := utils.ResponseData{Response: rsp, Mime: mime_chain.Mime, Checksum: check_sum.Checksum, FileSizeByte: file_size.ByteSize}
-			ModifyResponseBasedOnPolicy(p, ctx, &rsp_data)
 			return nil
 		},
 	}
 
+	handler := &PolicyHandler{
+		next:   rp,
+		p:      p,
+		ca:     rootCa,
+		dists:  dists,
+		refs:   refs,
+		images: images,
+	}
 	appProxy := &http.Server{
-		Handler: &PolicyHandler{
-			next: rp,
-			p:    p,
-		},
+		Handler: handler,
 		TLSConfig: &tls.Config{
 			GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
 				return rootCa.IssueCertificate(hello.ServerName)
@@ -156,6 +291,10 @@ func NewProxy(policyFile string) *Proxy {
 		rootCa:   rootCa,
 		l:        appList,
 		appProxy: appProxy,
+		handler:  handler,
+
+		proxyServer:   &http.Server{},
+		controlServer: &http.Server{},
 	}
 
 }
@@ -227,32 +366,114 @@ func loadCertificates(rootCa *ca.CA) *x509.CertPool {
 	return rootCAs
 }
 
-func (p *Proxy) Start() {
+// Start serves every enabled listener from the configuration and blocks
+// until one of them fails or Shutdown is called.
+func (p *Proxy) Start() error {
+	listeners := config.Cfg().Listeners
+	errs := make(chan error, 4)
+	serving := 0
+	serve := func(s *http.Server, l net.Listener) {
+		serving++
+		go func() { errs <- s.Serve(l) }()
+	}
+
+	// CONNECT tunnels hijacked by ServeHTTP
+	serve(p.appProxy, tls.NewListener(p.l, p.appProxy.TLSConfig))
 
-	// Listen on both IPv4 and IPv6 for TLS
-	tlist := tls.NewListener(p.l, p.appProxy.TLSConfig)
-	go func() {
-		if err := p.appProxy.Serve(tlist); err != nil {
-			log.Panic(err)
+	if !listeners.TLS.Disabled {
+		l, err := listeners.TLS.Listen()
+		if err != nil {
+			p.close()
+			return fmt.Errorf("TLS listen: %w", err)
 		}
-	}()
+		cl.Infof("direct TLS listening on %v", listeners.TLS)
+		serve(p.appProxy, tls.NewListener(l, p.appProxy.TLSConfig))
+	}
 
-	tlist2, err := tls.Listen("tcp4", "[::]:12345", p.appProxy.TLSConfig)
-	if err != nil {
-		log.Panic("TLS Listen: ", err)
+	if !listeners.Control.Disabled {
+		l, err := listeners.Control.Listen()
+		if err != nil {
+			p.close()
+			return fmt.Errorf("control listen: %w", err)
+		}
+		cl.Infof("control endpoint listening on %v", listeners.Control)
+		p.controlServer.Handler = http.HandlerFunc(p.handler.ControlEndpoint)
+		serve(p.controlServer, l)
 	}
-	go func() {
-		if err := p.appProxy.Serve(tlist2); err != nil {
-			log.Panic(err)
+
+	if !listeners.Proxy.Disabled {
+		listener, err := listeners.Proxy.Listen()
+		if err != nil {
+			p.close()
+			return fmt.Errorf("listen: %w", err)
 		}
-	}()
+		cl.Infof("proxy listening on %v", listeners.Proxy)
+		p.proxyServer.Handler = p
+		serve(p.proxyServer, listener)
+	}
+	p.handler.ready.Store(true)
+
+	// a server stopped by Shutdown returns ErrServerClosed, wait for the rest
+	// so Start only returns once nothing is accepting
+	var first error
+	for i := 0; i < serving; i++ {
+		err := <-errs
+		if errors.Is(err, http.ErrServerClosed) || errors.Is(err, net.ErrClosed) {
+			continue
+		}
+		if first == nil {
+			first = err
+			p.close()
+		}
+	}
+	return first
+}
 
-	// Listen on both IPv4 and IPv6 for HTTP
-	listener, err := net.Listen("tcp4", "[::]:3128")
-	if err != nil {
-		log.Panic("Listen: ", err)
+// close stops every listener without waiting for requests in flight
+func (p *Proxy) close() {
+	p.proxyServer.Close()
+	p.controlServer.Close()
+	p.l.Close()
+	p.appProxy.Close()
+}
+
+// Shutdown stops accepting connections and waits for requests and
+// pass-through tunnels in flight until ctx is done. Sessions still open are
+// then ended as aborted so their activities reach the portal, and the policy
+// engine is stopped.
+func (p *Proxy) Shutdown(ctx context.Context) error {
+	cl.Infof("shutting down")
+	p.handler.ready.Store(false)
+	var first error
+	keep := func(err error) {
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	keep(p.proxyServer.Shutdown(ctx))
+	keep(p.controlServer.Shutdown(ctx))
+	p.l.Close()
+	keep(p.appProxy.Shutdown(ctx))
+
+	drained := make(chan struct{})
+	go func() {
+		p.tunnels.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		keep(ctx.Err())
 	}
-	if err := http.Serve(listener, p); err != nil {
-		log.Panic("ListenAndServe: ", err)
+	if first != nil {
+		cl.Errorf("shutdown did not drain: %v", first)
+		p.close()
 	}
+
+	// the portal is posted to even when draining timed out
+	flushCtx, cancel := context.WithTimeout(context.Background(), flushTimeout)
+	defer cancel()
+	sessions.Abort(flushCtx)
+	p.handler.p.Stop(flushCtx)
+	return first
 }
@@ -1,17 +1,47 @@
 package proxy
 
 import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
 	"time"
 
+	"github.com/invisirisk/svcs/model"
 	"github.com/joho/godotenv"
+	"github.com/open-policy-agent/opa/sdk"
 	"github.com/stretchr/testify/require"
+	"inivisirisk.com/pse/ca"
+	"inivisirisk.com/pse/config"
+	"inivisirisk.com/pse/integrity"
+	"inivisirisk.com/pse/policy"
 	"inivisirisk.com/pse/server"
+	"inivisirisk.com/pse/session"
+	"inivisirisk.com/pse/technology/maven"
+	"inivisirisk.com/pse/technology/npm"
+	"inivisirisk.com/pse/technology/oci"
+	"inivisirisk.com/pse/utils"
 )
 
 var (
@@ -48,3 +78,1011 @@ func TestStart(t *testing.T) {
 	require.NoError(t, err)
 	log.Printf("response %v", resp.StatusCode)
 }
+
+// testDecider allows every request except to the deny hosts and marks the
+// bypass hosts as pass-through. Responses to URLs containing one of
+// denyResponse are denied.
+type testDecider struct {
+	deny, bypass []string
+	denyResponse []string
+}
+
+func (d testDecider) Decision(ctx context.Context, options sdk.DecisionOptions) (*sdk.DecisionResult, error) {
+	input := options.Input.(policy.PolicyInput)
+	host := input.Request.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	result := "allow"
+	if matchHost(host, d.deny) {
+		result = "deny"
+	}
+	if input.IsResponseReady {
+		for _, u := range d.denyResponse {
+			if strings.Contains(input.Response.Request.URL, u) {
+				return &sdk.DecisionResult{
+					Result: map[string]interface{}{
+						"final_decision": map[string]interface{}{
+							"result":        "deny",
+							"details":       "malware",
+							"policy_checks": []interface{}{map[string]interface{}{"policy": "malware-scan", "result": "deny", "details": "known malicious tarball"}},
+						},
+						"final_secret_decision": map[string]interface{}{"check": false, "result": "allow"},
+					},
+				}, nil
+			}
+		}
+	}
+	return &sdk.DecisionResult{
+		Result: map[string]interface{}{
+			"final_decision":        map[string]interface{}{"result": result},
+			"final_secret_decision": map[string]interface{}{"check": false, "result": "allow"},
+			"bypass":                matchHost(host, d.bypass),
+		},
+	}, nil
+}
+
+func (testDecider) Stop(ctx context.Context) {
+}
+
+func testProxy(t *testing.T, d policy.PolicyDecider) *Proxy {
+	t.Setenv("INVISIRISK_JWT_TOKEN", "test")
+	cfg := config.DefaultCA()
+	cfg.Dir = t.TempDir()
+	rootCa, err := ca.New(cfg)
+	require.NoError(t, err)
+	return newProxy(rootCa, policy.NewPolicyWithDecider(d))
+}
+
+// testSession starts a build session for the client ip
+func testSession(t *testing.T, ip string) *session.Session {
+	r := httptest.NewRequest("POST", "https://"+self+"/start", strings.NewReader("project=test"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	sess := session.NewSession(r)
+	sessions.Add(ip, sess)
+	return sess
+}
+
+func TestServeHTTPForwardsPlainHTTP(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("plain " + r.URL.Path))
+	}))
+	defer origin.Close()
+	p := testProxy(t, testDecider{})
+	sess := testSession(t, "192.0.2.1")
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", origin.URL+"/index.html", nil)
+	req.RemoteAddr = "192.0.2.1:40000"
+	p.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "plain /index.html", rec.Body.String())
+
+	acts := sess.Activities()
+	require.Len(t, acts, 1)
+	require.Equal(t, model.Web, acts[0].Name)
+	require.Equal(t, model.Allow, acts[0].Decision)
+	require.Equal(t, origin.URL+"/index.html", acts[0].Activity.(model.WebActivity).URL)
+}
+
+func TestServeHTTPForwardedTrusted(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("Forwarded")))
+	}))
+	defer origin.Close()
+	cfg := config.Cfg()
+	defer func(peers []string) { cfg.TrustedProxies = peers }(cfg.TrustedProxies)
+	cfg.TrustedProxies = []string{"192.0.2.40"}
+	p := testProxy(t, testDecider{})
+	victim := testSession(t, "192.0.2.41")
+	relayed := testSession(t, "192.0.2.42")
+
+	get := func(from string) {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", origin.URL+"/", nil)
+		req.RemoteAddr = from + ":40000"
+		req.Header.Set("Forwarded", "for=192.0.2.41")
+		p.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Empty(t, rec.Body.String())
+	}
+	// another build host cannot name the victim
+	get("192.0.2.42")
+	require.Empty(t, victim.Activities())
+	require.Len(t, relayed.Activities(), 1)
+
+	get("192.0.2.40")
+	require.Len(t, victim.Activities(), 1)
+}
+
+func TestServeHTTPRejectsOriginForm(t *testing.T) {
+	p := &Proxy{}
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/index.html", nil)
+	p.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestMatchHost(t *testing.T) {
+	hosts := []string{"artifacts.corp.example", ".mtls.example", "*.pinned.example"}
+	require.True(t, matchHost("artifacts.corp.example", hosts))
+	require.True(t, matchHost("Artifacts.Corp.Example.", hosts))
+	require.True(t, matchHost("a.b.mtls.example", hosts))
+	require.True(t, matchHost("repo.pinned.example", hosts))
+	require.False(t, matchHost("corp.example", hosts))
+	require.False(t, matchHost("pinned.example", hosts))
+	require.False(t, matchHost("xmtls.example", hosts))
+}
+
+func TestPeekServerName(t *testing.T) {
+	client, server := net.Pipe()
+	go func() {
+		tls.Client(client, &tls.Config{ServerName: "registry.corp.example"}).Handshake()
+	}()
+	sni, r := peekServerName(server)
+	require.Equal(t, "registry.corp.example", sni)
+
+	// the ClientHello is replayed to the upstream untouched
+	hello := make([]byte, 5)
+	_, err := io.ReadFull(r, hello)
+	require.NoError(t, err)
+	require.Equal(t, byte(0x16), hello[0])
+	client.Close()
+
+	sni, r = peekServerName(bytes.NewBufferString("SSH-2.0-OpenSSH\r\n"))
+	require.Empty(t, sni)
+	data, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, "SSH-2.0-OpenSSH\r\n", string(data))
+}
+
+func TestSplice(t *testing.T) {
+	client, clientEnd := net.Pipe()
+	upstream, upstreamEnd := net.Pipe()
+	go func() {
+		buf := make([]byte, 4)
+		io.ReadFull(upstreamEnd, buf)
+		upstreamEnd.Write([]byte("pong!"))
+		upstreamEnd.Close()
+	}()
+	go func() {
+		clientEnd.Write([]byte("ping"))
+		io.Copy(io.Discard, clientEnd)
+	}()
+	sent, received := splice(client, client, upstream)
+	require.Equal(t, int64(4), sent)
+	require.Equal(t, int64(5), received)
+}
+
+// passThroughClient sends requests to origin through a CONNECT tunnel of p,
+// trusting only the origin's own certificate
+func passThroughClient(t *testing.T, p *Proxy, origin *httptest.Server) *http.Transport {
+	go p.appProxy.Serve(tls.NewListener(p.l, p.appProxy.TLSConfig))
+	front := httptest.NewServer(p)
+	t.Cleanup(front.Close)
+	frontURL, _ := url.Parse(front.URL)
+	roots := x509.NewCertPool()
+	roots.AddCert(origin.Certificate())
+	tr := &http.Transport{
+		Proxy: http.ProxyURL(frontURL),
+		TLSClientConfig: &tls.Config{
+			RootCAs:    roots,
+			ServerName: "example.com",
+		},
+	}
+	t.Cleanup(tr.CloseIdleConnections)
+	return tr
+}
+
+func TestPassThrough(t *testing.T) {
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("pinned"))
+	}))
+	defer origin.Close()
+	cfg := config.Cfg()
+	defer func(hosts []string, enabled bool) {
+		cfg.PassThroughHosts, cfg.PassThroughPolicy = hosts, enabled
+	}(cfg.PassThroughHosts, cfg.PassThroughPolicy)
+
+	t.Run("configured", func(t *testing.T) {
+		cfg.PassThroughHosts, cfg.PassThroughPolicy = []string{"127.0.0.1"}, false
+		p := testProxy(t, testDecider{deny: []string{"127.0.0.1"}})
+		sess := testSession(t, "127.0.0.1")
+		tr := passThroughClient(t, p, origin)
+
+		// the origin certificate verifies, no leaf was issued by the proxy CA
+		rsp, err := tr.RoundTrip(httptest.NewRequest("GET", origin.URL+"/", nil))
+		require.NoError(t, err)
+		body, _ := io.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		require.Equal(t, "pinned", string(body))
+		require.Equal(t, origin.Certificate().Raw, rsp.TLS.PeerCertificates[0].Raw)
+		tr.CloseIdleConnections()
+
+		require.Eventually(t, func() bool { return len(sess.Activities()) == 1 }, 5*time.Second, 10*time.Millisecond)
+		act := sess.Activities()[0]
+		require.Equal(t, model.Web, act.Name)
+		require.Equal(t, model.Allow, act.Decision)
+		require.Equal(t, "example.com", act.Host)
+		tunnel := act.Activity.(session.TunnelActivity)
+		require.Equal(t, "example.com", tunnel.SNI)
+		require.Positive(t, tunnel.BytesSent)
+		require.Positive(t, tunnel.BytesReceived)
+	})
+
+	t.Run("policy deny", func(t *testing.T) {
+		cfg.PassThroughHosts, cfg.PassThroughPolicy = nil, true
+		p := testProxy(t, testDecider{deny: []string{"127.0.0.1"}, bypass: []string{"127.0.0.1"}})
+		sess := testSession(t, "127.0.0.1")
+		tr := passThroughClient(t, p, origin)
+
+		_, err := tr.RoundTrip(httptest.NewRequest("GET", origin.URL+"/", nil))
+		require.ErrorContains(t, err, "Forbidden")
+		require.Eventually(t, func() bool { return len(sess.Activities()) == 1 }, 5*time.Second, 10*time.Millisecond)
+		require.Equal(t, model.Deny, sess.Activities()[0].Decision)
+	})
+
+	t.Run("policy intercept", func(t *testing.T) {
+		cfg.PassThroughHosts, cfg.PassThroughPolicy = nil, true
+		p := testProxy(t, testDecider{})
+		tr := passThroughClient(t, p, origin)
+
+		// without a bypass the tunnel is intercepted with a leaf of the proxy CA
+		_, err := tr.RoundTrip(httptest.NewRequest("GET", origin.URL+"/", nil))
+		require.Error(t, err)
+	})
+}
+
+func TestShutdownDrains(t *testing.T) {
+	started := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("slow download"))
+	}))
+	defer origin.Close()
+
+	dir, err := os.MkdirTemp("", "pse")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "proxy.sock")
+	saved := config.Cfg().Listeners
+	defer func() { config.Cfg().Listeners = saved }()
+	config.Cfg().Listeners = config.Listeners{
+		Proxy:   config.Listener{Socket: socket},
+		TLS:     config.Listener{Disabled: true},
+		Control: config.Listener{Disabled: true},
+	}
+
+	p := testProxy(t, testDecider{})
+	testSession(t, "192.0.2.7")
+	startErr := make(chan error, 1)
+	go func() { startErr <- p.Start() }()
+
+	client := &http.Client{Transport: &http.Transport{
+		Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: "pse"}),
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	require.Eventually(t, func() bool {
+		c, err := net.Dial("unix", socket)
+		if err == nil {
+			c.Close()
+		}
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, http.StatusOK, pseGet(p, "/readyz").Code)
+
+	type result struct {
+		body string
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		req, _ := http.NewRequest("GET", origin.URL+"/artifact.tgz", nil)
+		req.Header.Set("Forwarded", "for=192.0.2.7")
+		rsp, err := client.Do(req)
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		defer rsp.Body.Close()
+		body, err := io.ReadAll(rsp.Body)
+		done <- result{string(body), err}
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, p.Shutdown(ctx))
+	res := <-done
+	require.NoError(t, res.err)
+	require.Equal(t, "slow download", res.body)
+	require.NoError(t, <-startErr)
+	require.Equal(t, http.StatusServiceUnavailable, pseGet(p, "/readyz").Code)
+
+	_, ok := sessions.Find("192.0.2.7")
+	require.False(t, ok)
+	_, err = net.Dial("unix", socket)
+	require.Error(t, err)
+}
+
+func TestAppListenerClose(t *testing.T) {
+	l := newAppListener()
+	queued, other := net.Pipe()
+	defer other.Close()
+	l.push(queued)
+	l.Close()
+	_, err := l.Accept()
+	require.ErrorIs(t, err, net.ErrClosed)
+	// the queued connection was closed with the listener
+	_, err = other.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+
+	late, other2 := net.Pipe()
+	defer other2.Close()
+	l.push(late)
+	_, err = other2.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+}
+
+// pseGet requests path from the PSE endpoint of p
+func pseGet(p *Proxy, path string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	p.handler.PseEndpoint(rec, httptest.NewRequest("GET", "https://"+self+path, nil))
+	return rec
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("metered"))
+	}))
+	defer origin.Close()
+	p := testProxy(t, testDecider{})
+	testSession(t, "192.0.2.8")
+
+	require.Equal(t, http.StatusOK, pseGet(p, "/healthz").Code)
+	// listeners are bound by Start
+	require.Equal(t, http.StatusServiceUnavailable, pseGet(p, "/readyz").Code)
+
+	req := httptest.NewRequest("GET", origin.URL+"/metered", nil)
+	req.RemoteAddr = "192.0.2.8:40000"
+	p.ServeHTTP(httptest.NewRecorder(), req)
+
+	rec := pseGet(p, "/metrics")
+	require.Equal(t, http.StatusOK, rec.Code)
+	body := rec.Body.String()
+	for _, metric := range []string{
+		`pse_requests_total{technology="web"}`,
+		`pse_decisions_total{decision="allow"}`,
+		`pse_proxied_bytes_total{direction="download"}`,
+		"pse_opa_decision_seconds_count",
+		"pse_cert_issue_seconds_count",
+		"pse_sessions_active",
+	} {
+		require.Contains(t, body, metric)
+	}
+}
+
+// errDecider fails every evaluation
+type errDecider struct{}
+
+func (errDecider) Decision(ctx context.Context, options sdk.DecisionOptions) (*sdk.DecisionResult, error) {
+	return nil, errors.New("bundle not activated")
+}
+
+func (errDecider) Stop(ctx context.Context) {
+}
+
+func TestServeHTTPPolicyFailure(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("unchecked"))
+	}))
+	defer origin.Close()
+	saved := config.Cfg().PolicyFailure
+	defer func() { config.Cfg().PolicyFailure = saved }()
+	p := testProxy(t, errDecider{})
+
+	for _, mode := range []string{config.FailOpen, config.FailClosed} {
+		config.Cfg().PolicyFailure = config.PolicyFailure{FailureMode: config.FailureMode{Mode: mode}}
+		sess := testSession(t, "192.0.2.9")
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", origin.URL+"/"+mode, nil)
+		req.RemoteAddr = "192.0.2.9:40000"
+		p.ServeHTTP(rec, req)
+
+		acts := sess.Activities()
+		require.Len(t, acts, 1)
+		require.Equal(t, "policy-unavailable", acts[0].Checks[0].Policy)
+		if mode == config.FailClosed {
+			require.Equal(t, http.StatusForbidden, rec.Code)
+			require.Equal(t, model.Deny, acts[0].Decision)
+		} else {
+			require.Equal(t, "unchecked", rec.Body.String())
+			require.Equal(t, model.Alert, acts[0].Decision)
+		}
+	}
+}
+
+func TestHold(t *testing.T) {
+	h, n, err := hold(io.NopCloser(strings.NewReader("small")), holdMax)
+	require.NoError(t, err)
+	require.EqualValues(t, 5, n)
+	require.Nil(t, h.file)
+	data, _ := io.ReadAll(h)
+	require.Equal(t, "small", string(data))
+
+	large := bytes.Repeat([]byte("x"), holdInMemory+10)
+	h, n, err = hold(io.NopCloser(bytes.NewReader(large)), holdMax)
+	require.NoError(t, err)
+	require.EqualValues(t, len(large), n)
+	require.NotNil(t, h.file)
+	data, _ = io.ReadAll(h)
+	require.Equal(t, large, data)
+	require.NoError(t, h.Close())
+	_, err = os.Stat(h.file.Name())
+	require.True(t, os.IsNotExist(err))
+
+	_, _, err = hold(io.NopCloser(io.MultiReader(strings.NewReader("partial"), iotest.ErrReader(errResponseDenied))), holdMax)
+	require.ErrorIs(t, err, errResponseDenied)
+}
+
+func TestHoldLimit(t *testing.T) {
+	// past the limit the body is replayed and read on
+	for _, limit := range []int64{1 << 10, holdInMemory + 1} {
+		large := bytes.Repeat([]byte("x"), holdInMemory+10)
+		h, n, err := hold(io.NopCloser(bytes.NewReader(large)), limit)
+		require.NoError(t, err)
+		require.EqualValues(t, -1, n)
+		data, err := io.ReadAll(h)
+		require.NoError(t, err)
+		require.Equal(t, large, data)
+		require.NoError(t, h.Close())
+	}
+
+	// a deny past the limit ends the stream
+	h, n, err := hold(io.NopCloser(io.MultiReader(strings.NewReader("partial"), iotest.ErrReader(errResponseDenied))), 4)
+	require.NoError(t, err)
+	require.EqualValues(t, -1, n)
+	data, err := io.ReadAll(h)
+	require.ErrorIs(t, err, errResponseDenied)
+	require.Equal(t, "partial", string(data))
+}
+
+func TestResponseDenyBlocks(t *testing.T) {
+	artifact := bytes.Repeat([]byte("tarball"), 1<<20)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// no Content-Length, the body is sent chunked
+		w.Write(artifact[:10])
+		w.(http.Flusher).Flush()
+		w.Write(artifact[10:])
+	}))
+	defer origin.Close()
+	cfg := config.Cfg()
+	defer func(repos []string) { cfg.NpmRepos = repos }(cfg.NpmRepos)
+	cfg.NpmRepos = []string{strings.TrimPrefix(origin.URL, "http://")}
+	p := testProxy(t, testDecider{denyResponse: []string{"/evil"}})
+	testSession(t, "192.0.2.10")
+
+	get := func(path, accept string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", origin.URL+path, nil)
+		req.Header.Set("Accept", accept)
+		req.RemoteAddr = "192.0.2.10:40000"
+		p.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get("/left-pad/-/left-pad-1.3.0.tgz", "*/*")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, strconv.Itoa(len(artifact)), rec.Header().Get("Content-Length"))
+	require.Equal(t, artifact, rec.Body.Bytes())
+
+	rec = get("/evil/-/evil-1.0.0.tgz", "application/json")
+	require.Equal(t, http.StatusForbidden, rec.Code)
+	require.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	var page blockPage
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &page))
+	require.Equal(t, origin.URL+"/evil/-/evil-1.0.0.tgz", page.URL)
+	require.Equal(t, "deny", page.Decision)
+	require.Equal(t, []blockCheck{{Policy: "malware-scan", Result: "Block", Details: "known malicious tarball"}}, page.Checks)
+	require.Len(t, page.Reference, 16)
+
+	// npm clients read the error of any block page as JSON
+	rec = get("/evil/-/evil-1.0.0.tgz", "*/*")
+	require.Equal(t, http.StatusForbidden, rec.Code)
+	require.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	require.Contains(t, rec.Body.String(), "known malicious tarball")
+	require.NotContains(t, rec.Body.String(), "tarballtarball")
+}
+
+func TestResponseStreams(t *testing.T) {
+	page := bytes.Repeat([]byte("page"), 1<<18)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(page)
+	}))
+	defer origin.Close()
+	p := testProxy(t, testDecider{denyResponse: []string{"/evil"}})
+	sess := testSession(t, "192.0.2.15")
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", origin.URL+path, nil)
+		req.RemoteAddr = "192.0.2.15:40000"
+		p.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get("/index.html")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, page, rec.Body.Bytes())
+
+	// web responses are not held, a deny truncates the transfer already
+	// under way instead of serving a block page
+	rec = get("/evil.html")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NotEmpty(t, rec.Body.Bytes())
+	require.Less(t, rec.Body.Len(), len(page))
+	acts := sess.Activities()
+	require.Len(t, acts, 2)
+	require.Equal(t, model.Deny, acts[1].Decision)
+}
+
+func TestBlockPageFormats(t *testing.T) {
+	act := func(name model.ActivityName) *session.Activity {
+		return &session.Activity{ActivityHdr: model.ActivityHdr{
+			Name:     name,
+			Decision: model.Deny,
+			Checks:   []model.TechCheck{{Policy: "malware-scan", AlertLevel: model.AlertCritical, Details: "known <malicious> package"}},
+		}}
+	}
+	u := "https://registry.example.com/left-pad"
+
+	contentType, body := newBlockPage(act(model.NPM), u, "malware").render("*/*")
+	require.Equal(t, "application/json", contentType)
+	var page blockPage
+	require.NoError(t, json.Unmarshal(body, &page))
+	require.Equal(t, "blocked by InvisiRisk policy malware-scan: malware", page.Error)
+	require.Equal(t, "malware", page.Detail)
+
+	contentType, body = newBlockPage(act(model.Pypi), u, "malware").render("*/*")
+	require.Contains(t, contentType, "text/html")
+	require.Contains(t, string(body), "<h1>blocked by InvisiRisk policy malware-scan: malware</h1>")
+	require.Contains(t, string(body), "known &lt;malicious&gt; package")
+
+	for _, name := range []model.ActivityName{model.Maven, model.GoModule} {
+		contentType, body = newBlockPage(act(name), u, "malware").render("application/json")
+		require.Contains(t, contentType, "text/plain")
+		require.True(t, strings.HasPrefix(string(body), "blocked by InvisiRisk policy malware-scan: malware\n"))
+	}
+
+	contentType, _ = newBlockPage(act(model.Web), u, "").render("application/json")
+	require.Equal(t, "application/json", contentType)
+}
+
+func TestServeHTTPRequestDenyPage(t *testing.T) {
+	p := testProxy(t, testDecider{deny: []string{"blocked.example.com"}})
+	testSession(t, "192.0.2.11")
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "http://blocked.example.com/", nil)
+	req.Header.Set("Accept", "application/json")
+	req.RemoteAddr = "192.0.2.11:40000"
+	p.ServeHTTP(rec, req)
+
+	require.Equal(t, http.StatusForbidden, rec.Code)
+	require.Equal(t, "no-store", rec.Header().Get("Cache-Control"))
+	var page blockPage
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &page))
+	require.Equal(t, "http://blocked.example.com/", page.URL)
+	require.Equal(t, "deny", page.Decision)
+	require.Len(t, page.Reference, 16)
+}
+
+func TestIntegrityMismatch(t *testing.T) {
+	tarball := []byte("left-pad tarball")
+	sum := sha512.Sum512(tarball)
+	var origin *httptest.Server
+	origin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/left-pad":
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"versions": {"1.3.0": {"dist": {"tarball": "%v/left-pad/-/left-pad-1.3.0.tgz", "integrity": "sha512-%v"}}}}`,
+				origin.URL, base64.StdEncoding.EncodeToString(sum[:]))
+		case "/left-pad/-/left-pad-1.3.0.tgz":
+			w.Write(tarball)
+		default:
+			w.Write([]byte("tampered"))
+		}
+	}))
+	defer origin.Close()
+	cfg := config.Cfg()
+	defer func(repos []string) { cfg.NpmRepos = repos }(cfg.NpmRepos)
+	cfg.NpmRepos = []string{strings.TrimPrefix(origin.URL, "http://")}
+	p := testProxy(t, testDecider{})
+	sess := testSession(t, "192.0.2.12")
+
+	get := func(path string) {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", origin.URL+path, nil)
+		req.RemoteAddr = "192.0.2.12:40000"
+		p.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+	}
+	get("/left-pad")
+	get("/left-pad/-/left-pad-1.3.0.tgz")
+	acts := sess.Activities()
+	require.Len(t, acts, 2)
+	require.Equal(t, model.NPM, acts[1].Name)
+	require.Equal(t, model.Allow, acts[1].Decision)
+	require.Contains(t, acts[1].Checks, model.TechCheck{Name: "Allow", Score: 10, AlertLevel: model.AlertNone, Details: "sha512 matches npm dist.integrity", Policy: integrity.Policy})
+
+	// the registry serves another tarball for the same URL
+	tarball = []byte("left-pad tarball with a payload")
+	get("/left-pad/-/left-pad-1.3.0.tgz")
+	acts = sess.Activities()
+	require.Len(t, acts, 3)
+	require.Equal(t, model.Alert, acts[2].Decision)
+	require.Equal(t, model.AlertCritical, acts[2].AlertLevel)
+	require.Equal(t, integrity.Policy, acts[2].Checks[len(acts[2].Checks)-1].Policy)
+}
+
+func TestRegistryForPrefixedGoProxy(t *testing.T) {
+	cfg := &config.Config{GoProxies: []string{"proxy.example.com/gomod"}}
+	u, _ := url.Parse("https://proxy.example.com/gomod/golang.org/x/sync/@v/v0.1.0.zip")
+	reg := newRegistries(nil).For(u, cfg)
+	require.NotNil(t, reg)
+	require.Equal(t, "pkg:gomodule/golang.org/x/sync@v0.1.0", reg.Key(u))
+}
+
+// inputDecider is testDecider recording the response inputs it decides
+type inputDecider struct {
+	testDecider
+	mutex  *sync.Mutex
+	inputs *[]policy.PolicyInput
+}
+
+func (d inputDecider) Decision(ctx context.Context, options sdk.DecisionOptions) (*sdk.DecisionResult, error) {
+	if input := options.Input.(policy.PolicyInput); input.IsResponseReady {
+		d.mutex.Lock()
+		*d.inputs = append(*d.inputs, input)
+		d.mutex.Unlock()
+	}
+	return d.testDecider.Decision(ctx, options)
+}
+
+func TestNpmMetadata(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/evil":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"name": "evil", "dist-tags": {"latest": "1.0.1"}, "time": {"1.0.1": "2024-06-01T12:00:00.000Z"},
+				"versions": {"1.0.1": {"version": "1.0.1", "scripts": {"postinstall": "node steal.js"}}}}`))
+		default:
+			w.Write([]byte("tarball"))
+		}
+	}))
+	defer origin.Close()
+	cfg := config.Cfg()
+	defer func(repos []string) { cfg.NpmRepos = repos }(cfg.NpmRepos)
+	cfg.NpmRepos = []string{strings.TrimPrefix(origin.URL, "http://")}
+	var inputs []policy.PolicyInput
+	p := testProxy(t, inputDecider{mutex: &sync.Mutex{}, inputs: &inputs})
+	testSession(t, "192.0.2.14")
+
+	for _, path := range []string{"/evil", "/evil/-/evil-1.0.1.tgz", "/evil/-/evil-1.0.2.tgz"} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", origin.URL+path, nil)
+		req.RemoteAddr = "192.0.2.14:40000"
+		p.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+	}
+	require.Len(t, inputs, 3)
+	want := &npm.Metadata{
+		Name:             "evil",
+		Version:          "1.0.1",
+		Scripts:          map[string]string{"postinstall": "node steal.js"},
+		HasInstallScript: true,
+		Published:        "2024-06-01T12:00:00.000Z",
+	}
+	require.Equal(t, want, inputs[0].Response.Metadata)
+	require.Equal(t, want, inputs[1].Response.Metadata)
+	require.Nil(t, inputs[2].Response.Metadata)
+}
+
+func TestComposerDists(t *testing.T) {
+	var origin *httptest.Server
+	origin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/p2/acme/pkg.json" {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"packages": {"acme/pkg": [{"name": "acme/pkg", "version": "1.0.0", "dist": {"url": "%v/dists/acme/pkg/1.0.0/3f2c1d.zip", "reference": "3f2c1d"}}]}, "minified": "composer/2.0"}`, origin.URL)
+			return
+		}
+		w.Write([]byte("PK"))
+	}))
+	defer origin.Close()
+	cfg := config.Cfg()
+	defer func(repos []string) { cfg.ComposerRepos = repos }(cfg.ComposerRepos)
+	cfg.ComposerRepos = []string{strings.TrimPrefix(origin.URL, "http://")}
+	p := testProxy(t, testDecider{})
+	sess := testSession(t, "192.0.2.15")
+
+	for _, path := range []string{"/p2/acme/pkg.json", "/dists/acme/pkg/1.0.0/3f2c1d.zip"} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", origin.URL+path, nil)
+		req.RemoteAddr = "192.0.2.15:40000"
+		p.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+	}
+	acts := sess.Activities()
+	require.Len(t, acts, 2)
+	require.Equal(t, "metadata", acts[0].Action)
+	require.Equal(t, model.Composer, acts[1].Name)
+	require.Equal(t, "pkg:composer/acme/pkg@1.0.0", acts[1].Activity.(model.PackageActivity).Purl)
+}
+
+func TestGoSumVerify(t *testing.T) {
+	module := func(extra string) []byte {
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		for _, name := range []string{"example.com/m@v1.0.0/main.go", "example.com/m@v1.0.0/go.mod"} {
+			w, _ := zw.Create(name)
+			w.Write([]byte(name + extra))
+		}
+		zw.Close()
+		return buf.Bytes()
+	}
+	served := module("")
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(served)
+	}))
+	defer origin.Close()
+	sums := filepath.Join(t.TempDir(), "go.sum")
+	require.NoError(t, os.WriteFile(sums, []byte("example.com/m v1.0.0 h1:iFuQf2nMsEndT1dm+zU6GimrUjCG1gLF5JhCdMi1Q8Y=\n"), 0o644))
+	cfg := config.Cfg()
+	defer func(proxies, files []string) { cfg.GoProxies, cfg.GoSums = proxies, files }(cfg.GoProxies, cfg.GoSums)
+	cfg.GoProxies, cfg.GoSums = []string{strings.TrimPrefix(origin.URL, "http://")}, []string{sums}
+	p := testProxy(t, testDecider{})
+	sess := testSession(t, "192.0.2.13")
+
+	get := func() *session.Activity {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", origin.URL+"/example.com/m/@v/v1.0.0.zip", nil)
+		req.RemoteAddr = "192.0.2.13:40000"
+		p.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+		acts := sess.Activities()
+		return acts[len(acts)-1]
+	}
+	act := get()
+	require.Equal(t, model.GoModule, act.Name)
+	require.Equal(t, model.Allow, act.Decision)
+	require.Equal(t, "h1 matches "+sums, act.Checks[len(act.Checks)-1].Details)
+
+	served = module("// changed\n")
+	act = get()
+	require.Equal(t, model.Alert, act.Decision)
+	require.Equal(t, model.AlertCritical, act.AlertLevel)
+}
+
+func TestOCIPull(t *testing.T) {
+	layer := []byte("alpine layer")
+	sum := sha256.Sum256(layer)
+	layerDigest := "sha256:" + hex.EncodeToString(sum[:])
+	manifest := []byte(`{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.manifest.v1+json",
+		"config": {"digest": "sha256:1111111111111111111111111111111111111111111111111111111111111111"},
+		"layers": [{"digest": "` + layerDigest + `"}]}`)
+	msum := sha256.Sum256(manifest)
+	manifestDigest := "sha256:" + hex.EncodeToString(msum[:])
+	served := layer
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(served)
+	}))
+	defer storage.Close()
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/library/alpine/manifests/3.19":
+			w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+			w.Header().Set("Docker-Content-Digest", manifestDigest)
+			w.Write(manifest)
+		case "/v2/library/alpine/blobs/" + layerDigest:
+			http.Redirect(w, r, storage.URL+"/data?signature=x", http.StatusTemporaryRedirect)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer registry.Close()
+	cfg := config.Cfg()
+	defer func(repos []string) { cfg.OCIRepos = repos }(cfg.OCIRepos)
+	cfg.OCIRepos = []string{strings.TrimPrefix(registry.URL, "http://")}
+	var inputs []policy.PolicyInput
+	p := testProxy(t, inputDecider{mutex: &sync.Mutex{}, inputs: &inputs})
+	sess := testSession(t, "192.0.2.16")
+
+	get := func(u string, code int) *session.Activity {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", u, nil)
+		req.RemoteAddr = "192.0.2.16:40000"
+		p.ServeHTTP(rec, req)
+		require.Equal(t, code, rec.Code)
+		acts := sess.Activities()
+		return acts[len(acts)-1]
+	}
+	act := get(registry.URL+"/v2/library/alpine/manifests/3.19", http.StatusOK)
+	require.Equal(t, oci.OCI, act.Name)
+	require.Equal(t, "metadata", act.Action)
+	image := act.Activity.(session.ImageActivity)
+	require.Equal(t, "3.19", image.Tag)
+	require.Equal(t, manifestDigest, image.Digest)
+	// the policy weighs the response by the digest the tag resolved to
+	require.Equal(t, image, inputs[0].Request.Details)
+	require.Equal(t, []string{layerDigest}, inputs[0].Response.Metadata.(*oci.Metadata).Layers)
+
+	act = get(registry.URL+"/v2/library/alpine/blobs/"+layerDigest, http.StatusTemporaryRedirect)
+	require.Equal(t, "3.19", act.Activity.(session.ImageActivity).Tag)
+
+	act = get(storage.URL+"/data?signature=x", http.StatusOK)
+	require.Equal(t, oci.OCI, act.Name)
+	require.Equal(t, "get", act.Action)
+	require.Equal(t, layerDigest, act.Activity.(session.ImageActivity).Digest)
+	require.Equal(t, model.Allow, act.Decision)
+	require.Contains(t, act.Checks, model.TechCheck{Name: "Allow", Score: 10, AlertLevel: model.AlertNone, Details: "sha256 matches oci content digest", Policy: integrity.Policy})
+
+	// storage serves another layer for the digest
+	served = []byte("alpine layer with a payload")
+	act = get(storage.URL+"/data?signature=x", http.StatusOK)
+	require.Equal(t, model.Alert, act.Decision)
+	require.Equal(t, model.AlertCritical, act.AlertLevel)
+}
+
+func TestControlEndpointForwarded(t *testing.T) {
+	handler := &PolicyHandler{}
+	start := func(client *http.Client, ip string) {
+		req, _ := http.NewRequest("POST", "http://pse/start", strings.NewReader("project=test"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Forwarded", "for="+ip)
+		rsp, err := client.Do(req)
+		require.NoError(t, err)
+		rsp.Body.Close()
+	}
+
+	// TCP clients cannot name another build host
+	tcp := httptest.NewServer(http.HandlerFunc(handler.ControlEndpoint))
+	defer tcp.Close()
+	tcpClient := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "tcp", tcp.Listener.Addr().String())
+		},
+	}}
+	start(tcpClient, "192.0.2.30")
+	_, ok := sessions.Find("192.0.2.30")
+	require.False(t, ok)
+	_, ok = sessions.Find("127.0.0.1")
+	require.True(t, ok)
+
+	socket := filepath.Join(t.TempDir(), "control.sock")
+	l, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	unix := &httptest.Server{Listener: l, Config: &http.Server{Handler: http.HandlerFunc(handler.ControlEndpoint)}}
+	unix.Start()
+	defer unix.Close()
+	unixClient := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	start(unixClient, "192.0.2.31")
+	_, ok = sessions.Find("192.0.2.31")
+	require.True(t, ok)
+}
+
+func TestOCIMetadataLocked(t *testing.T) {
+	sess := testSession(t, "192.0.2.17")
+	act := &session.Activity{
+		ActivityHdr: model.ActivityHdr{Name: oci.OCI, Action: "metadata"},
+		Activity:    oci.Image{Host: "ghcr.io", Name: "acme/app", Tag: "1.0"}.Activity(oci.KindManifest),
+	}
+	sess.Add(act)
+	ctx := context.WithValue(context.Background(), utils.ActCtxKey, act)
+	ctx = context.WithValue(ctx, utils.SessionCtxKey, sess)
+	req := httptest.NewRequest("GET", "https://ghcr.io/v2/acme/app/manifests/1.0", nil)
+	digest := "sha256:" + strings.Repeat("ab", 32)
+	rsp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{oci.DigestHeader: {digest}}, Request: req}
+
+	// the activity is read as a report does while the digest is resolved
+	var seen []interface{}
+	read := make(chan struct{})
+	go func() {
+		defer close(read)
+		for i := 0; i < 100; i++ {
+			sess.Update(func() { seen = append(seen[:0], act.Activity) })
+		}
+	}()
+	ociMetadata(ctx, oci.NewStore(4), &oci.Manifest{Response: rsp})
+	<-read
+	require.Equal(t, digest, act.Activity.(session.ImageActivity).Digest)
+}
+
+// keyRegistry names every download k and publishes nothing
+type keyRegistry string
+
+func (keyRegistry) Published(rsp *http.Response, body io.Reader) ([]integrity.Digest, error) {
+	return nil, nil
+}
+
+func (k keyRegistry) Key(u *url.URL) string {
+	return string(k)
+}
+
+func TestResponseDecisionLocked(t *testing.T) {
+	p := testProxy(t, testDecider{denyResponse: []string{"evil"}})
+	sess := testSession(t, "192.0.2.18")
+	act := &session.Activity{
+		ActivityHdr: model.ActivityHdr{Name: model.NPM, Action: "get", Decision: model.Allow},
+		Activity:    model.PackageActivity{Package: "evil", Version: "1.0.0"},
+	}
+	sess.Add(act)
+	ctx := context.WithValue(context.Background(), utils.ActCtxKey, act)
+	ctx = context.WithValue(ctx, utils.SessionCtxKey, sess)
+	req := httptest.NewRequest("GET", "https://registry.npmjs.org/evil/-/evil-1.0.0.tgz", nil)
+	rsp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Request: req}
+	store := integrity.NewStore(4)
+	store.Publish(integrity.Digest{Key: "evil", Algorithm: integrity.SHA256, Value: "00", Source: "test"})
+
+	// the activity is read as a report does while the response is decided
+	var seen []model.ActivityHdr
+	reading, decided, reported := make(chan struct{}), make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(reported)
+		for i := 0; ; i++ {
+			select {
+			case <-decided:
+				return
+			default:
+				sess.Update(func() { seen = append(seen[:0], act.ActivityHdr) })
+			}
+			if i == 0 {
+				close(reading)
+			}
+		}
+	}()
+	<-reading
+	status := verifyIntegrity(ctx, store, keyRegistry("evil"), rsp, integrity.Sums{SHA256: "01"}, nil)
+	err := ModifyResponseBasedOnPolicy(p.handler.p, ctx, &utils.ResponseData{Response: rsp})
+	// let the report read the decision
+	time.Sleep(10 * time.Millisecond)
+	close(decided)
+	<-reported
+	require.ErrorIs(t, err, errResponseDenied)
+	require.Equal(t, integrity.Mismatch, status)
+	require.Equal(t, model.Deny, act.Decision)
+}
+
+func TestLateChecksumChecksArtifact(t *testing.T) {
+	sess := testSession(t, "192.0.2.19")
+	get := func(url string) (context.Context, *session.Activity, *http.Response) {
+		act := &session.Activity{ActivityHdr: model.ActivityHdr{Name: model.Maven, Action: "get", Decision: model.Allow}}
+		sess.Add(act)
+		ctx := context.WithValue(context.Background(), utils.ActCtxKey, act)
+		ctx = context.WithValue(ctx, utils.SessionCtxKey, sess)
+		req := httptest.NewRequest("GET", url, nil)
+		return ctx, act, &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Request: req}
+	}
+	store := integrity.NewStore(4)
+	reg := maven.NewRegistry()
+	jar := "https://repo1.maven.org/maven2/org/example/lib/1.0/lib-1.0.jar"
+
+	ctx, jarAct, rsp := get(jar)
+	require.Equal(t, "", verifyIntegrity(ctx, store, reg, rsp, integrity.Sums{SHA1: "aa", SHA256: "bb"}, nil))
+
+	ctx, sha1Act, rsp := get(jar + ".sha1")
+	published, err := reg.Published(rsp, strings.NewReader("cc\n"))
+	require.NoError(t, err)
+	verifyIntegrity(ctx, store, reg, rsp, integrity.Sums{}, published)
+
+	require.Len(t, jarAct.Checks, 1)
+	require.Equal(t, model.AlertCritical, jarAct.AlertLevel)
+	require.Equal(t, model.Alert, jarAct.Decision)
+	require.Empty(t, sha1Act.Checks)
+	require.Equal(t, model.Allow, sha1Act.Decision)
+}
@@ -1,30 +1,51 @@
 package server
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"net/http"
 
 	"github.com/julienschmidt/httprouter"
 )
 
 type Server struct {
-	server http.Server
+	server *http.Server
 }
 
-func StartServer(port int, policyDir string) *Server {
+func newServer(policyDir string) *http.Server {
 	router := httprouter.New()
 	router.ServeFiles("/*filepath", http.Dir(policyDir))
 
-	server := &http.Server{
+	return &http.Server{
 		Handler: router,
-		Addr:    fmt.Sprintf("localhost:%v", port),
 	}
+}
+
+func StartServer(port int, policyDir string) *Server {
+	server := newServer(policyDir)
+	server.Addr = fmt.Sprintf("localhost:%v", port)
 	go func() { server.ListenAndServe() }()
 	return &Server{
-		server: *server,
+		server: server,
+	}
+}
+
+// Serve serves the policy directory on an already bound listener, such as
+// a configured TCP address or Unix socket.
+func Serve(l net.Listener, policyDir string) *Server {
+	server := newServer(policyDir)
+	go func() { server.Serve(l) }()
+	return &Server{
+		server: server,
 	}
 }
 
 func (s *Server) Close() {
 	s.server.Close()
 }
+
+// Shutdown stops the server once the requests in flight are served
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.server.Shutdown(ctx)
+}
@@ -1,8 +1,13 @@
 package server
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -38,3 +43,28 @@ func TestStartServerInvalidPort(t *testing.T) {
     _, err := http.Get(fmt.Sprintf("http://localhost:%d/test.txt", port))
     require.Error(t, err)
 }
+
+func TestServeUnixSocket(t *testing.T) {
+	tempDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, "test.txt"), []byte("policy"), 0600))
+	sock := filepath.Join(t.TempDir(), "policy.sock")
+	l, err := net.Listen("unix", sock)
+	require.NoError(t, err)
+
+	server := Serve(l, tempDir)
+	defer server.Close()
+
+	client := http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", sock)
+			},
+		},
+	}
+	rsp, err := client.Get("http://policy/test.txt")
+	require.NoError(t, err)
+	defer rsp.Body.Close()
+	data, err := io.ReadAll(rsp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "policy", string(data))
+}
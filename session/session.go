@@ -13,6 +13,7 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -23,6 +24,8 @@ import (
 
 	"github.com/invisirisk/clog"
 	"github.com/invisirisk/svcs/model"
+
+	"inivisirisk.com/pse/upstream"
 )
 
 type Decision = model.Decision
@@ -31,6 +34,62 @@ type Activity = model.Activity
 
 var NilActivity = &Activity{}
 
+// TunnelActivity details a model.Web activity for a connection spliced
+// without TLS interception, only the tunnel itself is visible.
+type TunnelActivity struct {
+	model.WebActivity
+	SNI           string `json:"sni"`
+	BytesSent     int64  `json:"bytes_sent"`
+	BytesReceived int64  `json:"bytes_received"`
+	DurationMs    int64  `json:"duration_ms"`
+}
+
+// GitActivity details a model.Git activity with what the smart HTTP protocol
+// exchanged, the operation and the refs and commits fetched or pushed.
+type GitActivity struct {
+	model.GitActivity
+	// Operation is ls-remote for ref listings, which clones and fetches
+	// start with as well, clone, fetch or push
+	Operation string `json:"operation"`
+	Protocol  int    `json:"protocol_version"`
+	// RefPrefixes restrict a protocol v2 ref listing
+	RefPrefixes []string `json:"ref_prefixes,omitempty"`
+	// Wants are the commits fetched, with the refs advertised for them
+	Wants []GitRef `json:"wants,omitempty"`
+	// Haves counts the commits the client holds, none for a clone
+	Haves   int  `json:"haves"`
+	Shallow bool `json:"shallow"`
+	// Depth limits the history fetched, 0 when the fetch is not shallow
+	Depth int `json:"depth,omitempty"`
+	// Updates are the refs pushed
+	Updates []GitRefUpdate `json:"updates,omitempty"`
+}
+
+// GitRef is a commit and the refs pointing at it, a protocol v2 want-ref
+// names the ref alone
+type GitRef struct {
+	SHA  string   `json:"sha,omitempty"`
+	Refs []string `json:"refs,omitempty"`
+}
+
+// GitRefUpdate is a ref moved by a push, from the zero id when created and to
+// it when deleted
+type GitRefUpdate struct {
+	Ref string `json:"ref"`
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+// ImageActivity details a container registry activity, the package being the
+// image name and the version its digest, or the tag until it is resolved
+type ImageActivity struct {
+	model.PackageActivity
+	// Kind is manifest or blob
+	Kind   string `json:"kind"`
+	Tag    string `json:"tag,omitempty"`
+	Digest string `json:"digest,omitempty"`
+}
+
 type Session struct {
 	Project    string
 	Workflow   string
@@ -46,10 +105,14 @@ type Session struct {
 	ScmBranch     string
 
 	// Additional fields related to VB Integration
-	ScanID         string
-	activities     []*model.Activity
-	PackageNameMap map[string]string
-	cl             *clog.CLog
+	ScanID string
+	cl     *clog.CLog
+
+	// mutex guards the activities, which handlers add and update while the
+	// session may be ending, and the status reported
+	mutex      sync.Mutex
+	activities []*model.Activity
+	status     model.BuildStatus
 }
 
 var (
@@ -92,9 +155,8 @@ func NewSession(r *http.Request) *Session {
 		ScmPrevCommit: r.PostFormValue("scm_prev_commit"),
 		Workflow:      r.PostFormValue("workflow"),
 
-		PackageNameMap: make(map[string]string),
-		cl:             cl,
-		StartTime:      time.Now(),
+		cl:        cl,
+		StartTime: time.Now(),
 	}
 
 	cl.Infof("New Session %p %v, sess %v rip %v", sess, r.Form, r.FormValue("project"), r.RemoteAddr)
@@ -107,13 +169,45 @@ func (s *Session) Add(act *model.Activity) {
 		return
 	}
 	s.cl.Infof("new activity %v", act)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	s.activities = append(s.activities, act)
 }
 
+// Activities returns a copy of the activities recorded so far
+func (s *Session) Activities() []*model.Activity {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]*model.Activity(nil), s.activities...)
+}
+
+// Update runs update, which changes activities already added, under the
+// session lock. It returns false when the session was reported before, the
+// change is then not part of the report. A nil session runs update alone.
+func (s *Session) Update(update func()) bool {
+	if s == nil {
+		update()
+		return true
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	update()
+	return s.status == ""
+}
+
+// Status is the status the session was reported with, "" while it is open
+func (s *Session) Status() model.BuildStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.status
+}
+
 func (s *Session) End(w http.ResponseWriter, r *http.Request) {
 	status := model.Unknown
+	ctx := context.Background()
 
 	if r != nil {
+		ctx = r.Context()
 		r.ParseForm()
 		s.cl.Infof("End Session %p %v", s, r.Form)
 		// success, failed, or canceled
@@ -134,14 +228,63 @@ func (s *Session) End(w http.ResponseWriter, r *http.Request) {
 
 	}
 
+	defer func() {
+		if r := recover(); r != nil {
+			s.cl.Errorf("Panic in End function: %v", r)
+			// debug.PrintStack()
+		}
+	}()
+
+	data := s.report(ctx, status)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+	s.post(data)
+}
+
+// Abort ends a session the build never ended, such as on proxy shutdown, and
+// posts what was recorded with status aborted.
+func (s *Session) Abort(ctx context.Context) {
+	s.cl.Infof("Abort Session %p", s)
+	defer func() {
+		if r := recover(); r != nil {
+			s.cl.Errorf("Panic in Abort function: %v", r)
+		}
+	}()
+	s.post(s.report(ctx, model.Aborted))
+}
+
+// report summarizes the session as a build with the given status. The build
+// is a copy of the activities taken under the lock, it is logged to GitHub
+// once the lock is released.
+func (s *Session) report(ctx context.Context, status model.BuildStatus) []byte {
+	// activities updated from now on are not reported
+	s.mutex.Lock()
+	s.status = status
 	// send it to the server
-	bs := model.Build{
+	bs := s.build(status)
+	s.mutex.Unlock()
+
+	s.cl.Infof("build activity summary...")
+
+	for _, act := range bs.Activity {
+		fmt.Printf("%v\n", act)
+	}
+	data, _ := json.Marshal(bs)
+	// if github post to it
+	if s.Builder == "github" {
+		s.githubLog(ctx, bs)
+	}
+	return data
+}
+
+func (s *Session) build(status model.BuildStatus) *model.Build {
+	return &model.Build{
 		Id:         s.ScanID,
 		Project:    s.Project + " - " + s.Workflow,
 		Builder:    s.Builder,
 		BuilderUrl: s.BuilderUrl,
 		BuildUrl:   s.BuildUrl,
-		Activity:   s.activities,
+		Activity:   s.snapshot(),
 		Status:     status,
 		StartTime:  s.StartTime,
 		EndTime:    time.Now(),
@@ -152,27 +295,22 @@ func (s *Session) End(w http.ResponseWriter, r *http.Request) {
 		ScmPrevCommit: s.ScmPrevCommit,
 		ScmBranch:     s.ScmBranch,
 	}
+}
 
-	s.cl.Infof("build activity summary...")
-
-	defer func() {
-		if r := recover(); r != nil {
-			s.cl.Errorf("Panic in End function: %v", r)
-			// debug.PrintStack()
-		}
-	}()
-
-	for _, act := range s.activities {
-		fmt.Printf("%v\n", act)
-	}
-	// if github post to it
-	if s.Builder == "github" {
-		s.githubLog(r.Context(), &bs)
+// snapshot copies the activities, late updates do not change the copy. The
+// mutex must be held.
+func (s *Session) snapshot() []*model.Activity {
+	acts := make([]*model.Activity, len(s.activities))
+	for i, act := range s.activities {
+		cp := *act
+		cp.Checks = append([]model.TechCheck(nil), act.Checks...)
+		acts[i] = &cp
 	}
-	data, _ := json.Marshal(bs)
+	return acts
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(data)
+// post sends the build report to the portal when one is configured
+func (s *Session) post(data []byte) {
 	if portal == "" {
 		s.cl.Infof("invisirisk portal not set - skip post")
 		return
@@ -209,11 +347,10 @@ func (s *Session) End(w http.ResponseWriter, r *http.Request) {
 	defer cancel()
 	req = req.WithContext(ctx)
 
-	transport := &http.Transport{
-		MaxIdleConnsPerHost: 20,
-		IdleConnTimeout:     30 * time.Second,
-		ForceAttemptHTTP2:   false,
-	}
+	transport := upstream.Get().Transport()
+	transport.MaxIdleConnsPerHost = 20
+	transport.IdleConnTimeout = 30 * time.Second
+	transport.ForceAttemptHTTP2 = false
 
 	s.cl.Infof("Sending results to the portal")
 	client := &http.Client{
@@ -248,6 +385,7 @@ func (s *Session) githubLog(ctx context.Context, bs *model.Build) {
 	ts := oauth2.StaticTokenSource(
 		&oauth2.Token{AccessToken: token},
 	)
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, upstream.Get().Client(0))
 	tc := oauth2.NewClient(ctx, ts)
 
 	client := github.NewClient(tc)
@@ -262,7 +400,13 @@ func (s *Session) githubLog(ctx context.Context, bs *model.Build) {
 		var extraDetails string
 		switch act.Name {
 		case model.Web:
-			dact := act.Activity.(model.WebActivity)
+			dact, ok := act.Activity.(model.WebActivity)
+			if tact, isTunnel := act.Activity.(TunnelActivity); isTunnel {
+				dact, ok = tact.WebActivity, true
+			}
+			if !ok {
+				break
+			}
 			u, err := url.Parse(dact.URL)
 			if err == nil {
 				title += " - " + u.Host
@@ -271,7 +415,14 @@ func (s *Session) githubLog(ctx context.Context, bs *model.Build) {
 			}
 			extraDetails = fmt.Sprintf("- URL: %v\n", dact.URL)
 		case model.Git:
-			dact := act.Activity.(model.GitActivity)
+			dact, ok := act.Activity.(model.GitActivity)
+			if gact, isGit := act.Activity.(GitActivity); isGit {
+				dact, ok = gact.GitActivity, true
+				extraDetails = fmt.Sprintf("- Operation: %v\n", gact.Operation)
+			}
+			if !ok {
+				break
+			}
 			title += " - " + dact.Repo
 		case model.NPM:
 			dact := act.Activity.(model.PackageActivity)
@@ -349,7 +500,9 @@ func (s *Session) Summary(ctx context.Context, title string, checks []model.Tech
 	if openaiToken == "" {
 		return "", errors.New("no openai token")
 	}
-	client := openai.NewClient(openaiToken)
+	config := openai.DefaultConfig(openaiToken)
+	config.HTTPClient = upstream.Get().Client(0)
+	client := openai.NewClientWithConfig(config)
 
 	buf := bytes.NewBuffer([]byte{})
 	tmpl := template.New("request")
@@ -406,6 +559,13 @@ func (ss *Sessions) Add(addr string, s *Session) {
 	ss.sessions[addr] = s
 }
 
+// Len returns the number of open sessions
+func (ss *Sessions) Len() int {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	return len(ss.sessions)
+}
+
 func (ss *Sessions) Find(addr string) (*Session, bool) {
 	ss.mutex.Lock()
 	defer func() { ss.mutex.Unlock() }()
@@ -520,7 +680,7 @@ func (ss *Sessions) End(w http.ResponseWriter, r *http.Request) {
     // Bind all activities from related sessions to the current session
     for _, relatedSession := range relatedSessions {
         baseLogger.Infof("Binding activities from session with ScanID %v to current session", relatedSession.ScanID)
-        for _, activity := range relatedSession.activities {
+        for _, activity := range relatedSession.Activities() {
 			baseLogger.Infof("Binding activity %v", activity)
             sess.Add(activity)
         }
@@ -528,4 +688,45 @@ func (ss *Sessions) End(w http.ResponseWriter, r *http.Request) {
 
     // End the current session with all the aggregated information
     sess.End(w, r)
-}
\ No newline at end of file
+}
+
+// Abort ends every open session as aborted. Sessions sharing a scan are
+// posted once with their activities merged, as End does.
+func (ss *Sessions) Abort(ctx context.Context) {
+	ss.mutex.Lock()
+	var open []*Session
+	for _, s := range ss.sessions {
+		open = append(open, s)
+	}
+	for _, s := range ss.pendingSessions {
+		open = append(open, s)
+	}
+	ss.sessions = make(map[string]*Session)
+	ss.pendingSessions = make(map[string]*Session)
+	ss.mutex.Unlock()
+	// the session started first collects the activities of its scan
+	sort.SliceStable(open, func(i, j int) bool {
+		return open[i].StartTime.Before(open[j].StartTime)
+	})
+
+	scans := make(map[string]*Session)
+	var ended []*Session
+	for _, s := range open {
+		if s.ScanID == "" {
+			ended = append(ended, s)
+			continue
+		}
+		if first, ok := scans[s.ScanID]; ok {
+			for _, act := range s.Activities() {
+				first.Add(act)
+			}
+			continue
+		}
+		scans[s.ScanID] = s
+		ended = append(ended, s)
+	}
+	baseLogger.Infof("aborting %v open sessions", len(ended))
+	for _, s := range ended {
+		s.Abort(ctx)
+	}
+}
@@ -1,9 +1,14 @@
 package session
 
 import (
+	"context"
 	"net/http"
 	"net/url"
 	"testing"
+	"time"
+
+	"github.com/invisirisk/svcs/model"
+	"github.com/stretchr/testify/require"
 )
 
 func TestSeession(t *testing.T) {
@@ -12,3 +17,54 @@ func TestSeession(t *testing.T) {
 	req.Form.Add("project", "foo")
 	NewSession(req)
 }
+
+func TestAbort(t *testing.T) {
+	ss := NewSessions()
+	started := time.Now()
+	for i, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		req, _ := http.NewRequest("POST", "https://pse.invisirisk.com/start", nil)
+		scan := "scan-1"
+		if ip == "10.0.0.3" {
+			scan = "scan-2"
+		}
+		req.PostForm = url.Values{"project": {"foo"}, "id": {scan}}
+		s := NewSession(req)
+		s.StartTime = started.Add(time.Duration(i) * time.Second)
+		s.Add(&Activity{ActivityHdr: model.ActivityHdr{Name: model.Web, Action: ip}})
+		ss.Add(ip, s)
+	}
+	sessions := make(map[string]*Session)
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		sessions[ip], _ = ss.Find(ip)
+	}
+
+	ss.Abort(context.Background())
+	require.Zero(t, ss.Len())
+	actions := func(s *Session) []string {
+		var actions []string
+		for _, act := range s.Activities() {
+			actions = append(actions, act.Action)
+		}
+		return actions
+	}
+	// scan-1 is reported once, by the session started first, with the
+	// activities of both its sessions
+	require.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, actions(sessions["10.0.0.1"]))
+	require.Equal(t, model.Aborted, sessions["10.0.0.1"].Status())
+	require.Equal(t, []string{"10.0.0.2"}, actions(sessions["10.0.0.2"]))
+	require.Empty(t, sessions["10.0.0.2"].Status())
+	require.Equal(t, []string{"10.0.0.3"}, actions(sessions["10.0.0.3"]))
+	require.Equal(t, model.Aborted, sessions["10.0.0.3"].Status())
+}
+
+func TestUpdateAfterReport(t *testing.T) {
+	req, _ := http.NewRequest("POST", "https://pse.invisirisk.com/start", nil)
+	req.PostForm = url.Values{"project": {"foo"}}
+	s := NewSession(req)
+	act := &Activity{ActivityHdr: model.ActivityHdr{Name: model.Web, Action: "CONNECT"}}
+	s.Add(act)
+	require.True(t, s.Update(func() { act.Decision = model.Allow }))
+	s.Abort(context.Background())
+	require.False(t, s.Update(func() { act.Decision = model.Alert }))
+	require.Equal(t, model.Alert, act.Decision)
+}
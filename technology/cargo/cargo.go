@@ -0,0 +1,103 @@
+package cargo
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/invisirisk/svcs/model"
+	"inivisirisk.com/pse/policy"
+	"inivisirisk.com/pse/session"
+)
+
+// Cargo names the activities of crate downloads and index lookups
+const Cargo model.ActivityName = "cargo"
+
+// Crate download URL patterns:
+//   - https://static.crates.io/crates/{name}/{name}-{version}.crate
+//   - https://crates.io/api/v1/crates/{name}/{version}/download, redirecting
+//     to the above
+//
+// Sparse index files, https://index.crates.io/{prefix}/{name}, are prefixed
+// by the name length: 1/{name}, 2/{name}, 3/{n}/{name} and {na}/{me}/{name}
+// for longer names.
+
+// parse returns the crate and version of a download
+func parse(path string) (string, string, bool) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	n := len(parts)
+	if n >= 3 && parts[n-3] == "crates" && strings.HasSuffix(parts[n-1], ".crate") {
+		name := parts[n-2]
+		file := strings.TrimSuffix(parts[n-1], ".crate")
+		if !strings.HasPrefix(file, name+"-") || len(file) == len(name)+1 {
+			return "", "", false
+		}
+		return name, file[len(name)+1:], true
+	}
+	if n >= 4 && parts[n-4] == "crates" && parts[n-1] == "download" {
+		return parts[n-3], parts[n-2], true
+	}
+	return "", "", false
+}
+
+// indexPrefix is the directory of the index file of name
+func indexPrefix(name string) string {
+	switch len(name) {
+	case 1, 2:
+		return fmt.Sprint(len(name))
+	case 3:
+		return "3/" + name[:1]
+	}
+	return name[:2] + "/" + name[2:4]
+}
+
+// parseIndex returns the crate of a sparse index lookup
+func parseIndex(path string) (string, bool) {
+	path = strings.Trim(path, "/")
+	i := strings.LastIndex(path, "/")
+	if i < 0 {
+		return "", false
+	}
+	name := path[i+1:]
+	if name == "" || !strings.HasSuffix(path[:i], indexPrefix(name)) {
+		return "", false
+	}
+	// the prefix is preceded by the index root, if any
+	if root := strings.TrimSuffix(path[:i], indexPrefix(name)); root != "" && !strings.HasSuffix(root, "/") {
+		return "", false
+	}
+	return name, true
+}
+
+func purl(name, ver string) string {
+	purl := fmt.Sprintf("pkg:%s/%s", Cargo, name)
+	if ver != "" {
+		purl += "@" + ver
+	}
+	return purl
+}
+
+// Handle records crate downloads as get and sparse index lookups as metadata
+func Handle(p *policy.Policy, path string, r *http.Request) *session.Activity {
+	action := "get"
+	name, ver, act := parse(path)
+	if !act {
+		action = "metadata"
+		name, act = parseIndex(path)
+	}
+	if !act {
+		return session.NilActivity
+	}
+	return &session.Activity{
+		ActivityHdr: model.ActivityHdr{
+			Name:   Cargo,
+			Action: action,
+		},
+		Activity: model.PackageActivity{
+			Repo:    r.Host,
+			Package: name,
+			Version: ver,
+			Purl:    purl(name, ver),
+		},
+	}
+}
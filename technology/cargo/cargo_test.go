@@ -0,0 +1,135 @@
+package cargo
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/invisirisk/svcs/model"
+	"github.com/stretchr/testify/assert"
+	"inivisirisk.com/pse/integrity"
+	"inivisirisk.com/pse/policy"
+	"inivisirisk.com/pse/session"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		path string
+		name string
+		ver  string
+		ok   bool
+	}{
+		{"/crates/serde/serde-1.0.197.crate", "serde", "1.0.197", true},
+		{"/crates/serde_json/serde_json-1.0.114.crate", "serde_json", "1.0.114", true},
+		{"/crates/tokio-util/tokio-util-0.7.10-alpha.1.crate", "tokio-util", "0.7.10-alpha.1", true},
+		{"/api/v1/crates/serde/1.0.197/download", "serde", "1.0.197", true},
+		{"/crates/serde/serde_json-1.0.114.crate", "", "", false},
+		{"/crates/serde/serde-.crate", "", "", false},
+		{"/api/v1/crates/serde", "", "", false},
+	}
+	for _, tt := range tests {
+		name, ver, ok := parse(tt.path)
+		assert.Equal(t, tt.ok, ok, tt.path)
+		assert.Equal(t, tt.name, name, tt.path)
+		assert.Equal(t, tt.ver, ver, tt.path)
+	}
+}
+
+func TestParseIndex(t *testing.T) {
+	tests := []struct {
+		path string
+		name string
+		ok   bool
+	}{
+		{"/1/a", "a", true},
+		{"/2/cc", "cc", true},
+		{"/3/s/syn", "syn", true},
+		{"/se/rd/serde", "serde", true},
+		{"/api/v1/cargo/index/se/rd/serde", "serde", true},
+		{"/se/rd/tokio", "", false},
+		{"/3/t/syn", "", false},
+		{"/config.json", "", false},
+		{"/xse/rd/serde", "", false},
+	}
+	for _, tt := range tests {
+		name, ok := parseIndex(tt.path)
+		assert.Equal(t, tt.ok, ok, tt.path)
+		assert.Equal(t, tt.name, name, tt.path)
+	}
+}
+
+func TestHandle(t *testing.T) {
+	p := &policy.Policy{}
+	tests := []struct {
+		host   string
+		path   string
+		action string
+		pkg    string
+		ver    string
+		purl   string
+	}{
+		{"static.crates.io", "/crates/serde/serde-1.0.197.crate", "get", "serde", "1.0.197", "pkg:cargo/serde@1.0.197"},
+		{"crates.io", "/api/v1/crates/serde/1.0.197/download", "get", "serde", "1.0.197", "pkg:cargo/serde@1.0.197"},
+		{"index.crates.io", "/se/rd/serde", "metadata", "serde", "", "pkg:cargo/serde"},
+		{"index.crates.io", "/config.json", "", "", "", ""},
+	}
+	for _, tt := range tests {
+		r := &http.Request{Host: tt.host, URL: &url.URL{Host: tt.host, Path: tt.path}}
+		act := Handle(p, tt.path, r)
+		if tt.action == "" {
+			assert.Equal(t, session.NilActivity, act, tt.path)
+			continue
+		}
+		assert.Equal(t, Cargo, act.Name, tt.path)
+		assert.Equal(t, tt.action, act.Action, tt.path)
+		pact, ok := act.Activity.(model.PackageActivity)
+		assert.True(t, ok, tt.path)
+		assert.Equal(t, tt.host, pact.Repo)
+		assert.Equal(t, tt.pkg, pact.Package)
+		assert.Equal(t, tt.ver, pact.Version)
+		assert.Equal(t, tt.purl, pact.Purl)
+	}
+}
+
+func TestPublished(t *testing.T) {
+	reg := NewRegistry(integrity.NewVersions(1 << 20))
+	index := `{"name":"Serde","vers":"1.0.196","deps":[],"cksum":"870026E60FA08C69F064AA766C10F10B1D62DB9CCD4D0ABB206472BEE0CE3B32","features":{},"yanked":false}
+{"name":"Serde","vers":"1.0.197","deps":[],"cksum":"3fb1c873e1b9b056a4dc4c0c198b24c3ffa059243875552b2bd0933b1aee4ce2","features":{},"yanked":false,"v":2}
+`
+	req, _ := http.NewRequest("GET", "https://index.crates.io/se/rd/serde", nil)
+	digests, err := reg.Published(&http.Response{Request: req}, strings.NewReader(index))
+	assert.NoError(t, err)
+	// the index publishes nothing, the download of a version its cksum
+	assert.Empty(t, digests)
+
+	req, _ = http.NewRequest("GET", "https://static.crates.io/crates/serde/serde-1.0.196.crate", nil)
+	digests, err = reg.Published(&http.Response{Request: req}, strings.NewReader("crate"))
+	assert.NoError(t, err)
+	assert.Len(t, digests, 1)
+	assert.Equal(t, integrity.SHA256, digests[0].Algorithm)
+	assert.Equal(t, "870026e60fa08c69f064aa766c10f10b1d62db9ccd4d0abb206472bee0ce3b32", digests[0].Value)
+	assert.Equal(t, digests[0].Key, reg.Key(req.URL))
+
+	req, _ = http.NewRequest("GET", "https://crates.io/api/v1/crates/serde/1.0.197/download", nil)
+	digests, err = reg.Published(&http.Response{Request: req}, strings.NewReader("crate"))
+	assert.NoError(t, err)
+	assert.Len(t, digests, 1)
+	assert.Equal(t, "3fb1c873e1b9b056a4dc4c0c198b24c3ffa059243875552b2bd0933b1aee4ce2", digests[0].Value)
+	crate, _ := url.Parse("https://static.crates.io/crates/serde/serde-1.0.197.crate")
+	assert.Equal(t, digests[0].Key, reg.Key(crate))
+	assert.Equal(t, digests[0].Key, reg.Key(req.URL))
+
+	req, _ = http.NewRequest("GET", "https://static.crates.io/crates/serde/serde-1.0.198.crate", nil)
+	digests, err = reg.Published(&http.Response{Request: req}, strings.NewReader("crate"))
+	assert.NoError(t, err)
+	assert.Empty(t, digests)
+
+	config, _ := url.Parse("https://index.crates.io/config.json")
+	assert.Empty(t, reg.Key(config))
+
+	req, _ = http.NewRequest("GET", "https://index.crates.io/config.json", nil)
+	digests, err = reg.Published(&http.Response{Request: req}, strings.NewReader(`{"dl":"https://static.crates.io/crates"}`))
+	assert.NoError(t, err)
+	assert.Empty(t, digests)
+}
@@ -0,0 +1,81 @@
+package cargo
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"inivisirisk.com/pse/integrity"
+)
+
+// registry reads the cksum of every version in sparse index files, the
+// SHA-256 of the .crate. They are kept by crate, the download of a .crate
+// publishes the cksum of its version.
+type registry struct {
+	versions *integrity.Versions
+}
+
+// NewRegistry returns the registry keeping the cksums of index files in
+// versions
+func NewRegistry(versions *integrity.Versions) integrity.Registry {
+	return registry{versions: versions}
+}
+
+// key names a crate version by its purl, crates download from another host
+// than the index
+func key(name, ver string) string {
+	return strings.ToLower(purl(name, ver))
+}
+
+// entry is a line of an index file, one per published version
+type entry struct {
+	Name  string `json:"name"`
+	Vers  string `json:"vers"`
+	Cksum string `json:"cksum"`
+}
+
+func (r registry) Published(rsp *http.Response, body io.Reader) ([]integrity.Digest, error) {
+	if name, ver, ok := parse(rsp.Request.URL.Path); ok {
+		return r.versions.Get(name, ver), nil
+	}
+	name, ok := parseIndex(rsp.Request.URL.Path)
+	if !ok {
+		return nil, nil
+	}
+	versions := map[string][]integrity.Digest{}
+	sc := bufio.NewScanner(body)
+	// the metadata of a version lists its dependencies and features
+	sc.Buffer(make([]byte, 64*1024), 4<<20)
+	for sc.Scan() {
+		var e entry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("index line: %w", err)
+		}
+		if e.Name == "" || e.Vers == "" || e.Cksum == "" {
+			continue
+		}
+		versions[e.Vers] = []integrity.Digest{{
+			Key:       key(e.Name, e.Vers),
+			Algorithm: integrity.SHA256,
+			Value:     strings.ToLower(e.Cksum),
+			Source:    "cargo index cksum",
+		}}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	r.versions.Put(name, versions)
+	return nil, nil
+}
+
+func (registry) Key(u *url.URL) string {
+	name, ver, ok := parse(u.Path)
+	if !ok {
+		return ""
+	}
+	return key(name, ver)
+}
@@ -2,6 +2,7 @@ package composer
 
 import (
 	"net/http"
+	"net/url"
 	"strings"
 
 	"github.com/invisirisk/clog"
@@ -14,66 +15,91 @@ var (
 	baseLogger = clog.NewCLog("base")
 )
 
+// parse returns the package of a metadata request, /p2/<vendor>/<name>.json
+// of Composer 2 and /p/<vendor>/<name>$<hash>.json of Composer 1. Repository
+// indexes such as packages.json name none.
 func parse(urlPath string) string {
-	baseLogger.Infof("Parsing URL: %v", urlPath)
-	parts := strings.Split(urlPath, "/")
-	baseLogger.Infof("Parts: %v", parts)
-	if len(parts) < 4 {
+	parts := strings.Split(strings.TrimPrefix(urlPath, "/"), "/")
+	if len(parts) < 3 {
 		return ""
 	}
-	packageName := parts[2] + "/" + parts[3]
-	return packageName
+	parts = parts[len(parts)-3:]
+	if parts[0] != "p2" && parts[0] != "p" {
+		return ""
+	}
+	name := strings.TrimSuffix(parts[2], ".json")
+	// dev versions are listed apart, Composer 1 names carry a hash
+	name = strings.TrimSuffix(name, "~dev")
+	if i := strings.Index(name, "$"); i >= 0 {
+		name = name[:i]
+	}
+	if parts[1] == "" || name == "" {
+		return ""
+	}
+	return strings.ToLower(parts[1] + "/" + name)
 }
 
-func Handle(p *policy.Policy, r *http.Request, sess *session.Session) *session.Activity {
+func activity(action, repo string, d Dist) *session.Activity {
+	purl := ""
+	if d.Package != "" {
+		purl = purlOf(d.Package, d.Version)
+	}
+	return &session.Activity{
+		ActivityHdr: model.ActivityHdr{
+			Name:   model.Composer,
+			Action: action,
+		},
+		Activity: model.PackageActivity{
+			Repo:    repo,
+			Package: d.Package,
+			Version: d.Version,
+			Purl:    purl,
+		},
+	}
+}
 
-	if r==nil || sess==nil {
-		baseLogger.Errorf("Request or session is nil")
+// Handle records repository metadata requests as metadata and dist downloads
+// as get. Downloads are attributed through the dist URLs and references of
+// the metadata read by the Metadata chain, GitHub archives Composer fetches
+// without it, installing from a lock file, fall back to the repository name.
+func Handle(p *policy.Policy, dists *Store, path string, r *http.Request) *session.Activity {
+	if r == nil || r.URL == nil {
+		baseLogger.Errorf("request is nil")
 		return session.NilActivity
 	}
-	baseLogger.Infof("Patterns: %v", r.URL.Path)
-	if r.Host != "repo.packagist.org" && r.Host != "codeload.github.com" {
-		return session.NilActivity
+	u := *r.URL
+	if u.Host == "" {
+		u.Host = r.Host
+	}
+	if strings.HasSuffix(path, ".json") {
+		return activity("metadata", r.Host, Dist{Package: parse(path)})
 	}
-	if r.Host == "codeload.github.com" {
-		baseLogger.Infof("Package name map: %v", sess.PackageNameMap)
-		value, exists := sess.PackageNameMap[strings.ToLower(strings.Split(strings.Split(r.URL.Path, "/")[2], ".")[0])]
-		baseLogger.Infof("Value exists in package name map: %v", value)
-		// adds package name to session activity object if it exists in PackageNameMap
-		if !exists {
-			return &session.Activity{
-				ActivityHdr: model.ActivityHdr{
-					Name:   model.Composer,
-					Action: "get",
-				},
-				Activity: model.PackageActivity{
-					Repo: r.Host,
-				},
-			}
-		} else {
-			return &session.Activity{
-				ActivityHdr: model.ActivityHdr{
-					Name:   model.Composer,
-					Action: "get",
-				},
-				Activity: model.PackageActivity{
-					Repo:    r.Host,
-					Package: value,
-				},
-			}
+	if dists != nil {
+		if d, ok := dists.Get(&u); ok {
+			return activity("get", r.Host, d)
 		}
 	}
+	if owner, repo, _, ok := github(&u); ok && strings.HasPrefix(r.UserAgent(), "Composer") {
+		return activity("get", r.Host, Dist{Package: strings.ToLower(owner + "/" + repo)})
+	}
+	return session.NilActivity
+}
 
-	if r.Host == "repo.packagist.org" && r.URL.Path != "/downloads/" {
-		// store package name in separate object so that it could be retrieved later
-		PackageName := parse(r.URL.Path)
-		if PackageName != "" {
-			// add the last part of package name to packageNameMap, example abc\xyz (stores xyz)
-			sanitizedPackageName := strings.ToLower(strings.Split(PackageName, ".json")[0])
-			name := strings.Split(sanitizedPackageName, "/")[1]
-			sess.PackageNameMap[name] = sanitizedPackageName
+// github returns the repository and reference of a GitHub archive, the
+// zipball API Packagist lists as dist URL or the codeload URL it redirects to
+func github(u *url.URL) (owner, repo, ref string, ok bool) {
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	switch strings.ToLower(u.Host) {
+	case "api.github.com":
+		// /repos/<owner>/<repo>/zipball/<ref>
+		if len(parts) == 5 && parts[0] == "repos" && parts[3] == "zipball" {
+			return parts[1], parts[2], parts[4], true
+		}
+	case "codeload.github.com":
+		// /<owner>/<repo>/legacy.zip/<ref>
+		if len(parts) == 4 && parts[2] == "legacy.zip" {
+			return parts[0], parts[1], parts[3], true
 		}
-		return session.NilActivity
 	}
-	return session.NilActivity
+	return "", "", "", false
 }
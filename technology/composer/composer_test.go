@@ -1,153 +1,103 @@
 package composer
 
 import (
+	"context"
 	"net/http"
-	"net/url"
+	"strings"
 	"testing"
 
+	"github.com/invisirisk/svcs/model"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"inivisirisk.com/pse/policy"
 	"inivisirisk.com/pse/session"
+	"inivisirisk.com/pse/utils"
 )
 
-// Handle request from repo.packagist.org with valid package path
-func TestHandlePackagistRequestWithValidPath(t *testing.T) {
-    // Setup
-    req, err := http.NewRequest("GET", "https://repo.packagist.org/p/vendor/package.json", nil)
-    if err != nil {
-        t.Fatal(err)
-    }
-
-    policy := &policy.Policy{}
-    sess := &session.Session{
-        PackageNameMap: make(map[string]string),
-    }
-
-    // Execute
-    activity := Handle(policy, req, sess)
-
-    // Verify
-    assert.Equal(t, session.NilActivity, activity)
-    assert.Equal(t, "vendor/package", sess.PackageNameMap["package"])
+// p2/monolog/monolog.json as served by repo.packagist.org, minified
+const p2 = `{"packages":{"monolog/monolog":[
+{"name":"monolog/monolog","version":"3.5.0","version_normalized":"3.5.0.0","dist":{"type":"zip","url":"https://api.github.com/repos/Seldaek/monolog/zipball/c915e2634718dbc8a4a15c61b0e62e7a44e14448","reference":"c915e2634718dbc8a4a15c61b0e62e7a44e14448","shasum":""}},
+{"version":"3.4.0","version_normalized":"3.4.0.0","dist":{"type":"zip","url":"https://api.github.com/repos/Seldaek/monolog/zipball/e2392369686d420ca32df3803de28b5d6f76867d","reference":"e2392369686d420ca32df3803de28b5d6f76867d","shasum":""}},
+{"version":"1.0.0","dist":"__unset"}
+]},"minified":"composer/2.0"}`
+
+// packages.json of a Satis repository
+const satis = `{"packages":{"acme/internal":{"1.2.0":{"name":"acme/internal","version":"1.2.0","dist":{"type":"zip","url":"dist/acme-internal-1.2.0-3f2c1d.zip","reference":"3f2c1d"}}}}}`
+
+func TestParse(t *testing.T) {
+	for path, want := range map[string]string{
+		"/p2/monolog/monolog.json":             "monolog/monolog",
+		"/p2/symfony/console~dev.json":         "symfony/console",
+		"/p/Vendor/Package$0a1b2c.json":        "vendor/package",
+		"/acme/p2/acme/internal.json":          "acme/internal",
+		"/packages.json":                       "",
+		"/downloads/":                          "",
+		"/include/all$5f4dcc3b5aa765d61d.json": "",
+	} {
+		assert.Equal(t, want, parse(path), path)
+	}
 }
 
-    // Handle request from unsupported hosts
-func TestHandleUnsupportedHost(t *testing.T) {
-    // Setup
-    req, err := http.NewRequest("GET", "https://unsupported.host/some/path", nil)
-    if err != nil {
-        t.Fatal(err)
-    }
-
-    policy := &policy.Policy{}
-    sess := &session.Session{
-        PackageNameMap: make(map[string]string),
-    }
-
-    // Execute
-    activity := Handle(policy, req, sess)
-
-    // Verify
-    assert.Equal(t, session.NilActivity, activity)
-    assert.Empty(t, sess.PackageNameMap)
+func read(t *testing.T, dists *Store, u, body string) {
+	req, _ := http.NewRequest("GET", u, nil)
+	act := Handle(nil, dists, req.URL.Path, req)
+	require.Equal(t, "metadata", act.Action)
+	ctx := context.WithValue(context.Background(), utils.ActCtxKey, act)
+	m := &Metadata{Response: &http.Response{StatusCode: http.StatusOK, Request: req, Header: http.Header{}}, Dists: dists}
+	require.NoError(t, m.Handle(ctx, strings.NewReader(body)))
 }
 
-
-
-    // Store sanitized package name in session PackageNameMap for packagist requests
-func TestStoreSanitizedPackageNameInSession(t *testing.T) {
-    p := &policy.Policy{}
-    r := &http.Request{
-        Host: "repo.packagist.org",
-        URL:  &url.URL{Path: "/downloads/package/name"},
-    }
-    sess := &session.Session{
-        PackageNameMap: make(map[string]string),
-    }
-    
-    Handle(p, r, sess)
-    
-    expectedPackageName := "name"
-    if sess.PackageNameMap[expectedPackageName] != "package/name" {
-        t.Errorf("Expected package name %v, got %v", "package/name", sess.PackageNameMap[expectedPackageName])
-    }
-}
-
-    // Parse URL path with less than 3 parts
-func TestParseURLPathWithLessThanThreeParts(t *testing.T) {
-    urlPath := "/short/path"
-    
-    result := parse(urlPath)
-    
-    if result != "" {
-        t.Errorf("Expected empty string, got %v", result)
-    }
-}
-
-    // Handle empty URL path
-func TestHandleEmptyURLPath(t *testing.T) {
-    p := &policy.Policy{}
-    r := &http.Request{
-        Host: "repo.packagist.org",
-        URL:  &url.URL{Path: ""},
-    }
-    sess := &session.Session{
-        PackageNameMap: make(map[string]string),
-    }
-    
-    activity := Handle(p, r, sess)
-    
-    if activity != session.NilActivity {
-        t.Errorf("Expected NilActivity, got %v", activity)
-    }
+func get(dists *Store, u, agent string) *session.Activity {
+	req, _ := http.NewRequest("GET", u, nil)
+	req.Header.Set("User-Agent", agent)
+	return Handle(nil, dists, req.URL.Path, req)
 }
 
-    // Handle malformed package names in URL
-func TestHandleMalformedPackageNames(t *testing.T) {
-    p := &policy.Policy{}
-    r := &http.Request{
-        Host: "repo.packagist.org",
-        URL:  &url.URL{Path: "/malformed/package/name"},
-    }
-    sess := &session.Session{
-        PackageNameMap: make(map[string]string),
-    }
-    
-    activity := Handle(p, r, sess)
-    
-    if activity != session.NilActivity {
-        t.Errorf("Expected NilActivity, got %v", activity)
-    }
+func TestHandle(t *testing.T) {
+	dists := NewStore(16)
+	read(t, dists, "https://repo.packagist.org/p2/monolog/monolog.json", p2)
+
+	// the zipball API redirects to codeload
+	act := get(dists, "https://codeload.github.com/Seldaek/monolog/legacy.zip/e2392369686d420ca32df3803de28b5d6f76867d", "curl/8.0")
+	require.Equal(t, "get", act.Action)
+	assert.Equal(t, model.PackageActivity{
+		Repo:    "codeload.github.com",
+		Package: "monolog/monolog",
+		Version: "3.4.0",
+		Purl:    "pkg:composer/monolog/monolog@3.4.0",
+	}, act.Activity)
+
+	act = get(dists, "https://api.github.com/repos/seldaek/monolog/zipball/c915e2634718dbc8a4a15c61b0e62e7a44e14448", "curl/8.0")
+	assert.Equal(t, "3.5.0", act.Activity.(model.PackageActivity).Version)
+
+	// a version removed from minified metadata lists no dist
+	assert.Equal(t, 2, dists.dists.Len())
+
+	// archives of other references are not attributed to a version
+	act = get(dists, "https://codeload.github.com/Seldaek/monolog/legacy.zip/0000000000000000000000000000000000000000", "Composer/2.6.5 (Linux)")
+	assert.Equal(t, model.PackageActivity{Repo: "codeload.github.com", Package: "seldaek/monolog", Purl: "pkg:composer/seldaek/monolog"}, act.Activity)
+	assert.Equal(t, session.NilActivity, get(dists, "https://codeload.github.com/Seldaek/monolog/legacy.zip/0000000000000000000000000000000000000000", "curl/8.0"))
+
+	// Satis dist URLs are relative to the repository
+	read(t, dists, "https://satis.example.com/packages.json", satis)
+	act = get(dists, "https://satis.example.com/dist/acme-internal-1.2.0-3f2c1d.zip", "Composer/2.6.5 (Linux)")
+	assert.Equal(t, "pkg:composer/acme/internal@1.2.0", act.Activity.(model.PackageActivity).Purl)
 }
 
-    // Handle request with empty host
-func TestHandleRequestWithEmptyHost(t *testing.T) {
-    p := &policy.Policy{}
-    r := &http.Request{
-        Host: "",
-        URL:  &url.URL{Path: "/some/path"},
-    }
-    sess := &session.Session{
-        PackageNameMap: make(map[string]string),
-    }
-    
-    activity := Handle(p, r, sess)
-    
-    if activity != session.NilActivity {
-        t.Errorf("Expected NilActivity, got %v", activity)
-    }
+func TestHandleNilRequest(t *testing.T) {
+	assert.Equal(t, session.NilActivity, Handle(&policy.Policy{}, NewStore(1), "", nil))
 }
 
-    // Handle nil policy, request or session parameters
-func TestHandleNilParameters(t *testing.T) {
-    var p *policy.Policy = nil
-    var r *http.Request = nil
-    sess := &session.Session{
-        PackageNameMap: make(map[string]string),
-    }
-    activity := Handle(p, r, sess)
-    
-    if activity != session.NilActivity {
-        t.Errorf("Expected NilActivity, got %v", activity)
-    }
+func TestStore(t *testing.T) {
+	s := NewStore(1)
+	req, _ := http.NewRequest("GET", "https://repo.example.com/dists/a/b/1.0.0/ref.zip", nil)
+	s.Put(req.URL, Dist{Package: "a/b", Version: "1.0.0"})
+	d, ok := s.Get(req.URL)
+	require.True(t, ok)
+	assert.Equal(t, "1.0.0", d.Version)
+
+	other, _ := http.NewRequest("GET", "https://repo.example.com/dists/c/d/1.0.0/ref.zip", nil)
+	s.Put(other.URL, Dist{Package: "c/d", Version: "1.0.0"})
+	_, ok = s.Get(req.URL)
+	assert.False(t, ok)
 }
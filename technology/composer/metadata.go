@@ -0,0 +1,176 @@
+package composer
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/invisirisk/svcs/model"
+	"inivisirisk.com/pse/integrity"
+	"inivisirisk.com/pse/session"
+	"inivisirisk.com/pse/utils"
+)
+
+const (
+	// maxMetadata bounds the metadata read, Satis indexes list every package
+	maxMetadata = 64 << 20
+	// unset marks a field removed from the previous version in minified
+	// metadata
+	unset = `"__unset"`
+)
+
+// Dist is the package version a dist URL serves
+type Dist struct {
+	Package string
+	Version string
+}
+
+func purlOf(pkg, ver string) string {
+	purl := fmt.Sprintf("pkg:%s/%s", model.Composer, pkg)
+	if ver != "" {
+		purl += "@" + ver
+	}
+	return purl
+}
+
+type version struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Dist    struct {
+		URL string `json:"url"`
+	} `json:"dist"`
+}
+
+// document is a repository metadata file. Packages list their versions in an
+// array in Composer 2 metadata, minified so that each version only holds the
+// fields changed from the one before, and in a map by version in Composer 1
+// and Satis metadata.
+type document struct {
+	Packages map[string]json.RawMessage `json:"packages"`
+	Minified string                     `json:"minified"`
+}
+
+// expand restores the fields minified metadata leaves out
+func expand(versions []map[string]json.RawMessage) {
+	for i := 1; i < len(versions); i++ {
+		full := make(map[string]json.RawMessage, len(versions[i-1]))
+		for k, v := range versions[i-1] {
+			full[k] = v
+		}
+		for k, v := range versions[i] {
+			if string(v) == unset {
+				delete(full, k)
+			} else {
+				full[k] = v
+			}
+		}
+		versions[i] = full
+	}
+}
+
+// dists returns the dist URLs listed in metadata with the versions they serve
+func dists(body io.Reader) (map[string]Dist, error) {
+	var doc document
+	if err := json.NewDecoder(body).Decode(&doc); err != nil {
+		return nil, err
+	}
+	found := make(map[string]Dist)
+	for name, raw := range doc.Packages {
+		var versions []map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &versions); err == nil {
+			if doc.Minified != "" {
+				expand(versions)
+			}
+		} else {
+			var byVersion map[string]map[string]json.RawMessage
+			if err := json.Unmarshal(raw, &byVersion); err != nil {
+				continue
+			}
+			for _, v := range byVersion {
+				versions = append(versions, v)
+			}
+		}
+		for _, fields := range versions {
+			data, _ := json.Marshal(fields)
+			var v version
+			if err := json.Unmarshal(data, &v); err != nil || v.Dist.URL == "" {
+				continue
+			}
+			if v.Name == "" {
+				v.Name = name
+			}
+			found[v.Dist.URL] = Dist{Package: strings.ToLower(v.Name), Version: v.Version}
+		}
+	}
+	return found, nil
+}
+
+// Metadata records the dist URLs of the repository metadata read by Composer
+// metadata activities
+type Metadata struct {
+	Response *http.Response
+	Dists    *Store
+}
+
+func (m *Metadata) Handle(ctx context.Context, r io.Reader) error {
+	act, ok := ctx.Value(utils.ActCtxKey).(*session.Activity)
+	if !ok || act.Name != model.Composer || act.Action != "metadata" {
+		return nil
+	}
+	if m.Dists == nil || m.Response == nil || m.Response.StatusCode != http.StatusOK {
+		return nil
+	}
+	r = io.LimitReader(r, maxMetadata)
+	if m.Response.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil
+		}
+		defer zr.Close()
+		r = zr
+	}
+	found, err := dists(r)
+	if err != nil {
+		return fmt.Errorf("reading composer metadata: %w", err)
+	}
+	for ref, d := range found {
+		// dist URLs are absolute but may be relative to the repository
+		u, err := m.Response.Request.URL.Parse(ref)
+		if err != nil {
+			continue
+		}
+		m.Dists.Put(u, d)
+	}
+	return nil
+}
+
+// Store is a fixed size LRU of the versions served by dist URLs. GitHub
+// archives are keyed by repository and reference as Composer downloads them
+// from codeload rather than from the API URL listed.
+type Store struct {
+	dists *utils.LRU[string, Dist]
+}
+
+func NewStore(size int) *Store {
+	return &Store{dists: utils.NewLRU[string, Dist](size)}
+}
+
+func key(u *url.URL) string {
+	if owner, repo, ref, ok := github(u); ok {
+		return strings.ToLower("github.com/"+owner+"/"+repo) + "@" + ref
+	}
+	return integrity.URLKey(u)
+}
+
+func (s *Store) Put(u *url.URL, d Dist) {
+	s.dists.Put(key(u), d)
+}
+
+func (s *Store) Get(u *url.URL) (Dist, bool) {
+	return s.dists.Get(key(u))
+}
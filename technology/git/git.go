@@ -1,7 +1,11 @@
 package git
 
 import (
+	"bytes"
+	"compress/gzip"
+	"io"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/invisirisk/svcs/model"
@@ -9,35 +13,131 @@ import (
 	"inivisirisk.com/pse/session"
 )
 
-func Handle(p *policy.Policy, path string, r *http.Request) *session.Activity {
-	parts := strings.SplitN(path, "/", 4)
-	if len(parts) >= 4 {
-		repo := strings.Join([]string{r.Host, parts[1], parts[2]}, "/")
-		// identity git action based on request query param
-		queryParams := r.URL.Query()
-		service_query := queryParams.Get("service")
+const (
+	// maxRequest bounds the request body inspected, a fetch negotiating many
+	// haves runs to a few hundred KiB
+	maxRequest = 1 << 20
+)
 
-		action := ""
-		switch {
-		case parts[3] == "git-upload-pack" || service_query == "git-upload-pack":
-			action = "pull"
-		case parts[3] == "git-receive-pack" || service_query == "git-receive-pack":
-			action = "push"
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// protocol returns the protocol version asked for in the Git-Protocol header
+func protocol(r *http.Request) int {
+	for _, param := range strings.Split(r.Header.Get("Git-Protocol"), ":") {
+		if v := strings.TrimPrefix(param, "version="); v != param {
+			n, _ := strconv.Atoi(v)
+			return n
+		}
+	}
+	return 0
+}
+
+// inspect parses the start of the request body, which is put back for the
+// upstream request
+func inspect(r *http.Request, parse func(io.Reader)) {
+	if r.Body == nil || r.Body == http.NoBody {
+		parse(strings.NewReader(""))
+		return
+	}
+	body := r.Body
+	var buf bytes.Buffer
+	tee := io.TeeReader(io.LimitReader(body, maxRequest), &buf)
+	var in io.Reader = tee
+	// git compresses large fetch requests
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(tee)
+		if err != nil {
+			in = strings.NewReader("")
+		} else {
+			defer zr.Close()
+			in = zr
 		}
+	}
+	parse(in)
+	r.Body = readCloser{io.MultiReader(&buf, body), body}
+}
 
-		repo = strings.TrimSuffix(repo, ".git")
-		if action != "" {
-			return &model.Activity{
-				ActivityHdr: model.ActivityHdr{
-					Name:   model.Git,
-					Action: action,
-				},
-				Activity: model.GitActivity{
-					Repo: repo,
-				},
+// repoPath splits a smart HTTP path into the repository and the endpoint
+// following it. The repository ends with its .git suffix, which hosts accept
+// left out, or before info/refs and the service endpoints, which keeps GitLab
+// subgroups, Azure DevOps <org>/<project>/_git/<repo> and Bitbucket Server
+// scm/<project>/<repo> paths whole.
+func repoPath(path string) (repo, endpoint string, ok bool) {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for i, s := range segments {
+		switch {
+		case strings.HasSuffix(s, ".git") && s != ".git":
+			repo = strings.Join(segments[:i+1], "/")
+			return strings.TrimSuffix(repo, ".git"), strings.Join(segments[i+1:], "/"), true
+		case s == "info" && i+1 < len(segments) && segments[i+1] == "refs",
+			s == "git-upload-pack", s == "git-receive-pack":
+			if i == 0 {
+				return "", "", false
 			}
+			return strings.Join(segments[:i], "/"), strings.Join(segments[i:], "/"), true
 		}
+	}
+	return "", "", false
+}
+
+// Handle records fetches as pull and pushes as push. The smart HTTP
+// requests are parsed for the operation, the commits and refs fetched and the
+// refs pushed, wanted commits are named by the refs last advertised for them.
+func Handle(p *policy.Policy, refs *Store, path string, r *http.Request) *session.Activity {
+	// identity git action based on request query param
+	service := r.URL.Query().Get("service")
+	repo, endpoint, ok := repoPath(path)
+	if !ok && service != "" {
+		// the service names the endpoint
+		if i := strings.LastIndex(strings.Trim(path, "/"), "/"); i > 0 {
+			repo, ok = strings.Trim(path, "/")[:i], true
+		}
+	}
+	if !ok {
+		return session.NilActivity
+	}
+	repo = r.Host + "/" + repo
 
+	action := ""
+	switch {
+	case endpoint == "git-upload-pack" || service == "git-upload-pack":
+		action = "pull"
+	case endpoint == "git-receive-pack" || service == "git-receive-pack":
+		action = "push"
+	default:
+		return session.NilActivity
+	}
+
+	act := session.GitActivity{
+		GitActivity: model.GitActivity{Repo: repo},
+		Protocol:    protocol(r),
+	}
+	switch {
+	case service == "git-upload-pack":
+		act.Operation = "ls-remote"
+	case service != "":
+		act.Operation = "push"
+	case action == "pull":
+		inspect(r, func(body io.Reader) { parseUploadPack(body, &act) })
+		if refs != nil {
+			advertised := refs.Get(repo)
+			for i, want := range act.Wants {
+				if want.SHA != "" {
+					act.Wants[i].Refs = advertised[want.SHA]
+				}
+			}
+		}
+	default:
+		inspect(r, func(body io.Reader) { parseReceivePack(body, &act) })
+	}
+	return &model.Activity{
+		ActivityHdr: model.ActivityHdr{
+			Name:   model.Git,
+			Action: action,
+		},
+		Activity: act,
 	}
-	return session.NilActivity
 }
@@ -0,0 +1,161 @@
+package git
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"inivisirisk.com/pse/session"
+)
+
+const (
+	// special packets, a flush ends a section, protocol v2 delimits the
+	// arguments of a command and ends a response on stateless connections
+	flushPkt       = "0000"
+	delimPkt       = "0001"
+	responseEndPkt = "0002"
+
+	zeroID = "0000000000000000000000000000000000000000"
+)
+
+var (
+	errFlush = errors.New("flush packet")
+
+	// object ids are SHA-1 or, in sha256 repositories, SHA-256
+	refPattern = regexp.MustCompile(`^([0-9a-f]{40}|[0-9a-f]{64}) ([^ ]+)`)
+)
+
+// pktReader reads the pkt-lines of the smart protocol, each prefixed by its
+// length in four hex digits
+type pktReader struct {
+	r *bufio.Reader
+}
+
+func newPktReader(r io.Reader) *pktReader {
+	return &pktReader{r: bufio.NewReader(r)}
+}
+
+// next returns the payload of the next line without its newline, errFlush
+// for a flush and "" for the other special packets
+func (p *pktReader) next() (string, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(p.r, size[:]); err != nil {
+		return "", err
+	}
+	switch string(size[:]) {
+	case flushPkt:
+		return "", errFlush
+	case delimPkt, responseEndPkt:
+		return "", nil
+	}
+	n, err := strconv.ParseUint(string(size[:]), 16, 16)
+	if err != nil || n < 4 {
+		return "", fmt.Errorf("invalid pkt-line length %q", size)
+	}
+	payload := make([]byte, n-4)
+	if _, err := io.ReadFull(p.r, payload); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(payload), "\n"), nil
+}
+
+// parseUploadPack reads the request of a fetch, the wants, shallow state and
+// haves of protocol v0 and the fetch or ls-refs command of protocol v2
+func parseUploadPack(r io.Reader, act *session.GitActivity) {
+	pr := newPktReader(r)
+	act.Operation = "clone"
+	for {
+		line, err := pr.next()
+		if err == errFlush {
+			continue
+		}
+		if err != nil {
+			break
+		}
+		// capabilities follow the first want of protocol v0
+		line, _, _ = strings.Cut(line, "\x00")
+		key, value, _ := strings.Cut(line, " ")
+		switch key {
+		case "command=ls-refs":
+			act.Operation = "ls-remote"
+			act.Protocol = 2
+		case "command=fetch":
+			act.Protocol = 2
+		case "ref-prefix":
+			act.RefPrefixes = append(act.RefPrefixes, value)
+		case "want":
+			sha, _, _ := strings.Cut(value, " ")
+			act.Wants = append(act.Wants, session.GitRef{SHA: sha})
+		case "want-ref":
+			act.Wants = append(act.Wants, session.GitRef{Refs: []string{value}})
+		case "have":
+			act.Haves++
+		case "shallow":
+			act.Shallow = true
+		case "deepen":
+			act.Depth, _ = strconv.Atoi(value)
+		case "deepen-since", "deepen-not":
+			act.Shallow = true
+		}
+	}
+	if act.Operation != "ls-remote" && act.Haves > 0 {
+		act.Operation = "fetch"
+	}
+	if act.Depth > 0 {
+		act.Shallow = true
+	}
+}
+
+// parseReceivePack reads the ref updates a push starts with, the pack follows
+// them
+func parseReceivePack(r io.Reader, act *session.GitActivity) {
+	pr := newPktReader(r)
+	act.Operation = "push"
+	for {
+		line, err := pr.next()
+		if err != nil {
+			return
+		}
+		line, _, _ = strings.Cut(line, "\x00")
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+		act.Updates = append(act.Updates, session.GitRefUpdate{Old: fields[0], New: fields[1], Ref: fields[2]})
+	}
+}
+
+// parseRefs reads a ref advertisement, or the response to a protocol v2
+// ls-refs, into the refs pointing at each commit
+func parseRefs(r io.Reader) map[string][]string {
+	refs := make(map[string][]string)
+	pr := newPktReader(r)
+	for {
+		line, err := pr.next()
+		if err == errFlush {
+			continue
+		}
+		if err != nil {
+			return refs
+		}
+		// capabilities follow the first ref of protocol v0
+		line, _, _ = strings.Cut(line, "\x00")
+		m := refPattern.FindStringSubmatch(line)
+		if m == nil || m[1] == zeroID {
+			continue
+		}
+		// annotated tags are followed by the commit they peel to, protocol v2
+		// lists it as an attribute
+		name := strings.TrimSuffix(m[2], "^{}")
+		refs[m[1]] = append(refs[m[1]], name)
+		for _, attr := range strings.Fields(line[len(m[0]):]) {
+			if peeled := strings.TrimPrefix(attr, "peeled:"); peeled != attr {
+				refs[peeled] = append(refs[peeled], name)
+			}
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package git
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"inivisirisk.com/pse/session"
+	"inivisirisk.com/pse/utils"
+)
+
+const (
+	mainSHA = "8f2d3c4b5a69788796a5b4c3d2e1f00112233445"
+	tagSHA  = "1111111111111111111111111111111111111111"
+	peelSHA = "2222222222222222222222222222222222222222"
+	oldSHA  = "3333333333333333333333333333333333333333"
+)
+
+// pkt encodes lines as pkt-lines, "0000" and "0001" are written as is
+func pkt(lines ...string) string {
+	var b strings.Builder
+	for _, line := range lines {
+		if line == flushPkt || line == delimPkt {
+			b.WriteString(line)
+			continue
+		}
+		fmt.Fprintf(&b, "%04x%s", len(line)+4, line)
+	}
+	return b.String()
+}
+
+func advertisement() string {
+	return pkt("# service=git-upload-pack\n", flushPkt,
+		mainSHA+" HEAD\x00multi_ack side-band-64k symref=HEAD:refs/heads/main\n",
+		mainSHA+" refs/heads/main\n",
+		tagSHA+" refs/tags/v1.0.0\n",
+		peelSHA+" refs/tags/v1.0.0^{}\n",
+		flushPkt)
+}
+
+func TestParseRefs(t *testing.T) {
+	refs := parseRefs(strings.NewReader(advertisement()))
+	assert.Equal(t, map[string][]string{
+		mainSHA: {"HEAD", "refs/heads/main"},
+		tagSHA:  {"refs/tags/v1.0.0"},
+		peelSHA: {"refs/tags/v1.0.0"},
+	}, refs)
+
+	// protocol v2 ls-refs
+	refs = parseRefs(strings.NewReader(pkt(mainSHA+" HEAD symref-target:refs/heads/main\n", tagSHA+" refs/tags/v1.0.0 peeled:"+peelSHA+"\n", flushPkt)))
+	assert.Equal(t, []string{"refs/tags/v1.0.0"}, refs[peelSHA])
+	assert.Equal(t, []string{"HEAD"}, refs[mainSHA])
+}
+
+func request(t *testing.T, refs *Store, path, body string, header http.Header) (*session.GitActivity, *http.Request) {
+	req, err := http.NewRequest("POST", "https://github.com"+path, strings.NewReader(body))
+	require.NoError(t, err)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	act := Handle(nil, refs, path, req)
+	require.NotEqual(t, session.NilActivity, act)
+	gact := act.Activity.(session.GitActivity)
+	return &gact, req
+}
+
+func TestUploadPack(t *testing.T) {
+	refs := NewStore(4)
+	req, _ := http.NewRequest("GET", "https://github.com/owner/repo.git/info/refs?service=git-upload-pack", nil)
+	act := Handle(nil, refs, "/owner/repo.git/info/refs", req)
+	ctx := context.WithValue(context.Background(), utils.ActCtxKey, act)
+	adv := &Advertisement{Response: &http.Response{StatusCode: http.StatusOK, Header: http.Header{}}, Refs: refs}
+	require.NoError(t, adv.Handle(ctx, strings.NewReader(advertisement())))
+
+	// a shallow clone of the branch and the tag
+	gact, _ := request(t, refs, "/owner/repo.git/git-upload-pack",
+		pkt("want "+mainSHA+" multi_ack side-band-64k\n", "want "+peelSHA+"\n", "deepen 1\n", flushPkt, "done\n"), nil)
+	assert.Equal(t, "clone", gact.Operation)
+	assert.Equal(t, "github.com/owner/repo", gact.Repo)
+	assert.Equal(t, []session.GitRef{
+		{SHA: mainSHA, Refs: []string{"HEAD", "refs/heads/main"}},
+		{SHA: peelSHA, Refs: []string{"refs/tags/v1.0.0"}},
+	}, gact.Wants)
+	assert.True(t, gact.Shallow)
+	assert.Equal(t, 1, gact.Depth)
+
+	gact, _ = request(t, refs, "/owner/repo.git/git-upload-pack",
+		pkt("want "+mainSHA+"\n", flushPkt, "have "+oldSHA+"\n", "done\n"), nil)
+	assert.Equal(t, "fetch", gact.Operation)
+	assert.Equal(t, 1, gact.Haves)
+	assert.False(t, gact.Shallow)
+}
+
+func TestUploadPackV2(t *testing.T) {
+	v2 := http.Header{"Git-Protocol": {"version=2"}}
+	gact, _ := request(t, nil, "/owner/repo/git-upload-pack",
+		pkt("command=ls-refs\n", "agent=git/2.43.0\n", delimPkt, "peel\n", "ref-prefix HEAD\n", "ref-prefix refs/heads/\n", flushPkt), v2)
+	assert.Equal(t, "ls-remote", gact.Operation)
+	assert.Equal(t, 2, gact.Protocol)
+	assert.Equal(t, []string{"HEAD", "refs/heads/"}, gact.RefPrefixes)
+
+	var body bytes.Buffer
+	zw := gzip.NewWriter(&body)
+	zw.Write([]byte(pkt("command=fetch\n", delimPkt, "want-ref refs/heads/main\n", "have "+oldSHA+"\n", "done\n", flushPkt)))
+	zw.Close()
+	sent := body.String()
+	gact, req := request(t, nil, "/owner/repo/git-upload-pack", sent, http.Header{"Git-Protocol": {"version=2"}, "Content-Encoding": {"gzip"}})
+	assert.Equal(t, "fetch", gact.Operation)
+	assert.Equal(t, []session.GitRef{{Refs: []string{"refs/heads/main"}}}, gact.Wants)
+
+	// the body is forwarded as received
+	forwarded, err := io.ReadAll(req.Body)
+	require.NoError(t, err)
+	assert.Equal(t, sent, string(forwarded))
+}
+
+func TestReceivePack(t *testing.T) {
+	body := pkt(oldSHA+" "+mainSHA+" refs/heads/main\x00report-status side-band-64k\n", zeroID+" "+tagSHA+" refs/tags/v2\n", flushPkt) + "PACK\x00\x00\x00\x02"
+	gact, req := request(t, nil, "/owner/repo.git/git-receive-pack", body, nil)
+	assert.Equal(t, "push", gact.Operation)
+	assert.Equal(t, []session.GitRefUpdate{
+		{Ref: "refs/heads/main", Old: oldSHA, New: mainSHA},
+		{Ref: "refs/tags/v2", Old: zeroID, New: tagSHA},
+	}, gact.Updates)
+	forwarded, err := io.ReadAll(req.Body)
+	require.NoError(t, err)
+	assert.Equal(t, body, string(forwarded))
+}
@@ -0,0 +1,69 @@
+package git
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/invisirisk/svcs/model"
+	"inivisirisk.com/pse/session"
+	"inivisirisk.com/pse/utils"
+)
+
+// Advertisement records the refs listed to ls-remote activities, the ref
+// advertisement of protocol v0 and the ls-refs response of protocol v2
+type Advertisement struct {
+	Response *http.Response
+	Refs     *Store
+}
+
+func (a *Advertisement) Handle(ctx context.Context, r io.Reader) error {
+	act, ok := ctx.Value(utils.ActCtxKey).(*session.Activity)
+	if !ok || act.Name != model.Git {
+		return nil
+	}
+	gact, ok := act.Activity.(session.GitActivity)
+	if !ok || gact.Operation != "ls-remote" {
+		return nil
+	}
+	if a.Refs == nil || a.Response == nil || a.Response.StatusCode != http.StatusOK {
+		return nil
+	}
+	if a.Response.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil
+		}
+		defer zr.Close()
+		r = zr
+	}
+	a.Refs.Put(gact.Repo, parseRefs(r))
+	return nil
+}
+
+// Store is a fixed size LRU of the refs last advertised by repositories, by
+// the commit they point at
+type Store struct {
+	repos *utils.LRU[string, map[string][]string]
+}
+
+func NewStore(size int) *Store {
+	return &Store{repos: utils.NewLRU[string, map[string][]string](size)}
+}
+
+// Put replaces the refs of repo, protocol v2 advertisements listing
+// capabilities alone leave them in place
+func (s *Store) Put(repo string, refs map[string][]string) {
+	if len(refs) == 0 {
+		return
+	}
+	s.repos.Put(strings.ToLower(repo), refs)
+}
+
+// Get returns the refs of repo by commit, nil when none were advertised
+func (s *Store) Get(repo string) map[string][]string {
+	refs, _ := s.repos.Get(strings.ToLower(repo))
+	return refs
+}
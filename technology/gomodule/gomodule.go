@@ -26,16 +26,61 @@ func parse(url string) (string, string, bool) {
 	return pack, version, true
 
 }
+
+// resolve parses the requests the go command resolves versions with,
+// returning the action, the module and the version if one is named:
+//
+//	/<module>/@v/list          list
+//	/<module>/@latest          latest
+//	/<module>/@v/<version>.info info
+//	/<module>/@v/<version>.mod  mod
+//	/lookup/<module>@<version> lookup, to the checksum database
+func resolve(url string) (action, mod, ver string, ok bool) {
+	if _, lookup, found := strings.Cut(url, "/lookup/"); found {
+		at := strings.LastIndex(lookup, "@")
+		if at < 0 {
+			return "", "", "", false
+		}
+		return "lookup", lookup[:at], lookup[at+1:], true
+	}
+	if strings.HasSuffix(url, "/@latest") {
+		return "latest", strings.Trim(strings.TrimSuffix(url, "/@latest"), "/"), "", true
+	}
+	parts := strings.SplitN(url, "/@v/", 2)
+	if len(parts) != 2 {
+		return "", "", "", false
+	}
+	mod = strings.Trim(parts[0], "/")
+	switch {
+	case parts[1] == "list":
+		return "list", mod, "", true
+	case strings.HasSuffix(parts[1], ".info"):
+		return "info", mod, strings.TrimSuffix(parts[1], ".info"), true
+	case strings.HasSuffix(parts[1], ".mod"):
+		return "mod", mod, strings.TrimSuffix(parts[1], ".mod"), true
+	}
+	return "", "", "", false
+}
+
+// Handle records module zip downloads as get and the requests resolving
+// versions by their action, so policies can tell resolution from download
 func Handle(p *policy.Policy, path string, r *http.Request) *session.Activity {
+	action := "get"
 	pkg, ver, act := parse(path)
+	if !act {
+		action, pkg, ver, act = resolve(path)
+	}
 	if !act {
 		return session.NilActivity
 	}
-	purl := fmt.Sprintf("pkg:%s/%s@%s", model.GoModule, pkg, ver)
+	purl := fmt.Sprintf("pkg:%s/%s", model.GoModule, pkg)
+	if ver != "" {
+		purl += "@" + ver
+	}
 	return &session.Activity{
 		ActivityHdr: model.ActivityHdr{
 			Name:   model.GoModule,
-			Action: "get",
+			Action: action,
 		},
 		Activity: model.PackageActivity{
 			Repo:    r.Host,
@@ -1,9 +1,20 @@
 package gomodule
 
 import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/invisirisk/svcs/model"
 	"github.com/stretchr/testify/assert"
+	"inivisirisk.com/pse/integrity"
+	"inivisirisk.com/pse/session"
+	"inivisirisk.com/pse/utils"
 )
 
 func TestGoModule(t *testing.T) {
@@ -15,3 +26,108 @@ func TestGoModule(t *testing.T) {
 	_, _, act = parse("github.com/kairoaraujo/goca/@v/v1.1.3.info")
 	assert.False(t, act)
 }
+
+func TestPublished(t *testing.T) {
+	reg := NewRegistry("")
+	lookup := "12207423\n" +
+		"golang.org/x/sync v0.1.0 h1:wsuoTGHzEhffawBOhz5CYhcrV4IdKZbEyZjBMuTp12o=\n" +
+		"golang.org/x/sync v0.1.0/go.mod h1:RxMgew5VJxzue5/jJTE5uejpjVlOe/izrB70Jof72aM=\n" +
+		"\ngo.sum database tree\n12207423\nJ8X5dcaPdbBL1fC2hLPDq5msHQVhsvD3pEWS7AnhVbA=\n"
+	for _, u := range []string{
+		"https://sum.golang.org/lookup/golang.org/x/sync@v0.1.0",
+		"https://proxy.golang.org/sumdb/sum.golang.org/lookup/golang.org/x/sync@v0.1.0",
+	} {
+		req, _ := http.NewRequest("GET", u, nil)
+		digests, err := reg.Published(&http.Response{Request: req}, strings.NewReader(lookup))
+		assert.NoError(t, err)
+		assert.Equal(t, []integrity.Digest{{
+			Key:       "pkg:gomodule/golang.org/x/sync@v0.1.0",
+			Algorithm: integrity.H1,
+			Value:     "h1:wsuoTGHzEhffawBOhz5CYhcrV4IdKZbEyZjBMuTp12o=",
+			Source:    "go checksum database",
+		}, {
+			Key:       "pkg:gomodule/golang.org/x/sync@v0.1.0/go.mod",
+			Algorithm: integrity.H1Mod,
+			Value:     "h1:RxMgew5VJxzue5/jJTE5uejpjVlOe/izrB70Jof72aM=",
+			Source:    "go checksum database",
+		}}, digests)
+	}
+
+	mod, _ := http.NewRequest("GET", "https://proxy.golang.org/golang.org/x/sync/@v/v0.1.0.mod", nil)
+	assert.Equal(t, "pkg:gomodule/golang.org/x/sync@v0.1.0/go.mod", reg.Key(mod.URL))
+	zip, _ := http.NewRequest("GET", "https://proxy.golang.org/golang.org/x/sync/@v/v0.1.0.zip", nil)
+	assert.Equal(t, "pkg:gomodule/golang.org/x/sync@v0.1.0", reg.Key(zip.URL))
+}
+
+func TestPrefixedProxyKey(t *testing.T) {
+	reg := NewRegistry("/artifactory/api/go/gomod")
+	mod, _ := http.NewRequest("GET", "https://proxy.example.com/artifactory/api/go/gomod/golang.org/x/sync/@v/v0.1.0.mod", nil)
+	assert.Equal(t, "pkg:gomodule/golang.org/x/sync@v0.1.0/go.mod", reg.Key(mod.URL))
+	zip, _ := http.NewRequest("GET", "https://proxy.example.com/artifactory/api/go/gomod/golang.org/x/sync/@v/v0.1.0.zip", nil)
+	assert.Equal(t, "pkg:gomodule/golang.org/x/sync@v0.1.0", reg.Key(zip.URL))
+	other, _ := http.NewRequest("GET", "https://proxy.example.com/golang.org/x/sync/@v/v0.1.0.zip", nil)
+	assert.Empty(t, reg.Key(other.URL))
+}
+
+func TestReadSums(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "go.sum")
+	os.WriteFile(file, []byte("github.com/BurntSushi/toml v1.2.1 h1:9F2/+DoOYIOksmaJFPw1tGFy1eDnIJXg+UHjuD8lTak=\n"), 0o644)
+	digests, err := ReadSums(file)
+	assert.NoError(t, err)
+	assert.Equal(t, []integrity.Digest{{
+		Key:       "pkg:gomodule/github.com/!burnt!sushi/toml@v1.2.1",
+		Algorithm: integrity.H1,
+		Value:     "h1:9F2/+DoOYIOksmaJFPw1tGFy1eDnIJXg+UHjuD8lTak=",
+		Source:    file,
+	}}, digests)
+}
+
+func TestHashZip(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range []string{"example.com/m@v1.0.0/main.go", "example.com/m@v1.0.0/go.mod"} {
+		w, _ := zw.Create(name)
+		w.Write([]byte(name))
+	}
+	zw.Close()
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	assert.NoError(t, err)
+	h, err := hashZip(zr)
+	assert.NoError(t, err)
+	assert.Equal(t, "h1:iFuQf2nMsEndT1dm+zU6GimrUjCG1gLF5JhCdMi1Q8Y=", h)
+
+	act := &session.Activity{ActivityHdr: model.ActivityHdr{Name: model.GoModule, Action: "get"}}
+	zh := &ZipHash{}
+	assert.NoError(t, zh.Handle(context.WithValue(context.Background(), utils.ActCtxKey, act), bytes.NewReader(buf.Bytes())))
+	assert.Equal(t, h, zh.Hash)
+
+	act.Action = "mod"
+	zh = &ZipHash{}
+	assert.NoError(t, zh.Handle(context.WithValue(context.Background(), utils.ActCtxKey, act), bytes.NewReader(buf.Bytes())))
+	assert.Empty(t, zh.Hash)
+}
+
+func TestResolve(t *testing.T) {
+	for path, want := range map[string][3]string{
+		"/github.com/!azure/azure-sdk-for-go/@v/list":           {"list", "github.com/!azure/azure-sdk-for-go", ""},
+		"/github.com/kairoaraujo/goca/@latest":                  {"latest", "github.com/kairoaraujo/goca", ""},
+		"/github.com/kairoaraujo/goca/@v/v1.1.3.info":           {"info", "github.com/kairoaraujo/goca", "v1.1.3"},
+		"/github.com/kairoaraujo/goca/@v/v1.1.3.mod":            {"mod", "github.com/kairoaraujo/goca", "v1.1.3"},
+		"/lookup/github.com/kairoaraujo/goca@v1.1.3":            {"lookup", "github.com/kairoaraujo/goca", "v1.1.3"},
+		"/sumdb/sum.golang.org/lookup/golang.org/x/sync@v0.1.0": {"lookup", "golang.org/x/sync", "v0.1.0"},
+	} {
+		action, mod, ver, ok := resolve(path)
+		assert.True(t, ok, path)
+		assert.Equal(t, want, [3]string{action, mod, ver}, path)
+	}
+	_, _, _, ok := resolve("/tile/8/0/x040/123")
+	assert.False(t, ok)
+
+	r, _ := http.NewRequest("GET", "https://proxy.golang.org/github.com/kairoaraujo/goca/@v/list", nil)
+	act := Handle(nil, "/github.com/kairoaraujo/goca/@v/list", r)
+	assert.Equal(t, "list", act.Action)
+	assert.Equal(t, "pkg:gomodule/github.com/kairoaraujo/goca", act.Activity.(model.PackageActivity).Purl)
+	act = Handle(nil, "/github.com/kairoaraujo/goca/@v/v1.1.3.zip", r)
+	assert.Equal(t, "get", act.Action)
+	assert.Equal(t, "pkg:gomodule/github.com/kairoaraujo/goca@v1.1.3", act.Activity.(model.PackageActivity).Purl)
+}
@@ -0,0 +1,180 @@
+package gomodule
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/invisirisk/clog"
+	"github.com/invisirisk/svcs/model"
+	"inivisirisk.com/pse/integrity"
+	"inivisirisk.com/pse/session"
+	"inivisirisk.com/pse/utils"
+)
+
+// registry reads the hashes of checksum database lookups, served by
+// sum.golang.org or proxied at <proxy>/sumdb/<db>/lookup/
+type registry struct {
+	prefix string
+}
+
+// NewRegistry returns the registry of a proxy served under the URL path
+// prefix, such as /go/ for Athens or /artifactory/api/go/<repo> for
+// Artifactory, "" for proxy.golang.org
+func NewRegistry(prefix string) integrity.Registry {
+	return registry{prefix: prefix}
+}
+
+// escape applies the module proxy case encoding to a module path or version,
+// go.sum lines carry them unescaped
+func escape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if 'A' <= r && r <= 'Z' {
+			b.WriteByte('!')
+			r += 'a' - 'A'
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// key names the zip of a module version, escaped as in proxy URLs
+func key(mod, ver string) string {
+	return fmt.Sprintf("pkg:%s/%s@%s", model.GoModule, mod, ver)
+}
+
+// modKey names the go.mod of a module version the way go.sum does
+func modKey(mod, ver string) string {
+	return key(mod, ver) + "/go.mod"
+}
+
+// sumLine parses a go.sum line "<module> <version>[/go.mod] h1:<hash>"
+func sumLine(line, source string) (integrity.Digest, bool) {
+	fields := strings.Fields(line)
+	if len(fields) != 3 || !strings.HasPrefix(fields[2], "h1:") {
+		return integrity.Digest{}, false
+	}
+	mod := escape(fields[0])
+	if strings.HasSuffix(fields[1], "/go.mod") {
+		ver := strings.TrimSuffix(fields[1], "/go.mod")
+		return integrity.Digest{Key: modKey(mod, escape(ver)), Algorithm: integrity.H1Mod, Value: fields[2], Source: source}, true
+	}
+	return integrity.Digest{Key: key(mod, escape(fields[1])), Algorithm: integrity.H1, Value: fields[2], Source: source}, true
+}
+
+func (registry) Published(rsp *http.Response, body io.Reader) ([]integrity.Digest, error) {
+	if !strings.Contains(rsp.Request.URL.Path, "/lookup/") {
+		return nil, nil
+	}
+	var digests []integrity.Digest
+	// the go.sum lines of the record are followed by a signed tree head
+	sc := bufio.NewScanner(body)
+	for sc.Scan() {
+		if d, ok := sumLine(sc.Text(), "go checksum database"); ok {
+			digests = append(digests, d)
+		}
+	}
+	return digests, sc.Err()
+}
+
+func (r registry) Key(u *url.URL) string {
+	if !strings.HasPrefix(u.Path, r.prefix) {
+		return ""
+	}
+	path := u.Path[len(r.prefix):]
+	if pkg, ver, ok := parse(path); ok {
+		return key(pkg, ver)
+	}
+	if !strings.HasSuffix(path, ".mod") {
+		return ""
+	}
+	parts := strings.SplitN(strings.TrimSuffix(path, ".mod"), "/@v/", 2)
+	if len(parts) != 2 {
+		return ""
+	}
+	return modKey(strings.Trim(parts[0], "/"), parts[1])
+}
+
+// ReadSums returns the hashes listed in a go.sum file
+func ReadSums(file string) ([]integrity.Digest, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var digests []integrity.Digest
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if d, ok := sumLine(sc.Text(), file); ok {
+			digests = append(digests, d)
+		}
+	}
+	return digests, sc.Err()
+}
+
+// ZipHash computes the go.sum hash of module zip downloads. The zip is
+// spooled to a temporary file, its directory comes last.
+type ZipHash struct {
+	Hash string
+}
+
+func (z *ZipHash) Handle(ctx context.Context, r io.Reader) error {
+	act, ok := ctx.Value(utils.ActCtxKey).(*session.Activity)
+	if !ok || act.Name != model.GoModule || act.Action != "get" {
+		return nil
+	}
+	_, cl := clog.WithCtx(ctx, "ziphash")
+	f, err := os.CreateTemp("", "pse-module-*.zip")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	size, err := io.Copy(f, r)
+	if err != nil {
+		return err
+	}
+	zr, err := zip.NewReader(f, size)
+	if err != nil {
+		cl.Errorf("module zip unreadable: %v", err)
+		return nil
+	}
+	z.Hash, err = hashZip(zr)
+	return err
+}
+
+// hashZip is the h1: hash of dirhash.HashZip, the SHA-256 of the sorted
+// "<sha256>  <name>" lines of every file
+func hashZip(zr *zip.Reader) (string, error) {
+	files := make([]*zip.File, len(zr.File))
+	copy(files, zr.File)
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	summary := sha256.New()
+	for _, f := range files {
+		if strings.Contains(f.Name, "\n") {
+			return "", fmt.Errorf("file name %q contains a newline", f.Name)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return "", err
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, rc)
+		rc.Close()
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(summary, "%x  %s\n", h.Sum(nil), f.Name)
+	}
+	return "h1:" + base64.StdEncoding.EncodeToString(summary.Sum(nil)), nil
+}
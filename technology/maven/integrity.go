@@ -0,0 +1,71 @@
+package maven
+
+import (
+	"bufio"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"inivisirisk.com/pse/integrity"
+)
+
+// registry reads the .sha1, .sha256 and .sha512 files published next to
+// each artifact
+type registry struct{}
+
+func NewRegistry() integrity.Registry {
+	return registry{}
+}
+
+var (
+	checksumFiles = map[string]string{
+		".sha1":   integrity.SHA1,
+		".sha256": integrity.SHA256,
+		".sha512": integrity.SHA512,
+	}
+	// files about an artifact rather than artifacts themselves
+	sidecars = []string{".sha1", ".sha256", ".sha512", ".md5", ".asc"}
+)
+
+func (registry) Published(rsp *http.Response, body io.Reader) ([]integrity.Digest, error) {
+	u := rsp.Request.URL
+	for ext, alg := range checksumFiles {
+		if !strings.HasSuffix(u.Path, ext) {
+			continue
+		}
+		// the file holds the hex digest, some repositories follow it with
+		// the file name
+		line, err := bufio.NewReader(io.LimitReader(body, 1024)).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			return nil, nil
+		}
+		value := strings.ToLower(fields[0])
+		if _, err := hex.DecodeString(value); err != nil {
+			return nil, nil
+		}
+		artifact := *u
+		artifact.Path = strings.TrimSuffix(u.Path, ext)
+		return []integrity.Digest{{
+			Key:       integrity.URLKey(&artifact),
+			Algorithm: alg,
+			Value:     value,
+			Source:    "maven " + ext,
+		}}, nil
+	}
+	return nil, nil
+}
+
+func (registry) Key(u *url.URL) string {
+	for _, ext := range sidecars {
+		if strings.HasSuffix(u.Path, ext) {
+			return ""
+		}
+	}
+	return integrity.URLKey(u)
+}
@@ -3,6 +3,8 @@ package maven
 import (
 	"fmt"
 	"net/http"
+	"net/url"
+	"regexp"
 	"strings"
 
 	"github.com/invisirisk/svcs/model"
@@ -10,35 +12,141 @@ import (
 	"inivisirisk.com/pse/session"
 )
 
-func parse(url string) (string, string, bool) {
-	if !strings.HasSuffix(url, ".jar") {
+const (
+	metadataFile = "maven-metadata.xml"
+	snapshot     = "SNAPSHOT"
+)
+
+var (
+	// extensions of the artifacts recorded, longest first
+	extensions = []string{".tar.gz", ".module", ".jar", ".pom", ".war", ".aar", ".ear", ".zip"}
+	// the timestamp and build number a snapshot is deployed with
+	timestampPattern = regexp.MustCompile(`^\d{8}\.\d{6}-\d+`)
+)
+
+// gav are the coordinates of an artifact in a repository laid out as
+// group/path/artifactId/version/artifactId-version[-classifier].extension
+type gav struct {
+	Group      string
+	Artifact   string
+	Version    string
+	Classifier string
+	Extension  string
+}
+
+// Package is groupId:artifactId
+func (c gav) Package() string {
+	return c.Group + ":" + c.Artifact
+}
+
+// Purl is the package URL, type is left out for jars as the spec defaults it
+func (c gav) Purl() string {
+	purl := fmt.Sprintf("pkg:%s/%s/%s", model.Maven, c.Group, c.Artifact)
+	if c.Version != "" {
+		purl += "@" + url.PathEscape(c.Version)
+	}
+	q := url.Values{}
+	if c.Classifier != "" {
+		q.Set("classifier", c.Classifier)
+	}
+	if c.Extension != "" && c.Extension != "jar" {
+		q.Set("type", c.Extension)
+	}
+	if len(q) > 0 {
+		purl += "?" + q.Encode()
+	}
+	return purl
+}
+
+// fileVersion splits the version from base, the file name after the
+// artifactId and its dash. Snapshots are deployed with the SNAPSHOT of their
+// directory replaced by a timestamp.
+func fileVersion(base, dir string) (version, rest string, ok bool) {
+	if strings.HasPrefix(base, dir) {
+		return dir, base[len(dir):], true
+	}
+	if !strings.HasSuffix(dir, "-"+snapshot) {
 		return "", "", false
 	}
-	parts := strings.Split(url, "/")
-	if len(parts) < 3 {
+	prefix := strings.TrimSuffix(dir, snapshot)
+	if !strings.HasPrefix(base, prefix) {
 		return "", "", false
 	}
-	pkg := strings.Join(parts[1:len(parts)-2], ".")
-	rev := parts[len(parts)-2]
-	return pkg, rev, true
+	ts := timestampPattern.FindString(base[len(prefix):])
+	if ts == "" {
+		return "", "", false
+	}
+	version = prefix + ts
+	return version, base[len(version):], true
 }
 
+// parse returns the coordinates of the artifact at path
+func parse(path string) (gav, bool) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) < 4 {
+		return gav{}, false
+	}
+	n := len(parts)
+	file, dir, artifact := parts[n-1], parts[n-2], parts[n-3]
+	if !strings.HasPrefix(file, artifact+"-") {
+		return gav{}, false
+	}
+	c := gav{Group: strings.Join(parts[:n-3], "."), Artifact: artifact}
+	base := file[len(artifact)+1:]
+	for _, ext := range extensions {
+		if strings.HasSuffix(base, ext) {
+			c.Extension = ext[1:]
+			base = strings.TrimSuffix(base, ext)
+			break
+		}
+	}
+	if c.Extension == "" {
+		return gav{}, false
+	}
+	version, rest, ok := fileVersion(base, dir)
+	if !ok || (rest != "" && !strings.HasPrefix(rest, "-")) {
+		return gav{}, false
+	}
+	c.Version = version
+	c.Classifier = strings.TrimPrefix(rest, "-")
+	return c, true
+}
+
+// parseMetadata returns the coordinates a maven-metadata.xml lists the
+// versions of, snapshot versions have metadata of their own
+func parseMetadata(path string) (gav, bool) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	n := len(parts)
+	if n < 3 || parts[n-1] != metadataFile {
+		return gav{}, false
+	}
+	if strings.HasSuffix(parts[n-2], "-"+snapshot) && n >= 4 {
+		return gav{Group: strings.Join(parts[:n-3], "."), Artifact: parts[n-3], Version: parts[n-2]}, true
+	}
+	return gav{Group: strings.Join(parts[:n-2], "."), Artifact: parts[n-2]}, true
+}
+
+// Handle records artifact downloads as get and metadata lookups as metadata
 func Handle(p *policy.Policy, path string, r *http.Request) *session.Activity {
-	pkg, ver, act := parse(path)
+	action := "get"
+	c, act := parse(path)
+	if !act {
+		action = "metadata"
+		c, act = parseMetadata(path)
+	}
 	if !act {
 		return session.NilActivity
 	}
-	purl := fmt.Sprintf("pkg:%s/%s@%s", model.Maven, pkg, ver)
 	return &session.Activity{
 		ActivityHdr: model.ActivityHdr{
 			Name:   model.Maven,
-			Action: "get",
+			Action: action,
 		},
 		Activity: model.PackageActivity{
 			Repo:    r.Host,
-			Package: pkg,
-			Version: ver,
-			Purl:    purl,
+			Package: c.Package(),
+			Version: c.Version,
+			Purl:    c.Purl(),
 		},
 	}
 }
@@ -1,17 +1,100 @@
 package maven
 
 import (
+	"net/http"
+	"strings"
 	"testing"
 
+	"github.com/invisirisk/svcs/model"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"inivisirisk.com/pse/integrity"
 )
 
 func TestMaven(t *testing.T) {
-	pkg, rev, act := parse("/org/sonatype/sisu/sisu-inject-bean/1.4.2/sisu-inject-bean-1.4.2.jar")
-	assert.Equal(t, "org.sonatype.sisu.sisu-inject-bean", pkg)
-	assert.Equal(t, "1.4.2", rev)
-	assert.True(t, act)
-	_, _, act = parse("/org/")
-	assert.False(t, act)
+	tests := []struct {
+		path string
+		gav  gav
+		purl string
+	}{
+		{"/org/sonatype/sisu/sisu-inject-bean/1.4.2/sisu-inject-bean-1.4.2.jar",
+			gav{"org.sonatype.sisu", "sisu-inject-bean", "1.4.2", "", "jar"},
+			"pkg:maven/org.sonatype.sisu/sisu-inject-bean@1.4.2"},
+		{"/org/apache/commons/commons-lang3/3.12.0/commons-lang3-3.12.0-sources.jar",
+			gav{"org.apache.commons", "commons-lang3", "3.12.0", "sources", "jar"},
+			"pkg:maven/org.apache.commons/commons-lang3@3.12.0?classifier=sources"},
+		{"/org/apache/commons/commons-parent/52/commons-parent-52.pom",
+			gav{"org.apache.commons", "commons-parent", "52", "", "pom"},
+			"pkg:maven/org.apache.commons/commons-parent@52?type=pom"},
+		{"/androidx/core/core/1.9.0/core-1.9.0.aar",
+			gav{"androidx.core", "core", "1.9.0", "", "aar"},
+			"pkg:maven/androidx.core/core@1.9.0?type=aar"},
+		{"/org/jetbrains/kotlin/kotlin-stdlib/1.8.0/kotlin-stdlib-1.8.0.module",
+			gav{"org.jetbrains.kotlin", "kotlin-stdlib", "1.8.0", "", "module"},
+			"pkg:maven/org.jetbrains.kotlin/kotlin-stdlib@1.8.0?type=module"},
+		{"/com/example/app/2.0/app-2.0-jdk11.war",
+			gav{"com.example", "app", "2.0", "jdk11", "war"},
+			"pkg:maven/com.example/app@2.0?classifier=jdk11&type=war"},
+		{"/com/example/lib/1.0-SNAPSHOT/lib-1.0-20230102.030405-7-tests.jar",
+			gav{"com.example", "lib", "1.0-20230102.030405-7", "tests", "jar"},
+			"pkg:maven/com.example/lib@1.0-20230102.030405-7?classifier=tests"},
+		{"/com/example/lib/1.0-SNAPSHOT/lib-1.0-SNAPSHOT.jar",
+			gav{"com.example", "lib", "1.0-SNAPSHOT", "", "jar"},
+			"pkg:maven/com.example/lib@1.0-SNAPSHOT"},
+	}
+	for _, test := range tests {
+		c, act := parse(test.path)
+		require.True(t, act, test.path)
+		assert.Equal(t, test.gav, c)
+		assert.Equal(t, test.purl, c.Purl())
+	}
 
+	for _, path := range []string{
+		"/org/",
+		"/org/apache/commons/commons-lang3/3.12.0/commons-lang3-3.12.0.jar.sha1",
+		"/org/apache/commons/commons-lang3/3.12.0/commons-lang3-3.12.0.pom.asc",
+		"/org/apache/commons/commons-lang3/3.12.0/other-3.12.0.jar",
+		"/org/apache/commons/commons-lang3/3.12.0/commons-lang3-3.11.0.jar",
+		"/org/apache/commons/commons-lang3/maven-metadata.xml",
+	} {
+		_, act := parse(path)
+		assert.False(t, act, path)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	req, _ := http.NewRequest("GET", "https://repo1.maven.org/maven2/org/apache/commons/commons-lang3/maven-metadata.xml", nil)
+	act := Handle(nil, "/org/apache/commons/commons-lang3/maven-metadata.xml", req)
+	require.Equal(t, "metadata", act.Action)
+	pkg := act.Activity.(model.PackageActivity)
+	assert.Equal(t, "org.apache.commons:commons-lang3", pkg.Package)
+	assert.Equal(t, "pkg:maven/org.apache.commons/commons-lang3", pkg.Purl)
+
+	c, ok := parseMetadata("/com/example/lib/1.0-SNAPSHOT/maven-metadata.xml")
+	require.True(t, ok)
+	assert.Equal(t, gav{Group: "com.example", Artifact: "lib", Version: "1.0-SNAPSHOT"}, c)
+	assert.Equal(t, "pkg:maven/com.example/lib@1.0-SNAPSHOT", c.Purl())
+
+	_, ok = parseMetadata("/com/example/lib/1.0/lib-1.0.jar")
+	assert.False(t, ok)
+}
+
+func TestPublished(t *testing.T) {
+	reg := NewRegistry()
+	jar := "https://repo1.maven.org/maven2/org/apache/commons/commons-lang3/3.12.0/commons-lang3-3.12.0.jar"
+	req, _ := http.NewRequest("GET", jar+".sha1", nil)
+	digests, err := reg.Published(&http.Response{Request: req}, strings.NewReader("c6842c86792ff03b9f1d1fe2aab8dc23aa6c6f0e  commons-lang3-3.12.0.jar\n"))
+	require.NoError(t, err)
+	require.Len(t, digests, 1)
+	assert.Equal(t, integrity.SHA1, digests[0].Algorithm)
+	assert.Equal(t, "c6842c86792ff03b9f1d1fe2aab8dc23aa6c6f0e", digests[0].Value)
+
+	artifact, _ := http.NewRequest("GET", jar, nil)
+	assert.Equal(t, reg.Key(artifact.URL), digests[0].Key)
+	assert.Empty(t, reg.Key(req.URL))
+
+	artifact, _ = http.NewRequest("GET", jar, nil)
+	digests, err = reg.Published(&http.Response{Request: artifact}, strings.NewReader("PK"))
+	require.NoError(t, err)
+	assert.Empty(t, digests)
 }
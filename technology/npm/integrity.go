@@ -0,0 +1,73 @@
+package npm
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/invisirisk/svcs/model"
+	"inivisirisk.com/pse/integrity"
+	"inivisirisk.com/pse/session"
+	"inivisirisk.com/pse/utils"
+)
+
+// registry publishes dist.integrity and dist.shasum of the version of a
+// tarball downloaded. Packument keeps them for every version a packument
+// lists, by package.
+type registry struct {
+	versions *integrity.Versions
+}
+
+// NewRegistry returns the registry publishing the digests Packument keeps in
+// versions
+func NewRegistry(versions *integrity.Versions) integrity.Registry {
+	return registry{versions: versions}
+}
+
+type dist struct {
+	Tarball   string `json:"tarball"`
+	Integrity string `json:"integrity"`
+	Shasum    string `json:"shasum"`
+}
+
+// requested returns the package and version of the tarball rsp answers,
+// parsed from its path when the request carries none
+func requested(rsp *http.Response) (pkg, ver string) {
+	if act, ok := rsp.Request.Context().Value(utils.ActCtxKey).(*session.Activity); ok {
+		if p, ok := act.Activity.(model.PackageActivity); ok {
+			return p.Package, p.Version
+		}
+	}
+	pkg, ver, _ = parse(rsp.Request.URL.Path)
+	return pkg, ver
+}
+
+func digests(base *url.URL, d dist) []integrity.Digest {
+	u, err := base.Parse(d.Tarball)
+	if d.Tarball == "" || err != nil {
+		return nil
+	}
+	key := integrity.URLKey(u)
+	digests := integrity.SRI(key, d.Integrity, "npm dist.integrity")
+	if d.Shasum != "" {
+		digests = append(digests, integrity.Digest{Key: key, Algorithm: integrity.SHA1, Value: d.Shasum, Source: "npm dist.shasum"})
+	}
+	return digests
+}
+
+// Published returns the digests kept for the version of a tarball, packuments
+// are not read again
+func (r registry) Published(rsp *http.Response, body io.Reader) ([]integrity.Digest, error) {
+	if !isValidNPMURL(rsp.Request.URL.Path) {
+		return nil, nil
+	}
+	pkg, ver := requested(rsp)
+	return r.versions.Get(pkg, ver), nil
+}
+
+func (registry) Key(u *url.URL) string {
+	if !isValidNPMURL(u.Path) {
+		return ""
+	}
+	return integrity.URLKey(u)
+}
@@ -161,22 +161,56 @@ func parse(npmPath string) (packageName, version string, valid bool) {
 	return packageName, version, true
 }
 
+// parsePackument returns the package, and the version or dist-tag, of a
+// packument request /<name>[/<version>]
+func parsePackument(npmPath string) (packageName, version string, valid bool) {
+	parts := strings.Split(strings.Trim(npmPath, "/"), "/")
+	for _, part := range parts {
+		// /-/ serves search, audit and login rather than packages
+		if part == "" || part == "-" {
+			return "", "", false
+		}
+	}
+	if strings.HasPrefix(parts[0], "@") {
+		if len(parts) < 2 {
+			return "", "", false
+		}
+		parts = append([]string{parts[0] + "/" + parts[1]}, parts[2:]...)
+	}
+	switch len(parts) {
+	case 1:
+		return parts[0], "", true
+	case 2:
+		return parts[0], parts[1], true
+	}
+	return "", "", false
+}
+
+// Handle records tarball downloads as get and packument requests as metadata
 func Handle(p *policy.Policy, path string, r *http.Request) *session.Activity {
 	var pkg, ver string
 	var act bool
+	action := "get"
 	if r.Host == "npm.pkg.github.com" {
 		pkg, ver, act = githubParse(path)
 	} else {
 		pkg, ver, act = parse(path)
 	}
+	if !act && !isValidNPMURL(path) {
+		action = "metadata"
+		pkg, ver, act = parsePackument(path)
+	}
 	if !act {
 		return session.NilActivity
 	}
-	purl := fmt.Sprintf("pkg:%s/%s@%s", model.NPM, pkg, ver)
+	purl := fmt.Sprintf("pkg:%s/%s", model.NPM, pkg)
+	if ver != "" {
+		purl += "@" + ver
+	}
 	return &session.Activity{
 		ActivityHdr: model.ActivityHdr{
 			Name:   model.NPM,
-			Action: "get",
+			Action: action,
 		},
 		Activity: model.PackageActivity{
 			Repo:    r.Host,
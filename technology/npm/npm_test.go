@@ -1,10 +1,17 @@
 package npm
 
 import (
+	"context"
+	"net/http"
+	"strings"
 	"testing"
 
+	"github.com/invisirisk/svcs/model"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"inivisirisk.com/pse/integrity"
+	"inivisirisk.com/pse/session"
+	"inivisirisk.com/pse/utils"
 )
 
 func TestNpm(t *testing.T) {
@@ -52,3 +59,154 @@ func TestNpmGithub(t *testing.T) {
 	assert.Equal(t, "@invisirisk/ir-dep-npm", pkg)
 	assert.Equal(t, "1.0.0", rev)
 }
+
+func TestPublished(t *testing.T) {
+	versions := integrity.NewVersions(1 << 20)
+	reg := NewRegistry(versions)
+	packument := `{"name": "left-pad", "versions": {"1.3.0": {"dist": {
+		"tarball": "https://registry.npmjs.org/left-pad/-/left-pad-1.3.0.tgz",
+		"shasum": "5b8a3a7765dfe001261dde915589e782f8c94d1e",
+		"integrity": "sha512-XI5MPzVNApjAyhQzphX8BkmKsKUxD4LdyK24iZeQEhyjUJvdwV9WsmYUaIq3l2nbvtfT+0bFVA4B4tn4jkrGFg=="}}}}`
+	req, _ := http.NewRequest("GET", "https://registry.npmjs.org/left-pad", nil)
+	rsp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Request: req}
+	// the registry leaves the packument to Packument
+	digests, err := reg.Published(rsp, strings.NewReader("not json"))
+	require.NoError(t, err)
+	require.Empty(t, digests)
+	p := &Packument{Response: rsp, Digests: versions}
+	require.NoError(t, p.Handle(metadataCtx("left-pad", ""), strings.NewReader(packument)))
+
+	tarball, _ := http.NewRequest("GET", "https://registry.npmjs.org/left-pad/-/left-pad-1.3.0.tgz", nil)
+	digests, err = reg.Published(&http.Response{Request: tarball}, strings.NewReader("tarball"))
+	require.NoError(t, err)
+	require.Len(t, digests, 2)
+	assert.Equal(t, "registry.npmjs.org/left-pad/-/left-pad-1.3.0.tgz", digests[0].Key)
+	assert.Equal(t, integrity.SHA512, digests[0].Algorithm)
+	assert.Equal(t, "5c8e4c3f354d0298c0ca1433a615fc06498ab0a5310f82ddc8adb8899790121ca3509bddc15f56b26614688ab79769dbbed7d3fb46c5540e01e2d9f88e4ac616", digests[0].Value)
+	assert.Equal(t, integrity.SHA1, digests[1].Algorithm)
+
+	other, _ := http.NewRequest("GET", "https://registry.npmjs.org/left-pad/-/left-pad-1.2.0.tgz", nil)
+	digests, err = reg.Published(&http.Response{Request: other}, strings.NewReader("tarball"))
+	require.NoError(t, err)
+	assert.Empty(t, digests)
+
+	// a single version document adds to the versions kept
+	version, _ := http.NewRequest("GET", "https://registry.npmjs.org/left-pad/1.2.0", nil)
+	p = &Packument{Response: &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Request: version}, Digests: versions}
+	require.NoError(t, p.Handle(metadataCtx("left-pad", "1.2.0"), strings.NewReader(`{"name": "left-pad", "version": "1.2.0", "dist": {
+		"tarball": "https://registry.npmjs.org/left-pad/-/left-pad-1.2.0.tgz", "shasum": "6b8a3a7765dfe001261dde915589e782f8c94d1e"}}`)))
+	digests, err = reg.Published(&http.Response{Request: other}, strings.NewReader("tarball"))
+	require.NoError(t, err)
+	require.Len(t, digests, 1)
+	digests, err = reg.Published(&http.Response{Request: tarball}, strings.NewReader("tarball"))
+	require.NoError(t, err)
+	require.Len(t, digests, 2)
+
+	assert.Equal(t, digests[0].Key, reg.Key(tarball.URL))
+	assert.Empty(t, reg.Key(req.URL))
+}
+
+func TestParsePackument(t *testing.T) {
+	for path, want := range map[string][2]string{
+		"/left-pad":              {"left-pad", ""},
+		"/left-pad/1.3.0":        {"left-pad", "1.3.0"},
+		"/@types/node":           {"@types/node", ""},
+		"/@types/node/latest":    {"@types/node", "latest"},
+		"/@types/node/-/x/1.0.0": {},
+		"/-/v1/search":           {},
+		"/@types":                {},
+	} {
+		pkg, ver, ok := parsePackument(path)
+		assert.Equal(t, want[0] != "", ok, path)
+		assert.Equal(t, want[0], pkg, path)
+		assert.Equal(t, want[1], ver, path)
+	}
+
+	req, _ := http.NewRequest("GET", "https://registry.npmjs.org/@types/node", nil)
+	act := Handle(nil, req.URL.Path, req)
+	assert.Equal(t, "metadata", act.Action)
+	assert.Equal(t, "pkg:npm/@types/node", act.Activity.(model.PackageActivity).Purl)
+}
+
+const evilPackument = `{
+  "name": "evil",
+  "dist-tags": {"latest": "1.0.1"},
+  "maintainers": [{"name": "alice", "email": "alice@example.com"}],
+  "time": {"1.0.0": "2023-01-01T00:00:00.000Z", "1.0.1": "2024-06-01T12:00:00.000Z"},
+  "versions": {
+    "1.0.0": {"name": "evil", "version": "1.0.0", "dist": {"integrity": "sha512-AAAA"}, "scripts": {"test": "jest"}},
+    "1.0.1": {"name": "evil", "version": "1.0.1", "dist": {"integrity": "sha512-BBBB"},
+      "scripts": {"test": "jest", "postinstall": "node steal.js"},
+      "maintainers": [{"name": "mallory"}], "deprecated": "use good instead"}
+  }
+}`
+
+func metadataCtx(pkg, ver string) context.Context {
+	act := &session.Activity{
+		ActivityHdr: model.ActivityHdr{Name: model.NPM, Action: "metadata"},
+		Activity:    model.PackageActivity{Package: pkg, Version: ver},
+	}
+	return context.WithValue(context.Background(), utils.ActCtxKey, act)
+}
+
+func TestPackument(t *testing.T) {
+	rsp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}}
+	p := &Packument{Response: rsp}
+	require.NoError(t, p.Handle(metadataCtx("evil", ""), strings.NewReader(evilPackument)))
+	require.Len(t, p.Versions, 2)
+	require.NotNil(t, p.Resolved)
+	assert.Equal(t, Metadata{
+		Name:             "evil",
+		Version:          "1.0.1",
+		Integrity:        "sha512-BBBB",
+		Scripts:          map[string]string{"postinstall": "node steal.js"},
+		HasInstallScript: true,
+		Deprecated:       "use good instead",
+		Published:        "2024-06-01T12:00:00.000Z",
+		Maintainers:      []string{"mallory"},
+	}, *p.Resolved)
+	assert.Equal(t, Metadata{
+		Name:        "evil",
+		Version:     "1.0.0",
+		Integrity:   "sha512-AAAA",
+		Published:   "2023-01-01T00:00:00.000Z",
+		Maintainers: []string{"alice"},
+	}, p.Versions[0])
+
+	// abbreviated packuments flag install scripts without listing them
+	abbreviated := `{"name": "evil", "dist-tags": {"latest": "1.0.1"}, "versions": {"1.0.1": {"version": "1.0.1", "hasInstallScript": true, "deprecated": false}}}`
+	p = &Packument{Response: rsp}
+	require.NoError(t, p.Handle(metadataCtx("evil", "latest"), strings.NewReader(abbreviated)))
+	require.NotNil(t, p.Resolved)
+	assert.True(t, p.Resolved.HasInstallScript)
+	assert.Empty(t, p.Resolved.Deprecated)
+
+	// a single version document
+	p = &Packument{Response: rsp}
+	require.NoError(t, p.Handle(metadataCtx("evil", "1.0.0"), strings.NewReader(`{"name": "evil", "version": "1.0.0", "scripts": {"install": "node-gyp rebuild"}}`)))
+	require.NotNil(t, p.Resolved)
+	assert.Equal(t, map[string]string{"install": "node-gyp rebuild"}, p.Resolved.Scripts)
+
+	// tarballs are not read
+	get := context.WithValue(context.Background(), utils.ActCtxKey, &session.Activity{ActivityHdr: model.ActivityHdr{Name: model.NPM, Action: "get"}})
+	p = &Packument{Response: rsp}
+	require.NoError(t, p.Handle(get, strings.NewReader("not json")))
+	assert.Nil(t, p.Resolved)
+}
+
+func TestStore(t *testing.T) {
+	// room for the metadata of evil or good, not both
+	s := NewStore(40)
+	s.Put("evil", []Metadata{{Name: "evil", Version: "1.0.0"}, {Name: "evil", Version: "1.0.1", HasInstallScript: true}})
+	md, ok := s.Get("evil", "1.0.1")
+	require.True(t, ok)
+	assert.True(t, md.HasInstallScript)
+	_, ok = s.Get("evil", "2.0.0")
+	assert.False(t, ok)
+
+	s.Put("good", []Metadata{{Name: "good", Version: "1.0.0"}})
+	_, ok = s.Get("evil", "1.0.0")
+	assert.False(t, ok)
+	_, ok = s.Get("good", "1.0.0")
+	assert.True(t, ok)
+}
@@ -0,0 +1,243 @@
+package npm
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/invisirisk/svcs/model"
+	"inivisirisk.com/pse/integrity"
+	"inivisirisk.com/pse/session"
+	"inivisirisk.com/pse/utils"
+)
+
+const (
+	// maxPackument bounds the packument read, the largest run to tens of MiB
+	maxPackument = 64 << 20
+)
+
+var (
+	// lifecycle scripts npm runs when installing a package
+	installScripts = []string{"preinstall", "install", "postinstall"}
+)
+
+// Metadata is what the packument tells about a version, for the policy to
+// weigh installing it. Abbreviated packuments, which npm requests, carry
+// hasInstallScript and deprecated but neither scripts, publish times nor
+// maintainers.
+type Metadata struct {
+	Name             string            `json:"name"`
+	Version          string            `json:"version"`
+	Integrity        string            `json:"integrity,omitempty"`
+	Scripts          map[string]string `json:"scripts,omitempty"`
+	HasInstallScript bool              `json:"has_install_script"`
+	Deprecated       string            `json:"deprecated,omitempty"`
+	Published        string            `json:"published,omitempty"`
+	Maintainers      []string          `json:"maintainers,omitempty"`
+}
+
+type maintainer struct {
+	Name string `json:"name"`
+}
+
+type manifest struct {
+	Name             string            `json:"name"`
+	Version          string            `json:"version"`
+	Dist             dist              `json:"dist"`
+	Scripts          map[string]string `json:"scripts"`
+	HasInstallScript bool              `json:"hasInstallScript"`
+	// a message, some packuments carry false instead
+	Deprecated  interface{}  `json:"deprecated"`
+	Maintainers []maintainer `json:"maintainers"`
+}
+
+// document is a packument or, for /<name>/<version>, a single manifest
+type document struct {
+	manifest
+	DistTags map[string]string   `json:"dist-tags"`
+	Versions map[string]manifest `json:"versions"`
+	Time     map[string]string   `json:"time"`
+}
+
+func (m manifest) metadata(name string, time map[string]string, maintainers []maintainer) Metadata {
+	md := Metadata{
+		Name:             name,
+		Version:          m.Version,
+		Integrity:        m.Dist.Integrity,
+		HasInstallScript: m.HasInstallScript,
+		Published:        time[m.Version],
+	}
+	if s, ok := m.Deprecated.(string); ok {
+		md.Deprecated = s
+	}
+	for _, script := range installScripts {
+		if cmd, ok := m.Scripts[script]; ok {
+			if md.Scripts == nil {
+				md.Scripts = make(map[string]string)
+			}
+			md.Scripts[script] = cmd
+			md.HasInstallScript = true
+		}
+	}
+	if len(m.Maintainers) > 0 {
+		maintainers = m.Maintainers
+	}
+	for _, mt := range maintainers {
+		md.Maintainers = append(md.Maintainers, mt.Name)
+	}
+	return md
+}
+
+// Packument reads the packument of npm metadata activities
+type Packument struct {
+	Response *http.Response
+	// Digests keeps the dist digests of the versions listed, by package, for
+	// the registry to publish once a tarball is downloaded
+	Digests *integrity.Versions
+	// Versions is the metadata of every version listed
+	Versions []Metadata
+	// Resolved is the version requested, or the latest one, nil when the
+	// packument lists neither
+	Resolved *Metadata
+}
+
+func (p *Packument) Handle(ctx context.Context, r io.Reader) error {
+	act, ok := ctx.Value(utils.ActCtxKey).(*session.Activity)
+	if !ok || act.Name != model.NPM || act.Action != "metadata" {
+		return nil
+	}
+	pkg, ok := act.Activity.(model.PackageActivity)
+	if !ok {
+		return nil
+	}
+	if p.Response == nil || p.Response.StatusCode != http.StatusOK {
+		return nil
+	}
+	if p.Response.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil
+		}
+		defer zr.Close()
+		r = zr
+	}
+	var doc document
+	if err := json.NewDecoder(io.LimitReader(r, maxPackument)).Decode(&doc); err != nil {
+		return err
+	}
+	name := doc.Name
+	if name == "" {
+		name = pkg.Package
+	}
+	// a single version document
+	if doc.Versions == nil {
+		if doc.Version == "" {
+			return nil
+		}
+		md := doc.manifest.metadata(name, doc.Time, nil)
+		p.Versions = []Metadata{md}
+		p.Resolved = &p.Versions[0]
+		p.keep(pkg.Package, map[string]manifest{doc.Version: doc.manifest})
+		return nil
+	}
+	versions := make([]string, 0, len(doc.Versions))
+	for v := range doc.Versions {
+		versions = append(versions, v)
+	}
+	sort.Strings(versions)
+	resolved := pkg.Version
+	if tag, ok := doc.DistTags[resolved]; ok {
+		resolved = tag
+	}
+	if resolved == "" {
+		resolved = doc.DistTags["latest"]
+	}
+	for _, v := range versions {
+		m := doc.Versions[v]
+		if m.Version == "" {
+			m.Version = v
+		}
+		p.Versions = append(p.Versions, m.metadata(name, doc.Time, doc.Maintainers))
+	}
+	for i := range p.Versions {
+		if p.Versions[i].Version == resolved {
+			p.Resolved = &p.Versions[i]
+		}
+	}
+	p.keep(pkg.Package, doc.Versions)
+	return nil
+}
+
+// keep records the dist digests of the versions of pkg in Digests
+func (p *Packument) keep(pkg string, versions map[string]manifest) {
+	if p.Digests == nil || p.Response.Request == nil {
+		return
+	}
+	kept := make(map[string][]integrity.Digest, len(versions))
+	for v, m := range versions {
+		if d := digests(p.Response.Request.URL, m.Dist); len(d) > 0 {
+			kept[v] = d
+		}
+	}
+	p.Digests.Put(pkg, kept)
+}
+
+// Store is an LRU of the metadata of the packuments read, by package, looked
+// up when the tarballs of their versions are downloaded. It is bounded by the
+// approximate size of the metadata, packuments such as those of typescript
+// list thousands of versions.
+type Store struct {
+	packages *utils.LRU[string, map[string]Metadata]
+}
+
+// NewStore returns a Store keeping up to size bytes of metadata
+func NewStore(size int) *Store {
+	return &Store{packages: utils.NewLRUCost[string, map[string]Metadata](size, metadataCost)}
+}
+
+func metadataCost(mds map[string]Metadata) int {
+	cost := 0
+	for v, md := range mds {
+		cost += len(v) + len(md.Name) + len(md.Version) + len(md.Integrity) + len(md.Deprecated) + len(md.Published)
+		for script, cmd := range md.Scripts {
+			cost += len(script) + len(cmd)
+		}
+		for _, mt := range md.Maintainers {
+			cost += len(mt)
+		}
+	}
+	return cost
+}
+
+// Put records the versions of a package, replacing those recorded before
+func (s *Store) Put(pkg string, versions []Metadata) {
+	if len(versions) == 0 {
+		return
+	}
+	mds := make(map[string]Metadata, len(versions))
+	for _, md := range versions {
+		mds[md.Version] = md
+	}
+	s.packages.Update(strings.ToLower(pkg), func(prev map[string]Metadata, ok bool) map[string]Metadata {
+		// a single version document adds to the packument read before
+		for v, md := range prev {
+			if _, ok := mds[v]; !ok {
+				mds[v] = md
+			}
+		}
+		return mds
+	})
+}
+
+func (s *Store) Get(pkg, ver string) (Metadata, bool) {
+	mds, ok := s.packages.Get(strings.ToLower(pkg))
+	if !ok {
+		return Metadata{}, false
+	}
+	md, ok := mds[ver]
+	return md, ok
+}
@@ -0,0 +1,83 @@
+package nuget
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/invisirisk/svcs/model"
+	"inivisirisk.com/pse/integrity"
+)
+
+// registry reads the packageHash of catalog entries, wherever they appear in
+// a JSON response
+type registry struct{}
+
+func NewRegistry() integrity.Registry {
+	return registry{}
+}
+
+// key names a package by its purl, package content URLs vary between feeds
+func key(pkg, ver string) string {
+	return strings.ToLower(fmt.Sprintf("pkg:%s/%s@%s", model.Nuget, pkg, ver))
+}
+
+// catalogEntries walks v for objects with an id, a version and a packageHash
+func catalogEntries(v interface{}, digests []integrity.Digest) []integrity.Digest {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		id, _ := v["id"].(string)
+		ver, _ := v["version"].(string)
+		hash, _ := v["packageHash"].(string)
+		if id != "" && ver != "" && hash != "" {
+			alg, _ := v["packageHashAlgorithm"].(string)
+			if alg == "" {
+				alg = integrity.SHA512
+			}
+			raw, err := base64.StdEncoding.DecodeString(hash)
+			if err == nil {
+				digests = append(digests, integrity.Digest{
+					Key:       key(id, ver),
+					Algorithm: strings.ToLower(alg),
+					Value:     hex.EncodeToString(raw),
+					Source:    "nuget packageHash",
+				})
+			}
+		}
+		for _, child := range v {
+			digests = catalogEntries(child, digests)
+		}
+	case []interface{}:
+		for _, child := range v {
+			digests = catalogEntries(child, digests)
+		}
+	}
+	return digests
+}
+
+func (registry) Published(rsp *http.Response, body io.Reader) ([]integrity.Digest, error) {
+	if !strings.Contains(rsp.Header.Get("Content-Type"), "json") && !strings.HasSuffix(rsp.Request.URL.Path, ".json") {
+		return nil, nil
+	}
+	var doc interface{}
+	if err := json.NewDecoder(body).Decode(&doc); err != nil {
+		return nil, err
+	}
+	return catalogEntries(doc, nil), nil
+}
+
+func (registry) Key(u *url.URL) string {
+	if strings.HasSuffix(strings.ToLower(u.Path), ".nuspec") {
+		return ""
+	}
+	pkg, ver, ok := parseNugetURL(u.Path)
+	if !ok {
+		return ""
+	}
+	return key(pkg, ver)
+}
@@ -3,10 +3,12 @@ package nuget
 import (
 	"net/http"
 	"net/url"
+	"strings"
 	"testing"
 
 	"github.com/invisirisk/svcs/model"
 	"github.com/stretchr/testify/assert"
+	"inivisirisk.com/pse/integrity"
 	"inivisirisk.com/pse/policy"
 	"inivisirisk.com/pse/session"
 )
@@ -219,3 +221,21 @@ func TestHandle(t *testing.T) {
 		})
 	}
 }
+
+func TestPublished(t *testing.T) {
+	reg := NewRegistry()
+	leaf := `{"@type": ["PackageDetails", "catalog:Permalink"], "id": "Newtonsoft.Json", "version": "13.0.1",
+		"packageHash": "3uGaGWRKn5pX4tjr6HSqBTL2n7T2tAbJI7Lgwvt2ZhiOaFJQi2RwHW8dIuCZj+zhROwWYzFyBmrrcuSQGIBBNQ==",
+		"packageHashAlgorithm": "SHA512"}`
+	req, _ := http.NewRequest("GET", "https://api.nuget.org/v3/catalog0/data/2021.03.22.20.12.18/newtonsoft.json.13.0.1.json", nil)
+	digests, err := reg.Published(&http.Response{Request: req, Header: http.Header{"Content-Type": {"application/json"}}}, strings.NewReader(leaf))
+	assert.NoError(t, err)
+	assert.Len(t, digests, 1)
+	assert.Equal(t, integrity.SHA512, digests[0].Algorithm)
+	assert.Len(t, digests[0].Value, 128)
+
+	nupkg, _ := url.Parse("https://api.nuget.org/v3/flatcontainer/newtonsoft.json/13.0.1/newtonsoft.json.13.0.1.nupkg")
+	assert.Equal(t, digests[0].Key, reg.Key(nupkg))
+	nuspec, _ := url.Parse("https://api.nuget.org/v3/flatcontainer/newtonsoft.json/13.0.1/newtonsoft.json.nuspec")
+	assert.Empty(t, reg.Key(nuspec))
+}
@@ -0,0 +1,54 @@
+package oci
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"inivisirisk.com/pse/integrity"
+)
+
+// registry publishes the digest manifests and blobs are requested by, which
+// addresses their content, storage URLs are known by the blob redirected to
+// them
+type registry struct {
+	images *Store
+}
+
+// NewRegistry returns the integrity data of registries, images holds the
+// redirects of blob downloads
+func NewRegistry(images *Store) integrity.Registry {
+	return registry{images: images}
+}
+
+func (r registry) Published(rsp *http.Response, body io.Reader) ([]integrity.Digest, error) {
+	key := r.Key(rsp.Request.URL)
+	if key == "" {
+		return nil, nil
+	}
+	algorithm, value, _ := strings.Cut(key, ":")
+	return []integrity.Digest{{
+		Key:       key,
+		Algorithm: algorithm,
+		Value:     value,
+		Source:    "oci content digest",
+	}}, nil
+}
+
+// Key is the digest of the manifest or blob, "" for tags and for algorithms
+// that are not computed
+func (r registry) Key(u *url.URL) string {
+	digest := ""
+	if _, _, ref, ok := parse(u.Path); ok && isDigest(ref) {
+		digest = ref
+	} else if img, ok := r.images.Redirected(u); ok {
+		digest = img.Digest
+	}
+	algorithm, _, _ := strings.Cut(digest, ":")
+	switch algorithm {
+	case integrity.SHA256, integrity.SHA512:
+		return strings.ToLower(digest)
+	}
+	return ""
+}
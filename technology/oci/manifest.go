@@ -0,0 +1,147 @@
+package oci
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+
+	"inivisirisk.com/pse/session"
+	"inivisirisk.com/pse/utils"
+)
+
+const (
+	// maxManifest bounds the manifest read, registries refuse manifests
+	// over 4 MiB
+	maxManifest = 4 << 20
+
+	// DigestHeader carries the digest of the manifest a registry serves
+	DigestHeader = "Docker-Content-Digest"
+)
+
+// Metadata is what a manifest tells about an image, for the policy to weigh
+// pulling it
+type Metadata struct {
+	Digest    string `json:"digest"`
+	MediaType string `json:"media_type,omitempty"`
+	// Config and Layers are the blobs of an image manifest
+	Config string   `json:"config,omitempty"`
+	Layers []string `json:"layers,omitempty"`
+	// Manifests are the platform manifests of an index
+	Manifests []string `json:"manifests,omitempty"`
+}
+
+// Refs are the digests of the manifests and blobs the manifest references
+func (md *Metadata) Refs() []string {
+	var refs []string
+	if md.Config != "" {
+		refs = append(refs, md.Config)
+	}
+	refs = append(refs, md.Layers...)
+	return append(refs, md.Manifests...)
+}
+
+type descriptor struct {
+	Digest string `json:"digest"`
+}
+
+type document struct {
+	MediaType string       `json:"mediaType"`
+	Config    descriptor   `json:"config"`
+	Layers    []descriptor `json:"layers"`
+	Manifests []descriptor `json:"manifests"`
+	// schema 1 manifests Docker no longer pushes
+	FSLayers []struct {
+		BlobSum string `json:"blobSum"`
+	} `json:"fsLayers"`
+}
+
+// newHash returns the hash of algorithm, nil for algorithms not verified
+func newHash(algorithm string) hash.Hash {
+	switch algorithm {
+	case "sha256":
+		return sha256.New()
+	case "sha512":
+		return sha512.New()
+	}
+	return nil
+}
+
+// Manifest reads the manifests of OCI metadata activities, their digest is
+// computed from the body with the algorithm the registry names in its
+// Docker-Content-Digest header. HEAD requests resolve tags with the header
+// alone.
+type Manifest struct {
+	Response *http.Response
+	Metadata *Metadata
+}
+
+func (m *Manifest) Handle(ctx context.Context, r io.Reader) error {
+	act, ok := ctx.Value(utils.ActCtxKey).(*session.Activity)
+	if !ok || act.Name != OCI || act.Action != "metadata" {
+		return nil
+	}
+	if m.Response == nil || m.Response.StatusCode != http.StatusOK || m.Response.Request.Method != http.MethodGet {
+		return nil
+	}
+	if m.Response.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil
+		}
+		defer zr.Close()
+		r = zr
+	}
+	algorithm := "sha256"
+	if header, _, ok := strings.Cut(m.Response.Header.Get(DigestHeader), ":"); ok && newHash(header) != nil {
+		algorithm = header
+	}
+	h := newHash(algorithm)
+	body := io.TeeReader(io.LimitReader(r, maxManifest), h)
+	var doc document
+	// the digest covers the whole body, whatever json reads of it
+	err := json.NewDecoder(body).Decode(&doc)
+	if _, cerr := io.Copy(io.Discard, body); cerr != nil {
+		return nil
+	}
+	md := &Metadata{Digest: algorithm + ":" + hex.EncodeToString(h.Sum(nil))}
+	if err == nil {
+		md.MediaType = doc.MediaType
+		if md.MediaType == "" {
+			md.MediaType = m.Response.Header.Get("Content-Type")
+		}
+		md.Config = doc.Config.Digest
+		for _, l := range doc.Layers {
+			md.Layers = append(md.Layers, l.Digest)
+		}
+		for _, l := range doc.FSLayers {
+			md.Layers = append(md.Layers, l.BlobSum)
+		}
+		for _, d := range doc.Manifests {
+			md.Manifests = append(md.Manifests, d.Digest)
+		}
+	}
+	m.Metadata = md
+	return nil
+}
+
+// Digest returns the digest of the manifest served, read from the body or,
+// for HEAD requests, the header
+func (m *Manifest) Digest() string {
+	if m.Metadata != nil {
+		return m.Metadata.Digest
+	}
+	if m.Response == nil || m.Response.StatusCode != http.StatusOK {
+		return ""
+	}
+	if d := m.Response.Header.Get(DigestHeader); isDigest(d) {
+		return d
+	}
+	return ""
+}
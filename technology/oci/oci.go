@@ -0,0 +1,173 @@
+package oci
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/invisirisk/svcs/model"
+	"inivisirisk.com/pse/policy"
+	"inivisirisk.com/pse/session"
+)
+
+// OCI names the activities of container registries
+const OCI model.ActivityName = "oci"
+
+// kinds of registry objects
+const (
+	KindManifest = "manifest"
+	KindBlob     = "blob"
+)
+
+// Registry API paths of the distribution spec:
+//   - /v2/{name}/manifests/{tag or digest}, resolving a tag or reading an
+//     image manifest or index
+//   - /v2/{name}/blobs/{digest}, config and layers, which Docker Hub, GHCR,
+//     ECR and Quay redirect to their storage
+//
+// Names have path components, library/alpine on Docker Hub, and some hosts
+// serve registries below a path of their own.
+var (
+	namePattern   = regexp.MustCompile(`^[a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*(/[a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*)*$`)
+	tagPattern    = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}$`)
+	digestPattern = regexp.MustCompile(`^[a-z0-9]+([+._-][a-z0-9]+)*:[a-zA-Z0-9=_-]+$`)
+)
+
+// Image is an image of a registry, named by tag, digest or both
+type Image struct {
+	Host   string
+	Name   string
+	Tag    string
+	Digest string
+}
+
+func isDigest(ref string) bool {
+	return digestPattern.MatchString(ref)
+}
+
+// parse returns the image name, the kind of object and the tag or digest of
+// a registry API path
+func parse(p string) (name, kind, ref string, ok bool) {
+	i := strings.Index(p, "/v2/")
+	if i < 0 {
+		return "", "", "", false
+	}
+	p = p[i+len("/v2/"):]
+	for _, k := range []string{KindManifest, KindBlob} {
+		sep := "/" + k + "s/"
+		j := strings.LastIndex(p, sep)
+		if j <= 0 {
+			continue
+		}
+		name, ref = p[:j], p[j+len(sep):]
+		if !namePattern.MatchString(name) {
+			continue
+		}
+		// blobs are content addressed, uploads do not match
+		if isDigest(ref) || k == KindManifest && tagPattern.MatchString(ref) {
+			return name, k, ref, true
+		}
+	}
+	return "", "", "", false
+}
+
+// repository names the image as its registry is known by, Docker Hub serves
+// docker.io from other hosts
+func repository(host, name string) string {
+	switch strings.ToLower(host) {
+	case "registry-1.docker.io", "index.docker.io", "registry.hub.docker.com":
+		host = "docker.io"
+	}
+	return strings.ToLower(host) + "/" + name
+}
+
+func (img Image) Purl() string {
+	purl := fmt.Sprintf("pkg:%s/%s", OCI, path.Base(img.Name))
+	if img.Digest != "" {
+		purl += "@" + strings.ReplaceAll(url.PathEscape(img.Digest), ":", "%3A")
+	}
+	q := url.Values{}
+	q.Set("repository_url", repository(img.Host, img.Name))
+	if img.Tag != "" {
+		q.Set("tag", img.Tag)
+	}
+	return purl + "?" + q.Encode()
+}
+
+// Activity details an activity on kind of the image
+func (img Image) Activity(kind string) session.ImageActivity {
+	version := img.Digest
+	if version == "" {
+		version = img.Tag
+	}
+	return session.ImageActivity{
+		PackageActivity: model.PackageActivity{
+			Repo:    img.Host,
+			Package: img.Name,
+			Version: version,
+			Purl:    img.Purl(),
+		},
+		Kind:   kind,
+		Tag:    img.Tag,
+		Digest: img.Digest,
+	}
+}
+
+func activity(img Image, kind string) *session.Activity {
+	action := "get"
+	if kind == KindManifest {
+		action = "metadata"
+	}
+	return &session.Activity{
+		ActivityHdr: model.ActivityHdr{
+			Name:   OCI,
+			Action: action,
+		},
+		Activity: img.Activity(kind),
+	}
+}
+
+// Handle records manifest requests as metadata and blob downloads as get.
+// Tags are resolved to the digest their manifest was last read with, the
+// response tells the current one, and digests to the tag of the image
+// referencing them.
+func Handle(p *policy.Policy, images *Store, path string, r *http.Request) *session.Activity {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return session.NilActivity
+	}
+	name, kind, ref, ok := parse(path)
+	if !ok {
+		return session.NilActivity
+	}
+	img := Image{Host: r.Host, Name: name}
+	if isDigest(ref) {
+		img.Digest = ref
+	} else {
+		img.Tag = ref
+	}
+	if known, ok := images.Get(img); ok {
+		if img.Tag == "" {
+			img.Tag = known.Tag
+		}
+		if img.Digest == "" {
+			img.Digest = known.Digest
+		}
+	}
+	return activity(img, kind)
+}
+
+// Redirected records downloads of blobs the registry redirected to its
+// storage, nil for other requests
+func Redirected(images *Store, r *http.Request) *session.Activity {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return nil
+	}
+	img, ok := images.Redirected(r.URL)
+	if !ok {
+		return nil
+	}
+	return activity(img, KindBlob)
+}
@@ -0,0 +1,163 @@
+package oci
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/invisirisk/svcs/model"
+	"github.com/stretchr/testify/assert"
+	"inivisirisk.com/pse/integrity"
+	"inivisirisk.com/pse/policy"
+	"inivisirisk.com/pse/session"
+	"inivisirisk.com/pse/utils"
+)
+
+const digest = "sha256:6457d53fb065d6f250e1504b9bc42d5b6c65941d57532c072d929dd0628977d0"
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		path string
+		name string
+		kind string
+		ref  string
+		ok   bool
+	}{
+		{"/v2/library/alpine/manifests/3.19", "library/alpine", KindManifest, "3.19", true},
+		{"/v2/library/alpine/manifests/" + digest, "library/alpine", KindManifest, digest, true},
+		{"/v2/library/alpine/blobs/" + digest, "library/alpine", KindBlob, digest, true},
+		{"/v2/org/team/app/manifests/v1.2.0-rc.1", "org/team/app", KindManifest, "v1.2.0-rc.1", true},
+		{"/artifactory/api/docker/docker-remote/v2/nginx/manifests/latest", "nginx", KindManifest, "latest", true},
+		{"/v2/app/manifests/x/blobs/" + digest, "app/manifests/x", KindBlob, digest, true},
+		{"/v2/library/alpine/blobs/uploads/", "", "", "", false},
+		{"/v2/library/alpine/blobs/latest", "", "", "", false},
+		{"/v2/Library/alpine/manifests/latest", "", "", "", false},
+		{"/v2/library/alpine/tags/list", "", "", "", false},
+		{"/v2/", "", "", "", false},
+	}
+	for _, tt := range tests {
+		name, kind, ref, ok := parse(tt.path)
+		assert.Equal(t, tt.ok, ok, tt.path)
+		assert.Equal(t, tt.name, name, tt.path)
+		assert.Equal(t, tt.kind, kind, tt.path)
+		assert.Equal(t, tt.ref, ref, tt.path)
+	}
+}
+
+func TestPurl(t *testing.T) {
+	img := Image{Host: "registry-1.docker.io", Name: "library/alpine", Tag: "3.19", Digest: digest}
+	assert.Equal(t, "pkg:oci/alpine@sha256%3A6457d53fb065d6f250e1504b9bc42d5b6c65941d57532c072d929dd0628977d0?repository_url=docker.io%2Flibrary%2Falpine&tag=3.19", img.Purl())
+	img = Image{Host: "ghcr.io", Name: "acme/tools/builder", Tag: "main"}
+	assert.Equal(t, "pkg:oci/builder?repository_url=ghcr.io%2Facme%2Ftools%2Fbuilder&tag=main", img.Purl())
+}
+
+func TestHandle(t *testing.T) {
+	images := NewStore(16)
+	images.Put(Image{Host: "ghcr.io", Name: "acme/app", Tag: "v1", Digest: digest}, []string{"sha256:aa"})
+	tests := []struct {
+		method string
+		path   string
+		action string
+		image  Image
+	}{
+		{"GET", "/v2/acme/app/manifests/v1", "metadata", Image{Host: "ghcr.io", Name: "acme/app", Tag: "v1", Digest: digest}},
+		{"HEAD", "/v2/acme/app/manifests/v2", "metadata", Image{Host: "ghcr.io", Name: "acme/app", Tag: "v2"}},
+		{"GET", "/v2/acme/app/blobs/sha256:aa", "get", Image{Host: "ghcr.io", Name: "acme/app", Tag: "v1", Digest: "sha256:aa"}},
+		{"GET", "/v2/acme/other/blobs/sha256:aa", "get", Image{Host: "ghcr.io", Name: "acme/other", Digest: "sha256:aa"}},
+		{"PUT", "/v2/acme/app/manifests/v1", "", Image{}},
+		{"GET", "/v2/_catalog", "", Image{}},
+	}
+	for _, tt := range tests {
+		r := &http.Request{Method: tt.method, Host: "ghcr.io", URL: &url.URL{Host: "ghcr.io", Path: tt.path}}
+		act := Handle(&policy.Policy{}, images, tt.path, r)
+		if tt.action == "" {
+			assert.Equal(t, session.NilActivity, act, tt.path)
+			continue
+		}
+		assert.Equal(t, OCI, act.Name, tt.path)
+		assert.Equal(t, tt.action, act.Action, tt.path)
+		kind := KindBlob
+		if tt.action == "metadata" {
+			kind = KindManifest
+		}
+		assert.Equal(t, tt.image.Activity(kind), act.Activity, tt.path)
+	}
+	r := &http.Request{Method: "GET", Host: "ghcr.io", URL: &url.URL{Host: "ghcr.io", Path: "/v2/acme/app/manifests/v1"}}
+	act := Handle(&policy.Policy{}, nil, r.URL.Path, r)
+	assert.Equal(t, "v1", act.Activity.(session.ImageActivity).Version)
+}
+
+func TestStore(t *testing.T) {
+	images := NewStore(3)
+	img := Image{Host: "Quay.io", Name: "acme/app", Tag: "v1", Digest: digest}
+	images.Put(img, []string{"sha256:aa"})
+	got, ok := images.Get(Image{Host: "quay.io", Name: "acme/app", Tag: "v1"})
+	assert.True(t, ok)
+	assert.Equal(t, digest, got.Digest)
+	got, ok = images.Get(Image{Host: "quay.io", Name: "acme/app", Digest: "sha256:aa"})
+	assert.True(t, ok)
+	assert.Equal(t, "v1", got.Tag)
+
+	storage, _ := url.Parse("https://cdn.quay.io/sha256/aa/aa?signature=x")
+	images.Redirect(storage, got)
+	_, ok = images.Get(img)
+	assert.False(t, ok, "oldest entry evicted")
+	got, ok = images.Redirected(&url.URL{Host: "CDN.quay.io", Path: "/sha256/aa/aa"})
+	assert.True(t, ok)
+	assert.Equal(t, "sha256:aa", got.Digest)
+
+	var none *Store
+	_, ok = none.Redirected(storage)
+	assert.False(t, ok)
+}
+
+func TestManifest(t *testing.T) {
+	index := `{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.index.v1+json",
+		"manifests": [{"digest": "sha256:aa", "platform": {"os": "linux"}}, {"digest": "sha256:bb"}]}`
+	sum := sha256.Sum256([]byte(index))
+	act := &session.Activity{ActivityHdr: model.ActivityHdr{Name: OCI, Action: "metadata"}}
+	ctx := context.WithValue(context.Background(), utils.ActCtxKey, act)
+
+	req, _ := http.NewRequest("GET", "https://ghcr.io/v2/acme/app/manifests/v1", nil)
+	m := &Manifest{Response: &http.Response{StatusCode: http.StatusOK, Request: req, Header: http.Header{}}}
+	assert.NoError(t, m.Handle(ctx, strings.NewReader(index)))
+	assert.Equal(t, &Metadata{
+		Digest:    "sha256:" + hex.EncodeToString(sum[:]),
+		MediaType: "application/vnd.oci.image.index.v1+json",
+		Manifests: []string{"sha256:aa", "sha256:bb"},
+	}, m.Metadata)
+	assert.Equal(t, []string{"sha256:aa", "sha256:bb"}, m.Metadata.Refs())
+	assert.Equal(t, m.Metadata.Digest, m.Digest())
+
+	// HEAD requests resolve the tag by the header
+	req, _ = http.NewRequest("HEAD", "https://ghcr.io/v2/acme/app/manifests/v1", nil)
+	m = &Manifest{Response: &http.Response{StatusCode: http.StatusOK, Request: req, Header: http.Header{DigestHeader: {digest}}}}
+	assert.NoError(t, m.Handle(ctx, strings.NewReader("")))
+	assert.Nil(t, m.Metadata)
+	assert.Equal(t, digest, m.Digest())
+}
+
+func TestRegistry(t *testing.T) {
+	images := NewStore(16)
+	reg := NewRegistry(images)
+	blob, _ := url.Parse("https://ghcr.io/v2/acme/app/blobs/" + digest)
+	assert.Equal(t, digest, reg.Key(blob))
+	tag, _ := url.Parse("https://ghcr.io/v2/acme/app/manifests/v1")
+	assert.Empty(t, reg.Key(tag))
+	md5, _ := url.Parse("https://ghcr.io/v2/acme/app/blobs/md5:aa")
+	assert.Empty(t, reg.Key(md5))
+
+	storage, _ := url.Parse("https://pkg-containers.githubusercontent.com/ghcr1/blobs/sha256:aa?se=x")
+	assert.Empty(t, reg.Key(storage))
+	images.Redirect(storage, Image{Host: "ghcr.io", Name: "acme/app", Digest: digest})
+	assert.Equal(t, digest, reg.Key(storage))
+
+	req := &http.Request{Method: "GET", URL: storage}
+	digests, err := reg.Published(&http.Response{Request: req}, strings.NewReader("layer"))
+	assert.NoError(t, err)
+	assert.Equal(t, []integrity.Digest{{Key: digest, Algorithm: integrity.SHA256, Value: digest[len("sha256:"):], Source: "oci content digest"}}, digests)
+}
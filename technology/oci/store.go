@@ -0,0 +1,75 @@
+package oci
+
+import (
+	"net/url"
+	"strings"
+
+	"inivisirisk.com/pse/integrity"
+	"inivisirisk.com/pse/utils"
+)
+
+// Store is a fixed size LRU of the images read from registries, by tag and by
+// the digests of the manifests and blobs they reference, and of the storage
+// URLs blob downloads were redirected to
+type Store struct {
+	images *utils.LRU[string, Image]
+}
+
+func NewStore(size int) *Store {
+	return &Store{images: utils.NewLRU[string, Image](size)}
+}
+
+func tagKey(img Image) string {
+	return strings.ToLower(img.Host) + "/" + img.Name + ":" + img.Tag
+}
+
+func digestKey(img Image, digest string) string {
+	return strings.ToLower(img.Host) + "/" + img.Name + "@" + digest
+}
+
+func redirectKey(u *url.URL) string {
+	return "redirect " + integrity.URLKey(u)
+}
+
+func (s *Store) get(key string) (Image, bool) {
+	if s == nil {
+		return Image{}, false
+	}
+	return s.images.Get(key)
+}
+
+// Put records the digest of the manifest img was read with and the digests
+// of the manifests and blobs it references, which are read next
+func (s *Store) Put(img Image, refs []string) {
+	if img.Digest == "" {
+		return
+	}
+	if img.Tag != "" {
+		s.images.Put(tagKey(img), img)
+	}
+	s.images.Put(digestKey(img, img.Digest), img)
+	for _, ref := range refs {
+		child := img
+		child.Digest = ref
+		s.images.Put(digestKey(img, ref), child)
+	}
+}
+
+// Get returns the image named by the tag or, when set, the digest of img
+func (s *Store) Get(img Image) (Image, bool) {
+	if img.Digest != "" {
+		return s.get(digestKey(img, img.Digest))
+	}
+	return s.get(tagKey(img))
+}
+
+// Redirect records the storage URL the download of the blob img was
+// redirected to
+func (s *Store) Redirect(u *url.URL, img Image) {
+	s.images.Put(redirectKey(u), img)
+}
+
+// Redirected returns the blob downloaded from the storage URL u
+func (s *Store) Redirected(u *url.URL) (Image, bool) {
+	return s.get(redirectKey(u))
+}
@@ -0,0 +1,111 @@
+package pypi
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"regexp"
+	"strings"
+
+	"inivisirisk.com/pse/integrity"
+)
+
+// registry reads the hashes of the Simple API, in its PEP 503 HTML and
+// PEP 691 JSON forms, and the digests of the JSON API. Of the JSON API only
+// the files of the version resolved are published, not those of every
+// release.
+type registry struct{}
+
+func NewRegistry() integrity.Registry {
+	return registry{}
+}
+
+var (
+	hrefPattern = regexp.MustCompile(`(?i)href\s*=\s*"([^"]+)"`)
+)
+
+// file is a distribution in the Simple JSON and the JSON API, which name the
+// digests hashes and digests respectively
+type file struct {
+	URL     string            `json:"url"`
+	Hashes  map[string]string `json:"hashes"`
+	Digests map[string]string `json:"digests"`
+}
+
+type index struct {
+	// Simple API
+	Files []file `json:"files"`
+	// JSON API, the files of the latest or the requested version
+	URLs []file `json:"urls"`
+}
+
+// digest returns the digest of the distribution at ref, relative to base
+func digest(base *neturl.URL, ref, algorithm, value, source string) (integrity.Digest, bool) {
+	switch algorithm {
+	case integrity.SHA1, integrity.SHA256, integrity.SHA512:
+	default:
+		return integrity.Digest{}, false
+	}
+	u, err := base.Parse(ref)
+	if err != nil || value == "" {
+		return integrity.Digest{}, false
+	}
+	return integrity.Digest{Key: integrity.URLKey(u), Algorithm: algorithm, Value: strings.ToLower(value), Source: source}, true
+}
+
+func (registry) Published(rsp *http.Response, body io.Reader) ([]integrity.Digest, error) {
+	base := rsp.Request.URL
+	if _, _, ok := parse(base.Path); ok {
+		return nil, nil
+	}
+	var digests []integrity.Digest
+	if strings.Contains(rsp.Header.Get("Content-Type"), "json") {
+		var doc index
+		if err := json.NewDecoder(body).Decode(&doc); err != nil {
+			return nil, err
+		}
+		add := func(files []file, source string) {
+			for _, f := range files {
+				hashes := f.Hashes
+				if hashes == nil {
+					hashes = f.Digests
+				}
+				for alg, value := range hashes {
+					if d, ok := digest(base, f.URL, alg, value, source); ok {
+						digests = append(digests, d)
+					}
+				}
+			}
+		}
+		add(doc.Files, "pypi simple hashes")
+		add(doc.URLs, "pypi json digests")
+		return digests, nil
+	}
+	if !strings.Contains(rsp.Header.Get("Content-Type"), "html") {
+		return nil, nil
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	// PEP 503 links carry the hash as #<algorithm>=<value>
+	for _, m := range hrefPattern.FindAllStringSubmatch(string(data), -1) {
+		ref, fragment, ok := strings.Cut(strings.ReplaceAll(m[1], "&amp;", "&"), "#")
+		if !ok {
+			continue
+		}
+		alg, value, _ := strings.Cut(fragment, "=")
+		if d, ok := digest(base, ref, alg, value, "pypi simple #"+alg); ok {
+			digests = append(digests, d)
+		}
+	}
+	return digests, nil
+}
+
+func (registry) Key(u *neturl.URL) string {
+	if _, _, ok := parse(u.Path); !ok {
+		return ""
+	}
+	return integrity.URLKey(u)
+}
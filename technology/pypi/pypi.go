@@ -3,7 +3,9 @@ package pypi
 import (
 	"fmt"
 	"net/http"
+	neturl "net/url"
 	"path"
+	"regexp"
 	"strings"
 
 	"github.com/invisirisk/svcs/model"
@@ -11,57 +13,150 @@ import (
 	"inivisirisk.com/pse/session"
 )
 
-func parse(url string) (string, string, bool) {
+var (
+	// runs of separators PEP 503 folds into a single dash
+	separators = regexp.MustCompile(`[-_.]+`)
+	// sdist archives, PEP 625 settles on .tar.gz but indexes still serve the
+	// legacy formats
+	sdistExtensions = []string{".tar.gz", ".tar.bz2", ".tar.xz", ".tgz", ".zip"}
+)
 
-	filename := path.Base(url)
-	parts := strings.Split(filename, "-")
-	if len(parts) < 3 {
-		return "", "", false
-	}
+// dist is a distribution file, a wheel named per PEP 427
+// {name}-{version}(-{build})?-{python}-{abi}-{platform}.whl or an sdist
+// named {name}-{version}.tar.gz
+type dist struct {
+	Name     string
+	Version  string
+	Build    string
+	Python   string
+	ABI      string
+	Platform string
+}
+
+// normalize returns the PEP 503 normalized form of a project name
+func normalize(name string) string {
+	return strings.ToLower(separators.ReplaceAllString(name, "-"))
+}
+
+// isVersion reports whether s can start a PEP 440 version, an epoch or a
+// release segment
+func isVersion(s string) bool {
+	s = strings.TrimPrefix(strings.ToLower(s), "v")
+	return s != "" && s[0] >= '0' && s[0] <= '9'
+}
 
-	versionIndex := -1
-	for i, part := range parts {
-		// Assumes the version starts with a digit/number
-		if strings.HasPrefix(part, "0") || strings.HasPrefix(part, "1") || strings.HasPrefix(part, "2") ||
-			strings.HasPrefix(part, "3") || strings.HasPrefix(part, "4") || strings.HasPrefix(part, "5") ||
-			strings.HasPrefix(part, "6") || strings.HasPrefix(part, "7") || strings.HasPrefix(part, "8") ||
-			strings.HasPrefix(part, "9") {
-			versionIndex = i
-			break
+// Purl is the package URL of the distribution, wheels carry their build and
+// compatibility tags as qualifiers
+func (d dist) Purl() string {
+	purl := fmt.Sprintf("pkg:%s/%s", model.Pypi, d.Name)
+	if d.Version != "" {
+		purl += "@" + neturl.PathEscape(d.Version)
+	}
+	q := neturl.Values{}
+	for k, v := range map[string]string{"build": d.Build, "python": d.Python, "abi": d.ABI, "platform": d.Platform} {
+		if v != "" {
+			q.Set(k, v)
 		}
 	}
-
-	if versionIndex == -1 {
-		return "", "", false
+	if len(q) > 0 {
+		purl += "?" + q.Encode()
 	}
-	pkg := strings.Join(parts[:versionIndex], "-")
-	ver := parts[versionIndex]
-	return pkg, ver, true
+	return purl
+}
 
+func parseWheel(name string) (dist, bool) {
+	parts := strings.Split(strings.TrimSuffix(name, ".whl"), "-")
+	if len(parts) < 5 {
+		return dist{}, false
+	}
+	n := len(parts)
+	d := dist{Python: parts[n-3], ABI: parts[n-2], Platform: parts[n-1]}
+	parts = parts[:n-3]
+	// the optional build tag starts with a digit, as the version does
+	if n := len(parts); n >= 3 && isVersion(parts[n-1]) && isVersion(parts[n-2]) {
+		d.Build = parts[n-1]
+		parts = parts[:n-1]
+	}
+	n = len(parts)
+	if !isVersion(parts[n-1]) {
+		return dist{}, false
+	}
+	d.Name = normalize(strings.Join(parts[:n-1], "-"))
+	d.Version = parts[n-1]
+	return d, true
 }
 
-func Handle(p *policy.Policy, path string, r *http.Request) *session.Activity {
+func parseSdist(name string) (dist, bool) {
+	for _, ext := range sdistExtensions {
+		if !strings.HasSuffix(name, ext) {
+			continue
+		}
+		// legacy sdists leave the dashes of the name in place, the version
+		// follows the last one
+		i := strings.LastIndex(strings.TrimSuffix(name, ext), "-")
+		if i <= 0 || !isVersion(name[i+1:]) {
+			return dist{}, false
+		}
+		return dist{Name: normalize(name[:i]), Version: strings.TrimSuffix(name[i+1:], ext)}, true
+	}
+	return dist{}, false
+}
 
-	if r.Host != "files.pythonhosted.org" {
-		return session.NilActivity
+// parseDist returns the distribution a file is named for
+func parseDist(url string) (dist, bool) {
+	name := path.Base(url)
+	if strings.HasSuffix(name, ".whl") {
+		return parseWheel(name)
 	}
+	return parseSdist(name)
+}
+
+func parse(url string) (string, string, bool) {
+	d, ok := parseDist(url)
+	return d.Name, d.Version, ok
+}
 
-	pkg, ver, act := parse(path)
+// parseIndex returns the action and project of an index lookup, the Simple
+// API at [+]simple/<name>/ and the JSON API at pypi/<name>[/<version>]/json.
+// devpi serves +simple and Artifactory nests both under api/pypi/<repo>.
+func parseIndex(url string) (string, dist, bool) {
+	parts := strings.Split(strings.Trim(url, "/"), "/")
+	n := len(parts)
+	if n >= 2 && (parts[n-2] == "simple" || parts[n-2] == "+simple") {
+		return "simple", dist{Name: normalize(parts[n-1])}, true
+	}
+	if n >= 3 && parts[n-1] == "json" {
+		if parts[n-3] == "pypi" {
+			return "json", dist{Name: normalize(parts[n-2])}, true
+		}
+		if n >= 4 && parts[n-4] == "pypi" {
+			return "json", dist{Name: normalize(parts[n-3]), Version: parts[n-2]}, true
+		}
+	}
+	return "", dist{}, false
+}
 
+// Handle records distribution downloads as get and index lookups as simple or
+// json
+func Handle(p *policy.Policy, path string, r *http.Request) *session.Activity {
+	action := "get"
+	d, act := parseDist(path)
+	if !act {
+		action, d, act = parseIndex(path)
+	}
 	if !act {
 		return session.NilActivity
 	}
-	purl := fmt.Sprintf("pkg:%s/%s@%s", model.Pypi, pkg, ver)
 	return &session.Activity{
 		ActivityHdr: model.ActivityHdr{
 			Name:   model.Pypi,
-			Action: "get",
+			Action: action,
 		},
 		Activity: model.PackageActivity{
 			Repo:    r.Host,
-			Package: pkg,
-			Version: ver,
-			Purl:    purl,
+			Package: d.Name,
+			Version: d.Version,
+			Purl:    d.Purl(),
 		},
 	}
 }
@@ -1,9 +1,12 @@
 package pypi // Parse valid PyPI package URL with package name and version number
 import (
 	"net/http"
+	"strings"
 	"testing"
 
+	"github.com/invisirisk/svcs/model"
 	"github.com/stretchr/testify/assert"
+	"inivisirisk.com/pse/integrity"
 	"inivisirisk.com/pse/policy"
 	"inivisirisk.com/pse/session"
 )
@@ -96,3 +99,96 @@ func TestParseNoVersionNumber(t *testing.T) {
         t.Errorf("Expected false, got true")
     }
 }
+
+func TestPublished(t *testing.T) {
+	reg := NewRegistry()
+	sha := "4ad3c4b5d9a2e3f0a8f7e2b9c0d1e2f3a4b5c6d7e8f9a0b1c2d3e4f5a6b7c8d9"
+	simple := `<!DOCTYPE html><html><body>
+<a href="../../packages/d9/61/somepacakge-1.0.0-py3-none-any.whl#sha256=` + sha + `" data-requires-python="&gt;=3.7">somepacakge-1.0.0-py3-none-any.whl</a>
+<a href="https://files.pythonhosted.org/packages/aa/bb/somepacakge-1.0.0.tar.gz">somepacakge-1.0.0.tar.gz</a>
+</body></html>`
+	req, _ := http.NewRequest("GET", "https://files.pythonhosted.org/simple/somepacakge/", nil)
+	rsp := &http.Response{Request: req, Header: http.Header{"Content-Type": {"text/html"}}}
+	digests, err := reg.Published(rsp, strings.NewReader(simple))
+	assert.NoError(t, err)
+	assert.Equal(t, []integrity.Digest{{
+		Key:       "files.pythonhosted.org/packages/d9/61/somepacakge-1.0.0-py3-none-any.whl",
+		Algorithm: integrity.SHA256,
+		Value:     sha,
+		Source:    "pypi simple #sha256",
+	}}, digests)
+
+	// the files of other releases are not published
+	old := `{"url": "https://files.pythonhosted.org/packages/aa/bb/somepacakge-0.9.0.tar.gz", "digests": {"sha256": "` + sha + `"}}`
+	json := `{"info": {"name": "somepacakge"}, "urls": [{"url": "` + url + `", "digests": {"md5": "00", "sha256": "` + strings.ToUpper(sha) + `"}}], "releases": {"0.9.0": [` + old + `]}}`
+	req, _ = http.NewRequest("GET", "https://pypi.org/pypi/somepacakge/json", nil)
+	rsp = &http.Response{Request: req, Header: http.Header{"Content-Type": {"application/json"}}}
+	digests, err = reg.Published(rsp, strings.NewReader(json))
+	assert.NoError(t, err)
+	assert.Len(t, digests, 1)
+	assert.Equal(t, sha, digests[0].Value)
+
+	download, _ := http.NewRequest("GET", url, nil)
+	assert.Equal(t, digests[0].Key, reg.Key(download.URL))
+	assert.Empty(t, reg.Key(req.URL))
+}
+
+func TestParseDist(t *testing.T) {
+	tests := []struct {
+		file string
+		dist dist
+		purl string
+	}{
+		{"foo-bar-1.0.tar.gz", dist{Name: "foo-bar", Version: "1.0"}, "pkg:pypi/foo-bar@1.0"},
+		{"Foo_Bar-1.0.tar.gz", dist{Name: "foo-bar", Version: "1.0"}, "pkg:pypi/foo-bar@1.0"},
+		{"zope.interface-6.0.zip", dist{Name: "zope-interface", Version: "6.0"}, "pkg:pypi/zope-interface@6.0"},
+		{"/packages/aa/bb/Django-4.2.1-py3-none-any.whl",
+			dist{Name: "django", Version: "4.2.1", Python: "py3", ABI: "none", Platform: "any"},
+			"pkg:pypi/django@4.2.1?abi=none&platform=any&python=py3"},
+		{"numpy-1.26.0-1-cp311-cp311-manylinux_2_17_x86_64.manylinux2014_x86_64.whl",
+			dist{Name: "numpy", Version: "1.26.0", Build: "1", Python: "cp311", ABI: "cp311", Platform: "manylinux_2_17_x86_64.manylinux2014_x86_64"},
+			"pkg:pypi/numpy@1.26.0?abi=cp311&build=1&platform=manylinux_2_17_x86_64.manylinux2014_x86_64&python=cp311"},
+	}
+	for _, test := range tests {
+		d, ok := parseDist(test.file)
+		assert.True(t, ok, test.file)
+		assert.Equal(t, test.dist, d)
+		assert.Equal(t, test.purl, d.Purl())
+	}
+	for _, file := range []string{"foo.tar.gz", "foo-bar.whl", "foo-1.0.exe", "index.html"} {
+		_, ok := parseDist(file)
+		assert.False(t, ok, file)
+	}
+}
+
+func TestHandleIndex(t *testing.T) {
+	tests := []struct {
+		url     string
+		path    string
+		action  string
+		pkg     string
+		version string
+	}{
+		{"https://pypi.org/simple/Foo_Bar/", "/simple/Foo_Bar/", "simple", "foo-bar", ""},
+		{"https://pypi.org/pypi/requests/json", "/pypi/requests/json", "json", "requests", ""},
+		{"https://pypi.org/pypi/requests/2.31.0/json", "/pypi/requests/2.31.0/json", "json", "requests", "2.31.0"},
+		{"https://devpi.example.com/root/pypi/+simple/requests/", "/root/pypi/+simple/requests/", "simple", "requests", ""},
+		{"https://devpi.example.com/root/pypi/+f/3a1/b2c/requests-2.31.0.tar.gz", "/root/pypi/+f/3a1/b2c/requests-2.31.0.tar.gz", "get", "requests", "2.31.0"},
+		{"https://example.jfrog.io/artifactory/api/pypi/pypi-remote/simple/requests/", "/artifactory/api/pypi/pypi-remote/simple/requests/", "simple", "requests", ""},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", test.url, nil)
+		act := Handle(nil, test.path, req)
+		if !assert.NotEqual(t, session.NilActivity, act, test.url) {
+			continue
+		}
+		assert.Equal(t, test.action, act.Action)
+		pkg := act.Activity.(model.PackageActivity)
+		assert.Equal(t, test.pkg, pkg.Package)
+		assert.Equal(t, test.version, pkg.Version)
+		assert.Equal(t, req.Host, pkg.Repo)
+	}
+
+	req, _ := http.NewRequest("GET", "https://pypi.org/simple/", nil)
+	assert.Equal(t, session.NilActivity, Handle(nil, "/simple/", req))
+}
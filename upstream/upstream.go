@@ -0,0 +1,191 @@
+package upstream
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+	"inivisirisk.com/pse/config"
+)
+
+// Upstream routes outgoing connections through the configured parent proxy
+type Upstream struct {
+	proxy  func(*url.URL) (*url.URL, error)
+	dialer *net.Dialer
+}
+
+var (
+	current = direct()
+)
+
+func direct() *Upstream {
+	return &Upstream{
+		proxy: func(*url.URL) (*url.URL, error) { return nil, nil },
+		dialer: &net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		},
+	}
+}
+
+// New validates cfg and returns the upstream it describes
+func New(cfg config.Upstream) (*Upstream, error) {
+	u := direct()
+	if cfg.URL == "" {
+		return u, nil
+	}
+	parent, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("malformed upstream proxy url: %w", err)
+	}
+	switch parent.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("unsupported upstream proxy scheme %q", parent.Scheme)
+	}
+	if parent.Host == "" {
+		return nil, fmt.Errorf("upstream proxy url %v has no host", cfg.URL)
+	}
+	if cfg.Username != "" {
+		parent.User = url.UserPassword(cfg.Username, cfg.Password)
+	}
+	pc := &httpproxy.Config{
+		HTTPProxy:  parent.String(),
+		HTTPSProxy: parent.String(),
+		NoProxy:    strings.Join(cfg.NoProxy, ","),
+	}
+	u.proxy = pc.ProxyFunc()
+	return u, nil
+}
+
+// Set replaces the upstream used by Get
+func Set(cfg config.Upstream) error {
+	u, err := New(cfg)
+	if err != nil {
+		return err
+	}
+	current = u
+	return nil
+}
+
+// Get returns the upstream set last, connections are direct until Set is
+// called.
+func Get() *Upstream {
+	return current
+}
+
+// Proxy has the signature of http.Transport.Proxy
+func (u *Upstream) Proxy(r *http.Request) (*url.URL, error) {
+	return u.proxy(r.URL)
+}
+
+// Transport returns a transport chained through the parent proxy
+func (u *Upstream) Transport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = u.Proxy
+	t.DialContext = u.dialer.DialContext
+	return t
+}
+
+// Client returns a client using Transport
+func (u *Upstream) Client(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Transport: u.Transport(),
+		Timeout:   timeout,
+	}
+}
+
+// DialContext opens a TCP connection to addr through the parent proxy, an
+// HTTP parent is asked for a CONNECT tunnel.
+func (u *Upstream) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	parent, err := u.proxy(&url.URL{Scheme: "https", Host: addr})
+	if err != nil {
+		return nil, err
+	}
+	if parent == nil {
+		return u.dialer.DialContext(ctx, network, addr)
+	}
+	if parent.Scheme == "socks5" {
+		var auth *proxy.Auth
+		if parent.User != nil {
+			password, _ := parent.User.Password()
+			auth = &proxy.Auth{User: parent.User.Username(), Password: password}
+		}
+		d, err := proxy.SOCKS5("tcp", parent.Host, auth, u.dialer)
+		if err != nil {
+			return nil, err
+		}
+		return d.(proxy.ContextDialer).DialContext(ctx, network, addr)
+	}
+	return u.connect(ctx, parent, addr)
+}
+
+func (u *Upstream) connect(ctx context.Context, parent *url.URL, addr string) (net.Conn, error) {
+	host := parent.Host
+	if parent.Port() == "" {
+		host = net.JoinHostPort(parent.Hostname(), map[string]string{"http": "80", "https": "443"}[parent.Scheme])
+	}
+	conn, err := u.dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	if parent.Scheme == "https" {
+		tc := tls.Client(conn, &tls.Config{ServerName: parent.Hostname()})
+		if err := tc.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("upstream proxy handshake: %w", err)
+		}
+		conn = tc
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if parent.User != nil {
+		password, _ := parent.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(parent.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	rsp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("upstream proxy refused CONNECT to %v: %v", addr, rsp.Status)
+	}
+	return &bufConn{Conn: conn, r: br}, nil
+}
+
+// bufConn keeps reading from the buffer used for the CONNECT response
+type bufConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
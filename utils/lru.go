@@ -0,0 +1,125 @@
+package utils
+
+import (
+	"container/list"
+	"sync"
+)
+
+// LRU is a fixed size cache evicting the least recently used entry first. It
+// is safe for concurrent use.
+type LRU[K comparable, V any] struct {
+	mutex sync.Mutex
+	size  int
+	used  int
+	cost  func(V) int
+	ll    *list.List
+	items map[K]*list.Element
+}
+
+type lruEntry[K comparable, V any] struct {
+	key   K
+	value V
+	cost  int
+}
+
+// NewLRU returns an LRU of up to size entries
+func NewLRU[K comparable, V any](size int) *LRU[K, V] {
+	return NewLRUCost[K, V](size, func(V) int { return 1 })
+}
+
+// NewLRUCost returns an LRU bounded by the total cost of its values, such as
+// their size in bytes. A value costing more than size is not kept.
+func NewLRUCost[K comparable, V any](size int, cost func(V) int) *LRU[K, V] {
+	return &LRU[K, V]{
+		size:  size,
+		cost:  cost,
+		ll:    list.New(),
+		items: make(map[K]*list.Element),
+	}
+}
+
+// Get returns the value of key and marks it as used
+func (c *LRU[K, V]) Get(key K) (V, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	e, ok := c.items[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	c.ll.MoveToFront(e)
+	return e.Value.(*lruEntry[K, V]).value, true
+}
+
+// Put sets the value of key, evicting the least recently used entry when the
+// cache is full
+func (c *LRU[K, V]) Put(key K, value V) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.put(key, value)
+}
+
+// put is Put, the mutex must be held
+func (c *LRU[K, V]) put(key K, value V) {
+	cost := c.cost(value)
+	if e, ok := c.items[key]; ok {
+		en := e.Value.(*lruEntry[K, V])
+		c.used += cost - en.cost
+		en.value, en.cost = value, cost
+		c.ll.MoveToFront(e)
+	} else {
+		c.items[key] = c.ll.PushFront(&lruEntry[K, V]{key: key, value: value, cost: cost})
+		c.used += cost
+	}
+	for c.used > c.size {
+		c.remove(c.ll.Back())
+	}
+}
+
+// remove drops e, the mutex must be held
+func (c *LRU[K, V]) remove(e *list.Element) {
+	en := e.Value.(*lruEntry[K, V])
+	c.ll.Remove(e)
+	delete(c.items, en.key)
+	c.used -= en.cost
+}
+
+// Update sets the value of key to the one f returns for the current value,
+// ok tells whether there was one. f runs under the lock of the cache and
+// must not use it.
+func (c *LRU[K, V]) Update(key K, f func(value V, ok bool) V) V {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var value V
+	e, ok := c.items[key]
+	if ok {
+		value = e.Value.(*lruEntry[K, V]).value
+	}
+	value = f(value, ok)
+	c.put(key, value)
+	return value
+}
+
+// Remove drops key
+func (c *LRU[K, V]) Remove(key K) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if e, ok := c.items[key]; ok {
+		c.remove(e)
+	}
+}
+
+// Clear drops every entry
+func (c *LRU[K, V]) Clear() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.ll.Init()
+	c.items = make(map[K]*list.Element)
+	c.used = 0
+}
+
+func (c *LRU[K, V]) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.ll.Len()
+}
@@ -0,0 +1,61 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLRU(t *testing.T) {
+	c := NewLRU[string, int](2)
+	c.Put("a", 1)
+	c.Put("b", 2)
+	// a is used last, b is evicted
+	v, ok := c.Get("a")
+	require.True(t, ok)
+	require.Equal(t, 1, v)
+	c.Put("c", 3)
+	_, ok = c.Get("b")
+	require.False(t, ok)
+	require.Equal(t, 2, c.Len())
+
+	require.Equal(t, 4, c.Update("a", func(v int, ok bool) int {
+		require.True(t, ok)
+		return v + 3
+	}))
+	require.Equal(t, 1, c.Update("d", func(v int, ok bool) int {
+		require.False(t, ok)
+		return 1
+	}))
+	_, ok = c.Get("c")
+	require.False(t, ok)
+
+	c.Remove("a")
+	_, ok = c.Get("a")
+	require.False(t, ok)
+	c.Clear()
+	require.Equal(t, 0, c.Len())
+}
+
+func TestLRUCost(t *testing.T) {
+	c := NewLRUCost[string, string](8, func(v string) int { return len(v) })
+	c.Put("a", "abc")
+	c.Put("b", "defg")
+	c.Put("c", "hi")
+	// a is evicted to fit c
+	_, ok := c.Get("a")
+	require.False(t, ok)
+	require.Equal(t, 2, c.Len())
+
+	// a larger value evicts the least recently used
+	c.Get("b")
+	c.Put("c", "hijk")
+	require.Equal(t, 2, c.Len())
+	c.Put("d", "lm")
+	_, ok = c.Get("b")
+	require.False(t, ok)
+
+	// values over the bound are not kept
+	c.Put("e", "nopqrstuvw")
+	require.Equal(t, 0, c.Len())
+}
@@ -1,14 +1,18 @@
 package utils
 
 import (
-	"bytes"
 	"context"
 	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"strings"
+	"sync"
 
 	"github.com/gabriel-vasile/mimetype"
 	"github.com/invisirisk/clog"
@@ -17,10 +21,14 @@ import (
 
 type activityCtxKey struct{}
 type secretCtxKey struct{}
+type sessionCtxKey struct{}
 
 var (
 	ActCtxKey       = activityCtxKey{}
 	SecretPolicyCtx = secretCtxKey{}
+	// SessionCtxKey holds the session the activity was added to, changes to
+	// the activity after that are made under its lock
+	SessionCtxKey = sessionCtxKey{}
 
 	alertLevel = map[model.AlertLevel]int{
 		model.AlertNone:     0,
@@ -30,6 +38,21 @@ var (
 	}
 )
 
+// Updater is the session held by SessionCtxKey
+type Updater interface {
+	Update(update func()) bool
+}
+
+// UpdateActivity runs update, which changes the activity of ctx, under the
+// lock of the session the activity was added to
+func UpdateActivity(ctx context.Context, update func()) {
+	if u, ok := ctx.Value(SessionCtxKey).(Updater); ok {
+		u.Update(update)
+		return
+	}
+	update()
+}
+
 type Chain interface {
 	Handle(ctx context.Context, r io.Reader) error
 }
@@ -41,16 +64,18 @@ func appendCheck(ctx context.Context, check ...model.TechCheck) {
 	v := ctx.Value(ActCtxKey)
 
 	if act, ok := v.(*model.Activity); ok {
-		for _, ch := range check {
-			if act.AlertLevel != model.AlertNone && act.Decision != model.Deny {
-				act.Decision = model.Alert
+		UpdateActivity(ctx, func() {
+			for _, ch := range check {
+				if act.AlertLevel != model.AlertNone && act.Decision != model.Deny {
+					act.Decision = model.Alert
+				}
+
+				if AlertLt(act.AlertLevel, ch.AlertLevel) {
+					act.AlertLevel = ch.AlertLevel
+				}
 			}
-
-			if AlertLt(act.AlertLevel, ch.AlertLevel) {
-				act.AlertLevel = ch.AlertLevel
-			}
-		}
-		act.Checks = append(act.Checks, check...)
+			act.Checks = append(act.Checks, check...)
+		})
 	} else {
 		cl.Errorf("invalid activity type %T", v)
 	}
@@ -59,32 +84,151 @@ type ResponseData struct{
 	Response *http.Response
 	Mime string
 	Checksum string // md5 checksum
+	SHA1 string
+	SHA256 string
+	SHA512 string
 	FileSizeByte int64
+	// Integrity is verified or mismatch when the registry published a digest
+	Integrity string
+	// Metadata the registry published about the package version, such as
+	// npm install scripts
+	Metadata interface{}
 }
+// Verdict is called by a streaming ReaderChain once every chain has consumed
+// the whole body, before the last chunk is released to the reader. A non-nil
+// error aborts the stream and is returned to the reader in place of io.EOF.
+type Verdict func(ctx context.Context) error
+
+const (
+	chainChunkSize = 32 * 1024
+)
+
+var (
+	errChainClosed = errors.New("reader chain closed before end of stream")
+)
+
+// ReaderChain streams bottom to the returned reader while every chain consumes
+// its own copy of the stream. Results held by the chains are only complete once
+// the returned reader has been read to io.EOF.
 func ReaderChain(ctx context.Context, bottom io.ReadCloser, chains ...Chain) io.ReadCloser {
-    // Read initial content
-    content, err := io.ReadAll(bottom)
-    if err != nil {
-        log.Printf("Error reading initial content: %v", err)
-        return bottom
-    }
-
-    cl := clog.FromCtx(ctx)
-    cl.Infof("content size %v", len(content))
-
-    // Process through each chain sequentially
-    for _, chain := range chains {
-        // Create a new reader for each chain to ensure data is not consumed
-        chainReader := bytes.NewReader(content)
-
-        if err := chain.Handle(ctx, chainReader); err != nil {
-            log.Printf("Error in chain.Handle: %v", err)
-            return io.NopCloser(bytes.NewReader(content)) // Return original content on error
-        }
-    }
-
-    // Return the final processed content
-    return io.NopCloser(bytes.NewReader(content))
+	return VerdictReaderChain(ctx, bottom, nil, chains...)
+}
+
+// VerdictReaderChain is ReaderChain with a verdict applied at the end of the
+// stream. Memory use is bounded by two chunks regardless of the body size.
+func VerdictReaderChain(ctx context.Context, bottom io.ReadCloser, verdict Verdict, chains ...Chain) io.ReadCloser {
+	cr := &chainReader{
+		ctx:     ctx,
+		bottom:  bottom,
+		verdict: verdict,
+		bufs:    [2][]byte{make([]byte, chainChunkSize), make([]byte, chainChunkSize)},
+	}
+	writers := make([]io.Writer, 0, len(chains))
+	for _, chain := range chains {
+		pr, pw := io.Pipe()
+		cr.pipes = append(cr.pipes, pw)
+		writers = append(writers, pw)
+		cr.wg.Add(1)
+		go cr.run(chain, pr)
+	}
+	cr.fanout = io.MultiWriter(writers...)
+	return cr
+}
+
+type chainReader struct {
+	ctx     context.Context
+	bottom  io.ReadCloser
+	verdict Verdict
+	pipes   []*io.PipeWriter
+	fanout  io.Writer
+	wg      sync.WaitGroup
+
+	bufs [2][]byte
+	cur  int
+	// held is the most recent chunk, kept back until the next read succeeds
+	// or the verdict has been given
+	held  []byte
+	out   []byte
+	size  int64
+	err   error
+	ended bool
+}
+
+func (cr *chainReader) run(chain Chain, pr *io.PipeReader) {
+	cl := clog.FromCtx(cr.ctx)
+	defer cr.wg.Done()
+	defer func() {
+		if r := recover(); r != nil {
+			cl.Errorf("panic in chain %T: %v", chain, r)
+		}
+		// chains such as mime detection stop early, keep the fan-out moving
+		io.Copy(io.Discard, pr)
+	}()
+	if err := chain.Handle(cr.ctx, pr); err != nil {
+		cl.Errorf("error in chain %T: %v", chain, err)
+	}
+}
+
+func (cr *chainReader) Read(p []byte) (int, error) {
+	for len(cr.out) == 0 {
+		if cr.err != nil {
+			return 0, cr.err
+		}
+		cr.fill()
+	}
+	n := copy(p, cr.out)
+	cr.out = cr.out[n:]
+	return n, nil
+}
+
+func (cr *chainReader) fill() {
+	buf := cr.bufs[cr.cur]
+	n, err := cr.bottom.Read(buf)
+	if n > 0 {
+		// the other buffer is free once held moves to out
+		cr.cur ^= 1
+		cr.size += int64(n)
+		cr.fanout.Write(buf[:n])
+		cr.out, cr.held = cr.held, buf[:n]
+	}
+	if err != nil {
+		cr.end(err)
+		if cr.err == io.EOF {
+			cr.out = append(cr.out, cr.held...)
+		}
+		cr.held = nil
+	}
+}
+
+// end closes the fan-out, waits for every chain and applies the verdict
+func (cr *chainReader) end(err error) {
+	if cr.ended {
+		return
+	}
+	cr.ended = true
+	cl := clog.FromCtx(cr.ctx)
+	for _, pw := range cr.pipes {
+		if err == io.EOF {
+			pw.Close()
+		} else {
+			pw.CloseWithError(err)
+		}
+	}
+	cr.wg.Wait()
+	cl.Infof("content size %v", cr.size)
+
+	cr.err = err
+	if err == io.EOF && cr.verdict != nil {
+		if verr := cr.verdict(cr.ctx); verr != nil {
+			cl.Errorf("stream rejected by verdict %v", verr)
+			cr.err = verr
+		}
+	}
+}
+
+func (cr *chainReader) Close() error {
+	cr.end(errChainClosed)
+	return cr.bottom.Close()
 }
 
 type MimeChain struct {
@@ -108,17 +252,23 @@ func (mc *MimeChain) Handle(ctx context.Context, r io.Reader) error {
 
 type Checksum struct {
 	Direction string
-	Checksum  string
+	Checksum  string // md5 checksum
+	SHA1      string
+	SHA256    string
+	SHA512    string
 }
 
 func (sc *Checksum) Handle(ctx context.Context, r io.Reader) error {
-	// Calculate the MD5 checksum of the content and adds it to the activity log
+	// Calculate the checksums of the content in a single pass and adds them to the activity log
 	_, cl := clog.WithCtx(ctx, "md5")
-	h := md5.New()
-	if _, err := io.Copy(h, r); err != nil {
-		cl.Errorf("error %v calculating checksum")
+	hmd5, hsha1, hsha256, hsha512 := md5.New(), sha1.New(), sha256.New(), sha512.New()
+	if _, err := io.Copy(io.MultiWriter(hmd5, hsha1, hsha256, hsha512), r); err != nil {
+		cl.Errorf("error %v calculating checksum", err)
 	}
-	sc.Checksum = fmt.Sprintf("%x", h.Sum(nil))
+	sc.Checksum = fmt.Sprintf("%x", hmd5.Sum(nil))
+	sc.SHA1 = fmt.Sprintf("%x", hsha1.Sum(nil))
+	sc.SHA256 = fmt.Sprintf("%x", hsha256.Sum(nil))
+	sc.SHA512 = fmt.Sprintf("%x", hsha512.Sum(nil))
 	log.Print("Checksum: ", sc.Checksum)
 
 	return nil
@@ -130,7 +280,9 @@ type PHPCheck struct {
 
 // Handle inspects the response and extracts the package name and version.
 //
-// It only extracts info if the activity is a Composer activity.
+// It only extracts info if the activity is a Composer activity whose version
+// is unknown, downloads listed in repository metadata are attributed by the
+// Composer handler already.
 //
 // It uses the Content-Disposition header to determine the package name and version.
 //
@@ -156,6 +308,9 @@ func (sc *PHPCheck) Handle(ctx context.Context, r io.Reader) error {
 
 		if activityDetail, ok := act.Activity.(model.PackageActivity); ok {
 			cl.Infof("package name from activity: %v", activityDetail.Package)
+			if activityDetail.Version != "" {
+				return nil
+			}
 			packageName = activityDetail.Package
 		} else {
 			packageName = ""
@@ -176,13 +331,20 @@ func (sc *PHPCheck) Handle(ctx context.Context, r io.Reader) error {
 			return nil
 		}
 		if packageName == "" {
-			packageName = vendor + "/" + name
+			packageName = strings.ToLower(vendor + "/" + name)
 		}
-		act.Activity = model.PackageActivity{
-			Package: packageName,
-			Version: version,
-			Repo:    sc.Response.Request.Host,
+		purl := fmt.Sprintf("pkg:%s/%s", model.Composer, packageName)
+		if version != "" {
+			purl += "@" + version
 		}
+		UpdateActivity(ctx, func() {
+			act.Activity = model.PackageActivity{
+				Package: packageName,
+				Version: version,
+				Repo:    sc.Response.Request.Host,
+				Purl:    purl,
+			}
+		})
 	}
 
 	return nil
@@ -200,8 +362,6 @@ func (sc *PHPCheck) Handle(ctx context.Context, r io.Reader) error {
 func ExtractPackageInfo(url, disposition string) (vendor, packageName, version string, err error) {
 	// Extract vendor and package name from URL
 	urlParts := strings.Split(url, "/")
-	fmt.Printf("Urlparts: %d", len(urlParts))
-	fmt.Printf("Part 4: %s", urlParts[5])
 	if len(urlParts) < 6 || urlParts[5] != "legacy.zip" {
 		return "", "", "", fmt.Errorf("invalid URL format: %s", url)
 	}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"strings"
@@ -104,6 +105,9 @@ func TestReaderChainForBlankFile(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, "text/plain", dm.Mime)
 	assert.Equal(t, "d41d8cd98f00b204e9800998ecf8427e", sc.Checksum)
+	assert.Equal(t, "da39a3ee5e6b4b0d3255bfef95601890afd80709", sc.SHA1)
+	assert.Equal(t, "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", sc.SHA256)
+	assert.Equal(t, "cf83e1357eefb8bdf1542850d66d8007d620e4050b5715dc83f4a921d36ce9ce47d0d13c5d85f2b0ff8318d2877eec2f63b931bd47417a81a538327af927da3e", sc.SHA512)
 	assert.Equal(t, int64(0), fs.ByteSize)
 }
 func TestActivityLogUpdate(t *testing.T) {
@@ -322,3 +326,120 @@ func TestPHPCheckHandleNilResponseReturnsEarly(t *testing.T) {
 
     assert.NoError(t, err)
 }
+
+func TestExtractPackageInfoShortURL(t *testing.T) {
+	_, _, _, err := ExtractPackageInfo("https://codeload.github.com/PHPMailer", "")
+	assert.Error(t, err)
+}
+
+func TestPHPCheckKeepsKnownVersion(t *testing.T) {
+	activity := &model.Activity{
+		ActivityHdr: model.ActivityHdr{Name: model.Composer},
+		Activity:    model.PackageActivity{Package: "phpmailer/phpmailer", Version: "v6.9.1"},
+	}
+	ctx := context.WithValue(context.Background(), ActCtxKey, activity)
+	req := httptest.NewRequest("GET", "https://codeload.github.com/PHPMailer/PHPMailer/legacy.zip/a7b17b42fa4887c92146243f3d2f4ccb962af17c", nil)
+	rsp := &http.Response{Request: req, Header: http.Header{"Content-Disposition": {"attachment; filename=PHPMailer-PHPMailer-v6.9.2-0-ga7b17b4.zip"}}}
+
+	require.NoError(t, (&PHPCheck{Response: rsp}).Handle(ctx, bytes.NewReader(nil)))
+	assert.Equal(t, "v6.9.1", activity.Activity.(model.PackageActivity).Version)
+}
+
+func TestReaderChainStreamsLargeBody(t *testing.T) {
+	const size = 64 << 20
+	act := &session.Activity{}
+	ctx := context.WithValue(context.Background(), ActCtxKey, act)
+
+	fs := &FileSize{}
+	sc := &Checksum{}
+	var verdictSize int64
+	top := VerdictReaderChain(ctx, io.NopCloser(io.LimitReader(zeroReader{}, size)), func(ctx context.Context) error {
+		verdictSize = fs.ByteSize
+		return nil
+	}, &MimeChain{}, sc, fs)
+	n, err := io.Copy(io.Discard, top)
+	require.NoError(t, err)
+	require.NoError(t, top.Close())
+	assert.Equal(t, int64(size), n)
+	assert.Equal(t, int64(size), verdictSize)
+	assert.Equal(t, "7f614da9329cd3aebf59b91aadc30bf0", sc.Checksum)
+}
+
+func TestReaderChainVerdictWithholdsLastChunk(t *testing.T) {
+	data, err := os.ReadFile("testdata/test.zip")
+	require.NoError(t, err)
+	act := &session.Activity{}
+	ctx := context.WithValue(context.Background(), ActCtxKey, act)
+
+	denied := fmt.Errorf("denied")
+	top := VerdictReaderChain(ctx, io.NopCloser(bytes.NewReader(data)), func(ctx context.Context) error {
+		return denied
+	}, &Checksum{})
+	d, err := io.ReadAll(top)
+	assert.ErrorIs(t, err, denied)
+	assert.Less(t, len(d), len(data))
+	assert.Equal(t, data[:len(d)], d)
+}
+
+func TestReaderChainCloseBeforeEOF(t *testing.T) {
+	act := &session.Activity{}
+	ctx := context.WithValue(context.Background(), ActCtxKey, act)
+
+	called := false
+	top := VerdictReaderChain(ctx, io.NopCloser(io.LimitReader(zeroReader{}, 1<<20)), func(ctx context.Context) error {
+		called = true
+		return nil
+	}, &MimeChain{}, &Checksum{}, &FileSize{})
+	buf := make([]byte, 10)
+	_, err := top.Read(buf)
+	require.NoError(t, err)
+	require.NoError(t, top.Close())
+	assert.False(t, called)
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// stutterReader returns (0, nil) before every read of r
+type stutterReader struct {
+	r       io.Reader
+	stutter bool
+}
+
+func (s *stutterReader) Read(p []byte) (int, error) {
+	s.stutter = !s.stutter
+	if s.stutter {
+		return 0, nil
+	}
+	if len(p) > 1000 {
+		p = p[:1000]
+	}
+	return s.r.Read(p)
+}
+
+func TestReaderChainEmptyReads(t *testing.T) {
+	data := make([]byte, 10000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	act := &session.Activity{}
+	ctx := context.WithValue(context.Background(), ActCtxKey, act)
+	top := ReaderChain(ctx, io.NopCloser(&stutterReader{r: bytes.NewReader(data)}), &FileSize{})
+	var got []byte
+	buf := make([]byte, 300)
+	for {
+		n, err := top.Read(buf)
+		got = append(got, buf[:n]...)
+		if err != nil {
+			require.ErrorIs(t, err, io.EOF)
+			break
+		}
+	}
+	assert.Equal(t, data, got)
+}
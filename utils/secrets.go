@@ -150,10 +150,12 @@ func updateDecisionBySecret(ctx context.Context, on_secret_action model.Decision
 		return
 	}
 
-	if on_secret_action == model.Deny {
-		act.Decision = model.Deny
-	}
-	if on_secret_action == model.Alert && act.Decision != model.Deny {
-		act.Decision = model.Alert
-	}
+	UpdateActivity(ctx, func() {
+		if on_secret_action == model.Deny {
+			act.Decision = model.Deny
+		}
+		if on_secret_action == model.Alert && act.Decision != model.Deny {
+			act.Decision = model.Alert
+		}
+	})
 }